@@ -7,10 +7,13 @@ import (
 	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xretry"
+	"github.com/net-byte/vtun/transport/protocol/dns"
 	"github.com/net-byte/vtun/transport/protocol/dtls"
 	"github.com/net-byte/vtun/transport/protocol/grpc"
 	"github.com/net-byte/vtun/transport/protocol/h1"
 	"github.com/net-byte/vtun/transport/protocol/h2"
+	"github.com/net-byte/vtun/transport/protocol/icmp"
 	"github.com/net-byte/vtun/transport/protocol/kcp"
 	"github.com/net-byte/vtun/transport/protocol/quic"
 	"github.com/net-byte/vtun/transport/protocol/tcp"
@@ -41,6 +44,9 @@ func (app *App) InitConfig() {
 	if !app.Config.ServerMode {
 		app.Config.LocalGateway = netutil.DiscoverGateway(true)
 		app.Config.LocalGatewayv6 = netutil.DiscoverGateway(false)
+		xretry.SetStateListener(func(s xretry.State) {
+			log.Printf("client state -> %v", s)
+		})
 	}
 	app.Config.BufferSize = 64 * 1024
 	cipher.SetKey(app.Config.Key)
@@ -60,7 +66,9 @@ func (app *App) StartApp() {
 		}
 	case "ws", "wss":
 		if app.Config.ServerMode {
-			ws.StartServer(app.Iface, *app.Config)
+			if err := ws.StartServer(app.Iface, *app.Config); err != nil {
+				log.Panic(err)
+			}
 		} else {
 			ws.StartClient(app.Iface, *app.Config)
 		}
@@ -112,12 +120,24 @@ func (app *App) StartApp() {
 		} else {
 			tcp.StartClient(app.Iface, *app.Config)
 		}
-	case "http", "https":
+	case "http", "https", "http-poll", "https-poll":
 		if app.Config.ServerMode {
 			h1.StartServer(app.Iface, *app.Config)
 		} else {
 			h1.StartClient(app.Iface, *app.Config)
 		}
+	case "icmp":
+		if app.Config.ServerMode {
+			icmp.StartServer(app.Iface, *app.Config)
+		} else {
+			icmp.StartClient(app.Iface, *app.Config)
+		}
+	case "dns":
+		if app.Config.ServerMode {
+			dns.StartServer(app.Iface, *app.Config)
+		} else {
+			dns.StartClient(app.Iface, *app.Config)
+		}
 	default:
 		if app.Config.ServerMode {
 			udp.StartServer(app.Iface, *app.Config)
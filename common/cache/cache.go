@@ -1,15 +1,165 @@
 package cache
 
 import (
+	"sync"
 	"time"
 
+	"github.com/net-byte/vtun/common/x/xchan"
+	"github.com/net-byte/vtun/register"
 	"github.com/patrickmn/go-cache"
 )
 
 // The global cache
 var _cache = cache.New(30*time.Minute, 10*time.Minute)
 
+// The lock of the peer routing entries
+var _routeLock sync.Mutex
+
+// The send groups of the client sessions
+var _groups = make(map[string]*Group)
+
+// The lock of the send groups
+var _groupLock sync.Mutex
+
 // GetCache returns the cache
 func GetCache() *cache.Cache {
 	return _cache
 }
+
+// Peer tracks the routing entries pointing to a server side conn or its send queue
+type Peer struct {
+	conn     any
+	identity string
+	mx       sync.Mutex
+	keys     map[string]struct{}
+}
+
+// NewPeer returns a peer for the conn
+func NewPeer(conn any) *Peer {
+	return &Peer{conn: conn, keys: make(map[string]struct{})}
+}
+
+// SetIdentity sets the verified client identity of the peer, it must be called before routing
+func (p *Peer) SetIdentity(identity string) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.identity = identity
+}
+
+// Identity returns the verified client identity of the peer
+func (p *Peer) Identity() string {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.identity
+}
+
+// Route routes the key to the peer conn until the peer is evicted,
+// it returns false if the key is owned by another client identity
+func (p *Peer) Route(key string) bool {
+	p.mx.Lock()
+	_, ok := p.keys[key]
+	p.mx.Unlock()
+	if ok {
+		if v, ok := _cache.Get(key); ok && v == p.conn {
+			return true
+		}
+	}
+	_routeLock.Lock()
+	defer _routeLock.Unlock()
+	if identity := p.Identity(); identity != "" && !register.ClaimClientIP(key, identity) {
+		return false
+	}
+	_cache.Set(key, p.conn, cache.NoExpiration)
+	p.mx.Lock()
+	p.keys[key] = struct{}{}
+	p.mx.Unlock()
+	return true
+}
+
+// Evict deletes the routing entries still pointing to the peer conn and releases their ip leases
+func (p *Peer) Evict() {
+	_routeLock.Lock()
+	defer _routeLock.Unlock()
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	for key := range p.keys {
+		if v, ok := _cache.Get(key); ok && v == p.conn {
+			_cache.Delete(key)
+			register.DeleteClientIP(key)
+		}
+	}
+	p.keys = make(map[string]struct{})
+}
+
+// Group is the set of send queues of one client session, e.g. the streams of a connection,
+// packets are spread over the queues by flow hash so a flow stays ordered on one queue
+type Group struct {
+	*Peer
+	mx     sync.RWMutex
+	queues []*xchan.SendQueue
+}
+
+// NewGroup returns an empty group
+func NewGroup() *Group {
+	g := &Group{}
+	g.Peer = NewPeer(g)
+	return g
+}
+
+// Add adds the queue to the group
+func (g *Group) Add(q *xchan.SendQueue) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	g.queues = append(g.queues, q)
+}
+
+// Remove removes the queue from the group and returns the number of queues left
+func (g *Group) Remove(q *xchan.SendQueue) int {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	for i, v := range g.queues {
+		if v == q {
+			g.queues = append(g.queues[:i], g.queues[i+1:]...)
+			break
+		}
+	}
+	return len(g.queues)
+}
+
+// Push queues the packet on the queue picked by the flow hash
+func (g *Group) Push(hash uint32, b []byte) bool {
+	g.mx.RLock()
+	defer g.mx.RUnlock()
+	if len(g.queues) == 0 {
+		return false
+	}
+	return g.queues[hash%uint32(len(g.queues))].Push(b)
+}
+
+// JoinGroup adds the queue to the group of the session, the group is created by the first queue
+func JoinGroup(session string, q *xchan.SendQueue) *Group {
+	_groupLock.Lock()
+	defer _groupLock.Unlock()
+	g, ok := _groups[session]
+	if !ok {
+		g = NewGroup()
+		_groups[session] = g
+	}
+	g.Add(q)
+	return g
+}
+
+// LeaveGroup removes the queue from the group of the session,
+// the routes of the group are evicted when its last queue leaves
+func LeaveGroup(session string, q *xchan.SendQueue) {
+	_groupLock.Lock()
+	defer _groupLock.Unlock()
+	g, ok := _groups[session]
+	if !ok {
+		return
+	}
+	if g.Remove(q) == 0 {
+		delete(_groups, session)
+		g.Evict()
+	}
+}
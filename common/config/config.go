@@ -7,60 +7,253 @@ import (
 
 // Config The config struct
 type Config struct {
-	DeviceName                string `json:"device_name"`
-	LocalAddr                 string `json:"local_addr"`
-	ServerAddr                string `json:"server_addr"`
-	ServerIP                  string `json:"server_ip"`
-	ServerIPv6                string `json:"server_ipv6"`
-	CIDR                      string `json:"cidr"`
-	CIDRv6                    string `json:"cidr_ipv6"`
-	Key                       string `json:"key"`
-	Protocol                  string `json:"protocol"`
-	Path                      string `json:"path"`
-	ServerMode                bool   `json:"server_mode"`
-	GlobalMode                bool   `json:"global_mode"`
-	Obfs                      bool   `json:"obfs"`
-	Compress                  bool   `json:"compress"`
-	MTU                       int    `json:"mtu"`
-	Timeout                   int    `json:"timeout"`
-	LocalGateway              string `json:"local_gateway"`
-	LocalGatewayv6            string `json:"local_gateway_ipv6"`
-	TLSCertificateFilePath    string `json:"tls_certificate_file_path"`
-	TLSCertificateKeyFilePath string `json:"tls_certificate_key_file_path"`
-	TLSSni                    string `json:"tls_sni"`
-	TLSInsecureSkipVerify     bool   `json:"tls_insecure_skip_verify"`
-	BufferSize                int    `json:"buffer_size"`
-	Verbose                   bool   `json:"verbose"`
-	PSKMode                   bool   `json:"psk_mode"`
-	Host                      string `json:"host"`
+	DeviceName                      string                 `json:"device_name"`
+	LocalAddr                       string                 `json:"local_addr"`
+	ServerAddr                      string                 `json:"server_addr"`
+	ServerIP                        string                 `json:"server_ip"`
+	ServerIPv6                      string                 `json:"server_ipv6"`
+	CIDR                            string                 `json:"cidr"`
+	CIDRv6                          string                 `json:"cidr_ipv6"`
+	Key                             string                 `json:"key"`
+	Protocol                        string                 `json:"protocol"`
+	Path                            string                 `json:"path"`
+	ServerMode                      bool                   `json:"server_mode"`
+	GlobalMode                      bool                   `json:"global_mode"`
+	Obfs                            bool                   `json:"obfs"`
+	Compress                        bool                   `json:"compress"`
+	MTU                             int                    `json:"mtu"`
+	Timeout                         int                    `json:"timeout"`
+	LocalGateway                    string                 `json:"local_gateway"`
+	LocalGatewayv6                  string                 `json:"local_gateway_ipv6"`
+	TLSCertificateFilePath          string                 `json:"tls_certificate_file_path"`
+	TLSCertificateKeyFilePath       string                 `json:"tls_certificate_key_file_path"`
+	TLSCertificates                 []TLSCertificateConfig `json:"tls_certificates"`
+	TLSSni                          string                 `json:"tls_sni"`
+	TLSInsecureSkipVerify           bool                   `json:"tls_insecure_skip_verify"`
+	TLSCAFilePath                   string                 `json:"tls_ca_file_path"`
+	TLSPins                         []string               `json:"tls_pins"`
+	TLSALPN                         []string               `json:"tls_alpn"`
+	UTLSFingerprint                 string                 `json:"utls_fingerprint"`
+	UTLSHTTP                        bool                   `json:"utls_http"`
+	BufferSize                      int                    `json:"buffer_size"`
+	Verbose                         bool                   `json:"verbose"`
+	PSKMode                         bool                   `json:"psk_mode"`
+	PSKIdentity                     string                 `json:"psk_identity"`
+	PSKIdentities                   map[string]string      `json:"psk_identities"`
+	TLSClientCAFilePath             string                 `json:"tls_client_ca_file_path"`
+	TLSClientCertificateFilePath    string                 `json:"tls_client_certificate_file_path"`
+	TLSClientCertificateKeyFilePath string                 `json:"tls_client_certificate_key_file_path"`
+	Host                            string                 `json:"host"`
+	Fallback                        string                 `json:"fallback"`
+	Proxy                           string                 `json:"proxy"`
+	ProxyToken                      string                 `json:"proxy_token"`
+	ProxyForward                    bool                   `json:"proxy_forward"`
+	WSHeaders                       map[string]string      `json:"ws_headers"`
+	WSTokenHeader                   string                 `json:"ws_token_header"`
+	WSLegacyKey                     bool                   `json:"ws_legacy_key"`
+	TokenTTL                        int                    `json:"token_ttl"`
+	WSTokenTTL                      int                    `json:"ws_token_ttl"`
+	WSEarlyData                     int                    `json:"ws_early_data"`
+	TrustedProxies                  []string               `json:"trusted_proxies"`
+	WSReadHeaderTimeout             int                    `json:"ws_read_header_timeout"`
+	WSIdleTimeout                   int                    `json:"ws_idle_timeout"`
+	WSMaxHeaderBytes                int                    `json:"ws_max_header_bytes"`
+	WSMaxConns                      int                    `json:"ws_max_conns"`
+	GrpcService                     string                 `json:"grpc_service"`
+	GrpcMethod                      string                 `json:"grpc_method"`
+	GrpcH2C                         bool                   `json:"grpc_h2c"`
+	ReconnectDelay                  int                    `json:"reconnect_delay"`
+	ReconnectMaxDelay               int                    `json:"reconnect_max_delay"`
+	ReconnectJitter                 float64                `json:"reconnect_jitter"`
+	KeepAliveInterval               int                    `json:"keepalive_interval"`
+	KeepAliveTimeout                int                    `json:"keepalive_timeout"`
+	SendQueueSize                   int                    `json:"send_queue_size"`
+	DropPolicy                      string                 `json:"drop_policy"`
+	BatchSize                       int                    `json:"batch_size"`
+	BatchDelay                      int                    `json:"batch_delay"`
+	RawProto                        int                    `json:"raw_proto"`
+	DNSDomain                       string                 `json:"dns_domain"`
+	DNSType                         string                 `json:"dns_type"`
+	Streams                         int                    `json:"streams"`
+	QuicDatagram                    bool                   `json:"quic_datagram"`
+	Quic0RTT                        bool                   `json:"quic_0rtt"`
+	QuicMaxIdleTimeout              int                    `json:"quic_max_idle_timeout"`
+	QuicInitialStreamWindow         int                    `json:"quic_initial_stream_window"`
+	QuicMaxStreamWindow             int                    `json:"quic_max_stream_window"`
+	QuicInitialConnWindow           int                    `json:"quic_initial_conn_window"`
+	QuicMaxConnWindow               int                    `json:"quic_max_conn_window"`
+	QuicMaxStreams                  int                    `json:"quic_max_streams"`
+	KCP                             KCPConfig              `json:"kcp"`
+	ACME                            ACMEConfig             `json:"acme"`
+	H1                              H1Config               `json:"h1"`
+}
+
+// KCPConfig The kcp config struct, the crypt, salt, shards and smux must match between client and server
+type KCPConfig struct {
+	Mode         string `json:"mode"`
+	NoDelay      int    `json:"nodelay"`
+	Interval     int    `json:"interval"`
+	Resend       int    `json:"resend"`
+	NoCongestion int    `json:"nc"`
+	AckNoDelay   bool   `json:"ack_nodelay"`
+	DataShards   int    `json:"data_shards"`
+	ParityShards int    `json:"parity_shards"`
+	SndWnd       int    `json:"sndwnd"`
+	RcvWnd       int    `json:"rcvwnd"`
+	MTU          int    `json:"mtu"`
+	DSCP         int    `json:"dscp"`
+	SockBuf      int    `json:"sockbuf"`
+	Crypt        string `json:"crypt"`
+	Salt         string `json:"salt"`
+	Smux         bool   `json:"smux"`
+	Conns        int    `json:"conns"`
+	AutoExpire   int    `json:"autoexpire"`
+	ScavengeTTL  int    `json:"scavengettl"`
+}
+
+// TLSCertificateConfig The files of a certificate served to the clients asking for one of its names by sni
+type TLSCertificateConfig struct {
+	CertificateFilePath string `json:"certificate_file_path"`
+	KeyFilePath         string `json:"key_file_path"`
+}
+
+// ACMEConfig The acme config struct, the server certificate is obtained for the domains instead of read from the certificate files
+type ACMEConfig struct {
+	Domains      []string `json:"domains"`
+	Email        string   `json:"email"`
+	CacheDir     string   `json:"cache_dir"`
+	DirectoryURL string   `json:"directory_url"`
+	CAFilePath   string   `json:"ca_file_path"`
+	HTTPAddr     string   `json:"http_addr"`
+	RenewBefore  int      `json:"renew_before"`
+}
+
+// H1Config The h1 disguise config struct, the empty fields are derived from the key and must match between client and server,
+// except the path which is random per client if empty and the only path of the tunnel if set
+type H1Config struct {
+	TxMethod     string `json:"tx_method"`
+	RxMethod     string `json:"rx_method"`
+	TxFlag       string `json:"tx_flag"`
+	RxFlag       string `json:"rx_flag"`
+	TokenCookieA string `json:"token_cookie_a"`
+	TokenCookieB string `json:"token_cookie_b"`
+	TokenCookieC string `json:"token_cookie_c"`
+	UserAgent    string `json:"user_agent"`
+	ServerHeader string `json:"server_header"`
+	Path         string `json:"path"`
+	Timeout      int    `json:"timeout"`
+	TokenTTL     int    `json:"token_ttl"`
 }
 
 type nativeConfig Config
 
 var DefaultConfig = nativeConfig{
-	DeviceName:                "",
-	LocalAddr:                 ":3000",
-	ServerAddr:                ":3001",
-	ServerIP:                  "172.16.0.1",
-	ServerIPv6:                "fced:9999::1",
-	CIDR:                      "172.16.0.10/24",
-	CIDRv6:                    "fced:9999::9999/64",
-	Key:                       "freedom@2023",
-	Protocol:                  "udp",
-	Path:                      "/freedom",
-	ServerMode:                false,
-	GlobalMode:                false,
-	Obfs:                      false,
-	Compress:                  false,
-	MTU:                       1500,
-	Timeout:                   30,
-	TLSCertificateFilePath:    "./certs/server.pem",
-	TLSCertificateKeyFilePath: "./certs/server.key",
-	TLSSni:                    "",
-	TLSInsecureSkipVerify:     false,
-	Verbose:                   false,
-	PSKMode:                   false,
-	Host:                      "",
+	DeviceName:                      "",
+	LocalAddr:                       ":3000",
+	ServerAddr:                      ":3001",
+	ServerIP:                        "172.16.0.1",
+	ServerIPv6:                      "fced:9999::1",
+	CIDR:                            "172.16.0.10/24",
+	CIDRv6:                          "fced:9999::9999/64",
+	Key:                             "freedom@2023",
+	Protocol:                        "udp",
+	Path:                            "/freedom",
+	ServerMode:                      false,
+	GlobalMode:                      false,
+	Obfs:                            false,
+	Compress:                        false,
+	MTU:                             1500,
+	Timeout:                         30,
+	TLSCertificateFilePath:          "./certs/server.pem",
+	TLSCertificateKeyFilePath:       "./certs/server.key",
+	TLSCertificates:                 nil,
+	TLSSni:                          "",
+	TLSInsecureSkipVerify:           false,
+	TLSCAFilePath:                   "",
+	TLSPins:                         nil,
+	TLSALPN:                         nil,
+	UTLSFingerprint:                 "randomized",
+	UTLSHTTP:                        false,
+	Verbose:                         false,
+	PSKMode:                         false,
+	PSKIdentity:                     "",
+	PSKIdentities:                   nil,
+	TLSClientCAFilePath:             "",
+	TLSClientCertificateFilePath:    "",
+	TLSClientCertificateKeyFilePath: "",
+	Host:                            "",
+	Fallback:                        "",
+	Proxy:                           "",
+	ProxyToken:                      "",
+	ProxyForward:                    false,
+	WSHeaders:                       nil,
+	WSTokenHeader:                   "Authorization",
+	WSLegacyKey:                     false,
+	TokenTTL:                        300,
+	WSTokenTTL:                      0,
+	WSEarlyData:                     0,
+	TrustedProxies:                  nil,
+	WSReadHeaderTimeout:             10,
+	WSIdleTimeout:                   120,
+	WSMaxHeaderBytes:                16384,
+	WSMaxConns:                      0,
+	GrpcService:                     "proto.GrpcServe",
+	GrpcMethod:                      "Tunnel",
+	GrpcH2C:                         false,
+	ReconnectDelay:                  1,
+	ReconnectMaxDelay:               60,
+	ReconnectJitter:                 0.2,
+	KeepAliveInterval:               10,
+	KeepAliveTimeout:                30,
+	SendQueueSize:                   1024,
+	DropPolicy:                      "tail",
+	BatchSize:                       0,
+	BatchDelay:                      1000,
+	RawProto:                        0,
+	DNSDomain:                       "",
+	DNSType:                         "txt",
+	Streams:                         1,
+	QuicDatagram:                    false,
+	Quic0RTT:                        false,
+	QuicMaxIdleTimeout:              0,
+	QuicInitialStreamWindow:         0,
+	QuicMaxStreamWindow:             0,
+	QuicInitialConnWindow:           0,
+	QuicMaxConnWindow:               0,
+	QuicMaxStreams:                  0,
+	KCP: KCPConfig{
+		Mode:         "manual",
+		NoDelay:      0,
+		Interval:     100,
+		Resend:       0,
+		NoCongestion: 0,
+		DataShards:   10,
+		ParityShards: 3,
+		SndWnd:       512,
+		RcvWnd:       512,
+		MTU:          1400,
+		DSCP:         9,
+		SockBuf:      4194304,
+		Crypt:        "aes",
+		Salt:         "FOLLOW",
+		Smux:         false,
+		Conns:        1,
+		AutoExpire:   0,
+		ScavengeTTL:  60,
+	},
+	ACME: ACMEConfig{
+		Domains:      nil,
+		Email:        "",
+		CacheDir:     "./certs/acme",
+		DirectoryURL: "",
+		CAFilePath:   "",
+		HTTPAddr:     "",
+		RenewBefore:  30,
+	},
+	H1: H1Config{
+		Timeout:  10,
+		TokenTTL: 20,
+	},
 }
 
 func (c *Config) UnmarshalJSON(data []byte) error {
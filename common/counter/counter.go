@@ -13,6 +13,9 @@ var _totalReadBytes uint64 = 0
 // totalWrittenBytes is the total number of bytes written
 var _totalWrittenBytes uint64 = 0
 
+// totalDroppedPackets is the total number of packets dropped by full send queues
+var _totalDroppedPackets uint64 = 0
+
 // IncrReadBytes increments the number of bytes read
 func IncrReadBytes(n int) {
 	atomic.AddUint64(&_totalReadBytes, uint64(n))
@@ -23,6 +26,11 @@ func IncrWrittenBytes(n int) {
 	atomic.AddUint64(&_totalWrittenBytes, uint64(n))
 }
 
+// IncrDroppedPackets increments the number of dropped packets
+func IncrDroppedPackets() {
+	atomic.AddUint64(&_totalDroppedPackets, 1)
+}
+
 // GetReadBytes returns the number of bytes read
 func GetReadBytes() uint64 {
 	return atomic.LoadUint64(&_totalReadBytes)
@@ -33,6 +41,11 @@ func GetWrittenBytes() uint64 {
 	return atomic.LoadUint64(&_totalWrittenBytes)
 }
 
+// GetDroppedPackets returns the number of dropped packets
+func GetDroppedPackets() uint64 {
+	return atomic.LoadUint64(&_totalDroppedPackets)
+}
+
 // PrintBytes returns the bytes info
 func PrintBytes(serverMode bool) string {
 	if serverMode {
@@ -40,3 +53,8 @@ func PrintBytes(serverMode bool) string {
 	}
 	return fmt.Sprintf("download %v upload %v", bytesize.New(float64(GetReadBytes())).String(), bytesize.New(float64(GetWrittenBytes())).String())
 }
+
+// PrintDropped returns the dropped packets info
+func PrintDropped() string {
+	return fmt.Sprintf("dropped %v packets", GetDroppedPackets())
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"net"
 	"net/http"
@@ -18,10 +19,14 @@ import (
 	"github.com/net-byte/go-gateway"
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
+	"github.com/net-byte/vtun/common/x/xproxy"
+	"github.com/net-byte/vtun/common/x/xtls"
+	"github.com/net-byte/vtun/common/x/xws"
 )
 
-// ConnectServer connects to the server with the given address.
-func ConnectServer(config config.Config) net.Conn {
+// ConnectServer connects to the server with the given address,
+// the early data is sent within the handshake if not nil
+func ConnectServer(config config.Config, earlyData []byte) net.Conn {
 	scheme := "ws"
 	host := config.ServerAddr
 	if config.Host != "" {
@@ -34,25 +39,52 @@ func ConnectServer(config config.Config) net.Conn {
 		}
 	}
 	u := url.URL{Scheme: scheme, Host: host, Path: config.Path}
-	header := make(http.Header)
-	header.Set("user-agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/88.0.4324.182 Safari/537.36")
-	if config.Key != "" {
-		header.Set("key", config.Key)
-	}
+	header := xws.Header(config)
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: config.TLSInsecureSkipVerify,
 	}
 	if config.TLSSni != "" {
 		tlsConfig.ServerName = config.TLSSni
 	}
+	if err := xtls.ClientCertificate(tlsConfig, config); err != nil {
+		log.Printf("[client] failed to load client certificate %v", err)
+		return nil
+	}
+	if err := xtls.VerifyServer(tlsConfig, config); err != nil {
+		log.Printf("[client] failed to load server verification %v", err)
+		return nil
+	}
 	dialer := ws.Dialer{
 		Header:    ws.HandshakeHeaderHTTP(header),
 		Timeout:   time.Duration(config.Timeout) * time.Second,
 		TLSConfig: tlsConfig,
 		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return net.Dial(network, config.ServerAddr)
+			return xproxy.DialContext(ctx, config, config.ServerAddr)
 		},
 	}
+	if earlyData != nil {
+		if value, ok := xws.EncodeEarlyData(config, earlyData); ok {
+			dialer.Protocols = []string{value}
+		}
+	}
+	if config.UTLSHTTP {
+		dialer.TLSClient = func(conn net.Conn, hostname string) net.Conn {
+			c := tlsConfig.Clone()
+			if c.ServerName == "" {
+				c.ServerName = hostname
+			}
+			// websocket needs http/1.1 whatever the fingerprint offers
+			c.NextProtos = []string{"http/1.1"}
+			uConn, err := xtls.UClient(conn, c, config.UTLSFingerprint)
+			if err != nil {
+				log.Printf("[client] failed to handshake utls %v", err)
+				// the closed conn fails the dial instead of falling back to plaintext
+				conn.Close()
+				return conn
+			}
+			return uConn
+		}
+	}
 	c, _, _, err := dialer.Dial(context.Background(), u.String())
 	if err != nil {
 		log.Printf("[client] failed to dial websocket %s %v", u.String(), err)
@@ -179,6 +211,32 @@ func GetDstKey(packet []byte) string {
 	return key
 }
 
+// FlowHash returns a hash of the addresses, protocol and ports of the packet,
+// packets of the same flow have the same hash
+func FlowHash(packet []byte) uint32 {
+	h := fnv.New32a()
+	var proto byte
+	var l4 []byte
+	if len(packet) >= 20 && IsIPv4(packet) {
+		h.Write(packet[12:20])
+		proto = packet[9]
+		ihl := int(packet[0]&0x0f) * 4
+		// only the first fragment carries the ports
+		if packet[6]&0x1f == 0 && packet[7] == 0 && len(packet) >= ihl {
+			l4 = packet[ihl:]
+		}
+	} else if len(packet) >= 40 && IsIPv6(packet) {
+		h.Write(packet[8:40])
+		proto = packet[6]
+		l4 = packet[40:]
+	}
+	h.Write([]byte{proto})
+	if (proto == 6 || proto == 17) && len(l4) >= 4 {
+		h.Write(l4[:4])
+	}
+	return h.Sum32()
+}
+
 type ExecCmdRecorder struct {
 	cmds []string
 }
@@ -278,6 +336,10 @@ func PrintStats(enableVerbose bool, serverMode bool) {
 	go func() {
 		for {
 			time.Sleep(30 * time.Second)
+			if serverMode {
+				log.Printf("stats:%v %v", counter.PrintBytes(serverMode), counter.PrintDropped())
+				continue
+			}
 			log.Printf("stats:%v", counter.PrintBytes(serverMode))
 		}
 	}()
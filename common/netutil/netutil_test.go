@@ -35,3 +35,16 @@ func TestExecCmdRecoder(t *testing.T) {
 	// echo
 	// echo
 }
+
+func TestFlowHash(t *testing.T) {
+	packet := []byte{
+		0x45, 0x00, 0x00, 0x28, 0x00, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		172, 16, 0, 10, 172, 16, 0, 1,
+		0x30, 0x39, 0x00, 0x50, 0x00, 0x00, 0x00, 0x00,
+	}
+	other := append([]byte{}, packet...)
+	other[20] = 0x31
+	assert.Equal(t, FlowHash(packet), FlowHash(append([]byte{}, packet...)))
+	assert.NotEqual(t, FlowHash(packet), FlowHash(other))
+	assert.Equal(t, FlowHash(nil), FlowHash([]byte{}))
+}
@@ -0,0 +1,69 @@
+package xalive
+
+import (
+	"context"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// Interval returns the keepalive interval
+func Interval(config config.Config) time.Duration {
+	if config.KeepAliveInterval <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(config.KeepAliveInterval) * time.Second
+}
+
+// Timeout returns how long a peer may stay silent before it is declared dead
+func Timeout(config config.Config) time.Duration {
+	if config.KeepAliveTimeout <= 0 {
+		return 3 * Interval(config)
+	}
+	return time.Duration(config.KeepAliveTimeout) * time.Second
+}
+
+// Deadline returns the read deadline for the next read
+func Deadline(config config.Config) time.Time {
+	return time.Now().Add(Timeout(config))
+}
+
+// Run calls send every keepalive interval until the context is done or send fails
+func Run(_ctx context.Context, config config.Config, send func() error) {
+	ticker := time.NewTicker(Interval(config))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-_ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := send(); err != nil {
+			return
+		}
+	}
+}
+
+// Watchdog calls a function when it isn't touched within the timeout
+type Watchdog struct {
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+// NewWatchdog starts a watchdog
+func NewWatchdog(timeout time.Duration, onTimeout func()) *Watchdog {
+	return &Watchdog{
+		timer:   time.AfterFunc(timeout, onTimeout),
+		timeout: timeout,
+	}
+}
+
+// Touch postpones the timeout
+func (w *Watchdog) Touch() {
+	w.timer.Reset(w.timeout)
+}
+
+// Stop stops the watchdog
+func (w *Watchdog) Stop() {
+	w.timer.Stop()
+}
@@ -0,0 +1,91 @@
+package xalive
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+func TestDurations(t *testing.T) {
+	for _, tt := range []struct {
+		interval, timeout int
+		wantInterval      time.Duration
+		wantTimeout       time.Duration
+	}{
+		{0, 0, 10 * time.Second, 30 * time.Second},
+		{5, 0, 5 * time.Second, 15 * time.Second},
+		{5, 7, 5 * time.Second, 7 * time.Second},
+		{-1, -1, 10 * time.Second, 30 * time.Second},
+	} {
+		c := config.Config{KeepAliveInterval: tt.interval, KeepAliveTimeout: tt.timeout}
+		if got := Interval(c); got != tt.wantInterval {
+			t.Errorf("%+v: interval got %v, want %v", tt, got, tt.wantInterval)
+		}
+		if got := Timeout(c); got != tt.wantTimeout {
+			t.Errorf("%+v: timeout got %v, want %v", tt, got, tt.wantTimeout)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	dead := make(chan struct{})
+	w := NewWatchdog(50*time.Millisecond, func() { close(dead) })
+	defer w.Stop()
+	// the traffic keeps the peer alive past the timeout
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		w.Touch()
+	}
+	select {
+	case <-dead:
+		t.Fatal("the touched watchdog should not time out")
+	default:
+	}
+	select {
+	case <-dead:
+	case <-time.After(time.Second):
+		t.Fatal("the watchdog should time out without traffic")
+	}
+}
+
+func TestWatchdogStop(t *testing.T) {
+	var dead atomic.Bool
+	w := NewWatchdog(20*time.Millisecond, func() { dead.Store(true) })
+	w.Stop()
+	time.Sleep(50 * time.Millisecond)
+	if dead.Load() {
+		t.Error("the stopped watchdog should not time out")
+	}
+}
+
+func TestRun(t *testing.T) {
+	c := config.Config{KeepAliveInterval: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	Run(ctx, c, func() error {
+		t.Error("nothing should be sent once the context is done")
+		return nil
+	})
+
+	var sent atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		Run(context.Background(), c, func() error {
+			sent.Add(1)
+			return errors.New("closed")
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run should stop when the send fails")
+	}
+	if sent.Load() != 1 {
+		t.Errorf("the failed send should be the last one, got %v sends", sent.Load())
+	}
+}
@@ -0,0 +1,62 @@
+package xauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// BearerPrefix is the prefix of the auth token in an Authorization header
+const BearerPrefix = "Bearer "
+
+// Token returns the auth token of the key at the time, it is the time signed by the key
+// so the key itself never appears in the requests
+func Token(key string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return ts + "." + sign(key, ts)
+}
+
+// VerifyToken returns true if the token is signed by the key within the ttl of the time
+func VerifyToken(key string, token string, t time.Time, ttl time.Duration) bool {
+	ts, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if d := t.Sub(time.Unix(unix, 0)); d > ttl || d < -ttl {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(sign(key, ts)))
+}
+
+// sign returns the hmac of the message by the key
+func sign(key string, message string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TTL returns how long an auth token is valid
+func TTL(config config.Config) time.Duration {
+	if config.TokenTTL <= 0 {
+		return 300 * time.Second
+	}
+	return time.Duration(config.TokenTTL) * time.Second
+}
+
+// Verify returns true if the value is an auth token of the key within the ttl, with or without the Bearer prefix,
+// anything is verified without a key
+func Verify(key string, value string, ttl time.Duration) bool {
+	if key == "" {
+		return true
+	}
+	return VerifyToken(key, strings.TrimPrefix(value, BearerPrefix), time.Now(), ttl)
+}
@@ -0,0 +1,36 @@
+package xauth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	now := time.Now()
+	token := Token("secret", now)
+	if !VerifyToken("secret", token, now.Add(time.Minute), 5*time.Minute) {
+		t.Error("the token should be valid within the ttl")
+	}
+	if VerifyToken("secret", token, now.Add(10*time.Minute), 5*time.Minute) {
+		t.Error("the token should expire after the ttl")
+	}
+	if VerifyToken("other", token, now, 5*time.Minute) {
+		t.Error("the token of another key should be rejected")
+	}
+	if VerifyToken("secret", "secret", now, 5*time.Minute) {
+		t.Error("the key itself is not a token")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	token := Token("secret", time.Now())
+	if !Verify("secret", token, time.Minute) || !Verify("secret", BearerPrefix+token, time.Minute) {
+		t.Error("the token should be verified with or without the Bearer prefix")
+	}
+	if Verify("secret", BearerPrefix+"secret", time.Minute) {
+		t.Error("the key itself should not be verified")
+	}
+	if !Verify("", "", time.Minute) {
+		t.Error("anything should be verified without a key")
+	}
+}
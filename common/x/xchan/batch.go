@@ -0,0 +1,34 @@
+package xchan
+
+import (
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// Collect returns the packet with the packets following it on the channel as a batch,
+// the batch ends once it reaches maxBytes or the delay since the first packet elapses
+func Collect(ch <-chan []byte, b []byte, maxBytes int, delay time.Duration) [][]byte {
+	batch := [][]byte{b}
+	size := len(b)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for size < maxBytes {
+		select {
+		case b := <-ch:
+			batch = append(batch, b)
+			size += len(b)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// BatchDelay returns how long a packet waits for a batch
+func BatchDelay(config config.Config) time.Duration {
+	if config.BatchDelay <= 0 {
+		return time.Millisecond
+	}
+	return time.Duration(config.BatchDelay) * time.Microsecond
+}
@@ -0,0 +1,140 @@
+package xchan
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/net-byte/vtun/common/counter"
+)
+
+// DropPolicy decides which packet is dropped when a SendQueue is full
+type DropPolicy int
+
+const (
+	// DropTail drops the packet being pushed
+	DropTail DropPolicy = iota
+	// DropOldest drops the oldest queued packet to make room for the new one
+	DropOldest
+)
+
+// ParseDropPolicy returns the drop policy of the given name, defaults to DropTail
+func ParseDropPolicy(name string) DropPolicy {
+	if name == "oldest" {
+		return DropOldest
+	}
+	return DropTail
+}
+
+// SendQueue is a bounded queue of packets drained by its own writer goroutine,
+// so a slow peer never blocks the producer.
+type SendQueue struct {
+	ch         chan []byte
+	policy     DropPolicy
+	write      func([][]byte) error
+	batchSize  int
+	batchDelay time.Duration
+	done       chan struct{}
+	closeOnce  sync.Once
+	dropped    uint64
+}
+
+// NewSendQueue creates the queue and starts its writer goroutine,
+// the writer stops at the first write error.
+func NewSendQueue(size int, policy DropPolicy, write func([]byte) error) *SendQueue {
+	return NewBatchQueue(size, policy, 0, 0, func(batch [][]byte) error {
+		return write(batch[0])
+	})
+}
+
+// NewBatchQueue creates the queue whose writer coalesces the queued packets into batches of up to batchSize bytes,
+// waiting at most the delay for the following packets, a zero batchSize writes the packets one by one.
+func NewBatchQueue(size int, policy DropPolicy, batchSize int, delay time.Duration, write func([][]byte) error) *SendQueue {
+	if size <= 0 {
+		size = 1
+	}
+	q := &SendQueue{
+		ch:         make(chan []byte, size),
+		policy:     policy,
+		write:      write,
+		batchSize:  batchSize,
+		batchDelay: delay,
+		done:       make(chan struct{}),
+	}
+	go q.writer()
+	return q
+}
+
+func (q *SendQueue) writer() {
+	for {
+		select {
+		case <-q.done:
+			return
+		case b := <-q.ch:
+			batch := [][]byte{b}
+			if q.batchSize > 0 {
+				batch = Collect(q.ch, b, q.batchSize, q.batchDelay)
+			}
+			if err := q.write(batch); err != nil {
+				q.Close()
+				return
+			}
+		}
+	}
+}
+
+// Push queues the packet without blocking, returns false if a packet was dropped
+func (q *SendQueue) Push(b []byte) bool {
+	select {
+	case <-q.done:
+		q.drop()
+		return false
+	default:
+	}
+	select {
+	case q.ch <- b:
+		return true
+	default:
+	}
+	if q.policy == DropOldest {
+		select {
+		case <-q.ch:
+			q.drop()
+		default:
+		}
+		select {
+		case q.ch <- b:
+			return false
+		default:
+		}
+	}
+	q.drop()
+	return false
+}
+
+func (q *SendQueue) drop() {
+	atomic.AddUint64(&q.dropped, 1)
+	counter.IncrDroppedPackets()
+}
+
+// Dropped returns the number of packets dropped by this queue
+func (q *SendQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Len returns the number of queued packets
+func (q *SendQueue) Len() int {
+	return len(q.ch)
+}
+
+// Done returns a channel closed when the queue is closed
+func (q *SendQueue) Done() <-chan struct{} {
+	return q.done
+}
+
+// Close stops the writer goroutine, queued packets are discarded
+func (q *SendQueue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+	})
+}
@@ -0,0 +1,74 @@
+package xchan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendQueueDropPolicy(t *testing.T) {
+	block := make(chan struct{})
+	written := make(chan []byte, 8)
+	write := func(b []byte) error {
+		<-block
+		written <- b
+		return nil
+	}
+	for _, policy := range []DropPolicy{DropTail, DropOldest} {
+		q := NewSendQueue(2, policy, write)
+		q.Push([]byte{0})
+		// wait for the writer to pick up the first packet and block
+		for q.Len() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		q.Push([]byte{1})
+		q.Push([]byte{2})
+		if q.Push([]byte{3}) {
+			t.Fatalf("policy %v: push to a full queue should drop", policy)
+		}
+		if q.Dropped() != 1 {
+			t.Fatalf("policy %v: dropped %d, want 1", policy, q.Dropped())
+		}
+		want := []byte{0, 1, 2}
+		if policy == DropOldest {
+			want = []byte{0, 2, 3}
+		}
+		for _, w := range want {
+			block <- struct{}{}
+			if b := <-written; b[0] != w {
+				t.Fatalf("policy %v: got %d, want %d", policy, b[0], w)
+			}
+		}
+		q.Close()
+	}
+}
+
+func TestParseDropPolicy(t *testing.T) {
+	if ParseDropPolicy("oldest") != DropOldest || ParseDropPolicy("tail") != DropTail || ParseDropPolicy("") != DropTail {
+		t.Fatal("unexpected drop policy")
+	}
+}
+
+func TestBatchQueue(t *testing.T) {
+	written := make(chan [][]byte, 8)
+	q := NewBatchQueue(8, DropTail, 4, 50*time.Millisecond, func(batch [][]byte) error {
+		written <- batch
+		return nil
+	})
+	defer q.Close()
+	for i := byte(0); i < 5; i++ {
+		q.Push([]byte{i, i})
+	}
+	if batch := <-written; len(batch) != 2 || batch[0][0] != 0 || batch[1][0] != 1 {
+		t.Fatalf("got %v, want the batch to end at the size", batch)
+	}
+	if batch := <-written; len(batch) != 2 || batch[0][0] != 2 {
+		t.Fatalf("got %v, want the next batch", batch)
+	}
+	start := time.Now()
+	if batch := <-written; len(batch) != 1 || batch[0][0] != 4 {
+		t.Fatalf("got %v, want the last packet alone", batch)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("the last packet should wait for the delay")
+	}
+}
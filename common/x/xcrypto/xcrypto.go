@@ -3,8 +3,10 @@ package xcrypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
+	"errors"
 	"hash/fnv"
 )
 
@@ -73,3 +75,22 @@ func (x *XCrypto) Decode(ci []byte) ([]byte, error) {
 	}
 	return pl, nil
 }
+
+// Seal encrypts the payload with a random nonce prepended to the ciphertext,
+// the additional data is authenticated but not encrypted
+func (x *XCrypto) Seal(pl []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, x.aesGcm.NonceSize(), x.aesGcm.NonceSize()+len(pl)+x.aesGcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return x.aesGcm.Seal(nonce, nonce, pl, ad), nil
+}
+
+// Open decrypts the payload sealed with the same additional data
+func (x *XCrypto) Open(ci []byte, ad []byte) ([]byte, error) {
+	n := x.aesGcm.NonceSize()
+	if len(ci) < n {
+		return nil, errors.New("sealed payload too short")
+	}
+	return x.aesGcm.Open(nil, ci[:n], ci[n:], ad)
+}
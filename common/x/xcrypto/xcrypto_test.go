@@ -53,3 +53,20 @@ func TestXCrypto_Decode(t *testing.T) {
 	log.Printf("decode: %v\n", decode)
 	assert.Equal(t, decode, []byte{97, 97, 97})
 }
+
+func TestXCrypto_Seal(t *testing.T) {
+	x := &XCrypto{}
+	err := x.Init("aaa")
+	if err != nil {
+		t.Error("err: ", err)
+		return
+	}
+	a, _ := x.Seal([]byte{97, 97, 97}, []byte{1})
+	b, _ := x.Seal([]byte{97, 97, 97}, []byte{1})
+	assert.NotEqual(t, a, b)
+	open, err := x.Open(a, []byte{1})
+	assert.Nil(t, err)
+	assert.Equal(t, open, []byte{97, 97, 97})
+	_, err = x.Open(a, []byte{2})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,345 @@
+package xdns
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TypeNULL is the record type carrying raw data
+const TypeNULL dnsmessage.Type = 10
+
+// MaxSize is the max size of the udp messages, it is advertised by edns and avoids ip fragmentation on most paths
+const MaxSize = 1232
+
+// FragmentHeaderLength is the length of the fragment header: id 2 byte, index 1 byte, flags 1 byte
+const FragmentHeaderLength = 4
+
+// assembleTimeout is how long a partial packet waits for its missing fragments
+const assembleTimeout = 10 * time.Second
+
+// the labels are case insensitive so the data is base32 encoded in lower case
+var nameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ParseType returns the record type of the name, defaults to TXT
+func ParseType(name string) dnsmessage.Type {
+	switch strings.ToLower(name) {
+	case "null":
+		return TypeNULL
+	case "cname":
+		return dnsmessage.TypeCNAME
+	default:
+		return dnsmessage.TypeTXT
+	}
+}
+
+// canonical returns the lower case domain without the trailing dot
+func canonical(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// EncodeName returns the name under the domain carrying the data in its labels
+func EncodeName(data []byte, domain string) (dnsmessage.Name, error) {
+	text := strings.ToLower(nameEncoding.EncodeToString(data))
+	var labels []string
+	for len(text) > 63 {
+		labels = append(labels, text[:63])
+		text = text[63:]
+	}
+	if text != "" {
+		labels = append(labels, text)
+	}
+	labels = append(labels, canonical(domain))
+	name := strings.Join(labels, ".") + "."
+	if len(name) > 254 {
+		return dnsmessage.Name{}, errors.New("data too long for a name")
+	}
+	return dnsmessage.NewName(name)
+}
+
+// InDomain returns true if the name is the domain or under it
+func InDomain(name dnsmessage.Name, domain string) bool {
+	s := strings.ToLower(name.String())
+	domain = canonical(domain) + "."
+	return s == domain || strings.HasSuffix(s, "."+domain)
+}
+
+// DecodeName returns the data carried by the name, or false if the name is not under the domain or carries no data
+func DecodeName(name dnsmessage.Name, domain string) ([]byte, bool) {
+	if !InDomain(name, domain) {
+		return nil, false
+	}
+	s := strings.ToLower(name.String())
+	domain = canonical(domain) + "."
+	if s == domain {
+		return nil, true
+	}
+	text := strings.ReplaceAll(strings.TrimSuffix(s, "."+domain), ".", "")
+	data, err := nameEncoding.DecodeString(strings.ToUpper(text))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// NameCapacity returns the max bytes of data carried by a name under the domain
+func NameCapacity(domain string) int {
+	avail := 253 - len(canonical(domain)) - 1
+	chars := avail
+	// the labels of 63 characters are separated by dots
+	for chars > 0 && chars+(chars-1)/63 > avail {
+		chars--
+	}
+	return chars * 5 / 8
+}
+
+// Query returns the query of the name and type, it advertises MaxSize by edns
+func Query(id uint16, name dnsmessage.Name, t dnsmessage.Type) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := addEDNS(&b); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// addEDNS adds the opt record advertising MaxSize
+func addEDNS(b *dnsmessage.Builder) error {
+	if err := b.StartAdditionals(); err != nil {
+		return err
+	}
+	var h dnsmessage.ResourceHeader
+	if err := h.SetEDNS0(MaxSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return err
+	}
+	return b.OPTResource(h, dnsmessage.OPTResource{})
+}
+
+// edns returns the udp size advertised by the message, or 0 without edns
+func edns(m *dnsmessage.Message) int {
+	for _, r := range m.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			return int(r.Header.Class)
+		}
+	}
+	return 0
+}
+
+// Capacity returns the max bytes of data the answer to the query carries
+func Capacity(query *dnsmessage.Message, domain string) int {
+	size := 512
+	if n := edns(query); n > size {
+		size = min(n, MaxSize)
+	}
+	q := query.Questions[0]
+	// header, question, compressed answer name with the fixed fields, opt record and a margin
+	rdata := size - 12 - (len(q.Name.String()) + 1 + 4) - (2 + 10) - 11 - 16
+	if rdata <= 0 {
+		return 0
+	}
+	switch q.Type {
+	case TypeNULL:
+		return rdata
+	case dnsmessage.TypeCNAME:
+		return min(NameCapacity(domain), rdata*5/8)
+	default:
+		// the base64 text is split in strings of 255 characters with a length byte each
+		chars := rdata - (rdata+255)/256
+		return chars * 3 / 4
+	}
+}
+
+// Reply returns the response of the rcode to the query without answers
+func Reply(query *dnsmessage.Message, rcode dnsmessage.RCode) ([]byte, error) {
+	return respond(query, rcode, nil)
+}
+
+// Answer returns the response to the query carrying the data in an answer of the question type
+func Answer(query *dnsmessage.Message, data []byte, domain string) ([]byte, error) {
+	return respond(query, dnsmessage.RCodeSuccess, func(b *dnsmessage.Builder) error {
+		q := query.Questions[0]
+		h := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class}
+		switch q.Type {
+		case TypeNULL:
+			return b.UnknownResource(h, dnsmessage.UnknownResource{Type: TypeNULL, Data: data})
+		case dnsmessage.TypeCNAME:
+			name, err := EncodeName(data, domain)
+			if err != nil {
+				return err
+			}
+			return b.CNAMEResource(h, dnsmessage.CNAMEResource{CNAME: name})
+		default:
+			text := base64.RawStdEncoding.EncodeToString(data)
+			txt := []string{}
+			for len(text) > 255 {
+				txt = append(txt, text[:255])
+				text = text[255:]
+			}
+			txt = append(txt, text)
+			return b.TXTResource(h, dnsmessage.TXTResource{TXT: txt})
+		}
+	})
+}
+
+// respond returns the authoritative response to the query with the answers added by the function
+func respond(query *dnsmessage.Message, rcode dnsmessage.RCode, answer func(b *dnsmessage.Builder) error) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               query.ID,
+		Response:         true,
+		Authoritative:    true,
+		RecursionDesired: query.RecursionDesired,
+		RCode:            rcode,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, q := range query.Questions {
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+	}
+	if answer != nil {
+		if err := b.StartAnswers(); err != nil {
+			return nil, err
+		}
+		if err := answer(&b); err != nil {
+			return nil, err
+		}
+	}
+	if edns(query) > 0 {
+		if err := addEDNS(&b); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// AnswerData returns the data carried by the answer of the response
+func AnswerData(response *dnsmessage.Message, domain string) ([]byte, error) {
+	for _, r := range response.Answers {
+		switch body := r.Body.(type) {
+		case *dnsmessage.TXTResource:
+			return base64.RawStdEncoding.DecodeString(strings.Join(body.TXT, ""))
+		case *dnsmessage.UnknownResource:
+			if body.Type == TypeNULL {
+				return body.Data, nil
+			}
+		case *dnsmessage.CNAMEResource:
+			if data, ok := DecodeName(body.CNAME, domain); ok {
+				return data, nil
+			}
+		}
+	}
+	return nil, errors.New("no data in the response")
+}
+
+// Fragment is a part of a packet split over several messages
+type Fragment struct {
+	ID    uint16
+	Index uint8
+	Last  bool
+	Data  []byte
+}
+
+// Bytes returns the fragment with its header
+func (f *Fragment) Bytes() []byte {
+	b := make([]byte, FragmentHeaderLength+len(f.Data))
+	binary.BigEndian.PutUint16(b, f.ID)
+	b[2] = f.Index
+	if f.Last {
+		b[3] = 0x01
+	}
+	copy(b[FragmentHeaderLength:], f.Data)
+	return b
+}
+
+// ParseFragment returns nil if the fragment is malformed
+func ParseFragment(b []byte) *Fragment {
+	if len(b) < FragmentHeaderLength {
+		return nil
+	}
+	return &Fragment{
+		ID:    binary.BigEndian.Uint16(b),
+		Index: b[2],
+		Last:  b[3]&0x01 != 0,
+		Data:  b[FragmentHeaderLength:],
+	}
+}
+
+// Split returns the fragments of the packet with up to size bytes of data each
+func Split(id uint16, packet []byte, size int) []*Fragment {
+	var fragments []*Fragment
+	for i := 0; ; i++ {
+		n := min(size, len(packet))
+		fragments = append(fragments, &Fragment{ID: id, Index: uint8(i), Last: n == len(packet), Data: packet[:n]})
+		packet = packet[n:]
+		if len(packet) == 0 {
+			return fragments
+		}
+	}
+}
+
+// Assembler reassembles the packets from their fragments in any order,
+// the partial packets are dropped after a while
+type Assembler struct {
+	mx      sync.Mutex
+	packets map[uint16]*partial
+}
+
+type partial struct {
+	fragments map[uint8][]byte
+	last      int
+	at        time.Time
+}
+
+func NewAssembler() *Assembler {
+	return &Assembler{packets: make(map[uint16]*partial)}
+}
+
+// Add adds the fragment, it returns the packet once all its fragments are added
+func (a *Assembler) Add(f *Fragment) []byte {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	now := time.Now()
+	for id, p := range a.packets {
+		if now.Sub(p.at) > assembleTimeout {
+			delete(a.packets, id)
+		}
+	}
+	p, ok := a.packets[f.ID]
+	if !ok {
+		p = &partial{fragments: make(map[uint8][]byte), last: -1, at: now}
+		a.packets[f.ID] = p
+	}
+	p.fragments[f.Index] = append([]byte(nil), f.Data...)
+	if f.Last {
+		p.last = int(f.Index)
+	}
+	if p.last < 0 || len(p.fragments) != p.last+1 {
+		return nil
+	}
+	delete(a.packets, f.ID)
+	var packet []byte
+	for i := 0; i <= p.last; i++ {
+		data, ok := p.fragments[uint8(i)]
+		if !ok {
+			// a fragment beyond the last one was added
+			return nil
+		}
+		packet = append(packet, data...)
+	}
+	return packet
+}
@@ -0,0 +1,87 @@
+package xdns
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const domain = "t.example.com"
+
+func TestName(t *testing.T) {
+	data := make([]byte, NameCapacity(domain))
+	rand.Read(data)
+	name, err := EncodeName(data, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the resolvers may randomize the case of the names
+	upper, _ := dnsmessage.NewName(strings.ToUpper(name.String()))
+	got, ok := DecodeName(upper, domain)
+	if !ok || !bytes.Equal(got, data) {
+		t.Error("the data should survive the name in any case")
+	}
+	if _, err := EncodeName(append(data, 0), domain); err == nil {
+		t.Error("the data beyond the capacity should be rejected")
+	}
+	other, _ := dnsmessage.NewName("abc.example.org.")
+	if _, ok := DecodeName(other, domain); ok {
+		t.Error("the name under another domain should be rejected")
+	}
+	empty, _ := dnsmessage.NewName(domain + ".")
+	if got, ok := DecodeName(empty, domain); !ok || len(got) != 0 {
+		t.Error("the domain itself should carry no data")
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	for _, typ := range []string{"txt", "null", "cname"} {
+		name, _ := EncodeName(make([]byte, NameCapacity(domain)), domain)
+		b, err := Query(1, name, ParseType(typ))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, Capacity(&query, domain))
+		rand.Read(data)
+		b, err = Answer(&query, data, domain)
+		if err != nil {
+			t.Fatalf("%v: %v", typ, err)
+		}
+		if len(b) > MaxSize {
+			t.Errorf("%v: the answer of %v bytes exceeds the max size", typ, len(b))
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		got, err := AnswerData(&response, domain)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%v: the data should survive the answer", typ)
+		}
+	}
+}
+
+func TestAssembler(t *testing.T) {
+	packet := make([]byte, 1000)
+	rand.Read(packet)
+	fragments := Split(7, packet, 100)
+	if len(fragments) != 10 || !fragments[9].Last {
+		t.Fatal("the packet should be split in 10 fragments")
+	}
+	a := NewAssembler()
+	for i := len(fragments) - 1; i > 0; i-- {
+		if a.Add(ParseFragment(fragments[i].Bytes())) != nil {
+			t.Fatal("the packet should wait for its missing fragments")
+		}
+	}
+	if got := a.Add(ParseFragment(fragments[0].Bytes())); !bytes.Equal(got, packet) {
+		t.Error("the packet should be reassembled out of order")
+	}
+}
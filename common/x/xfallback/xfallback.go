@@ -0,0 +1,129 @@
+package xfallback
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+)
+
+// Enabled returns true if a fallback target is configured
+func Enabled(config config.Config) bool {
+	return config.Fallback != ""
+}
+
+// target returns the fallback url, or nil if the fallback is a local web root
+func target(config config.Config) *url.URL {
+	if !strings.HasPrefix(config.Fallback, "http://") && !strings.HasPrefix(config.Fallback, "https://") {
+		return nil
+	}
+	u, err := url.Parse(config.Fallback)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// Handler returns the handler of the requests which are not for the tunnel,
+// they are reverse proxied to the fallback url or served from the fallback web root,
+// the default page is served if no fallback is configured
+func Handler(config config.Config) http.Handler {
+	if !Enabled(config) {
+		return netutil.GetDefaultHttpHandleFunc()
+	}
+	u := target(config)
+	if u == nil {
+		return http.FileServer(http.Dir(strings.TrimPrefix(config.Fallback, "file://")))
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		// the upstream sees the request as if it was sent to it directly
+		r.Host = u.Host
+		r.Header["X-Forwarded-For"] = nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		netutil.PrintErr(err, config.Verbose)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy
+}
+
+// ServeConn answers a conn whose data is not for the tunnel,
+// http requests are served by the Handler and other data is relayed as is to the fallback url host
+func ServeConn(config config.Config, conn net.Conn, isHTTP bool) {
+	if isHTTP {
+		srv := &http.Server{Handler: Handler(config), ReadHeaderTimeout: time.Duration(config.Timeout) * time.Second}
+		srv.Serve(&connListener{conn: conn})
+		return
+	}
+	u := target(config)
+	if u == nil {
+		conn.Close()
+		return
+	}
+	relay(config, conn, u)
+}
+
+// relay pipes the conn to the fallback host
+func relay(config config.Config, conn net.Conn, u *url.URL) {
+	defer conn.Close()
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+	}
+	conn.SetDeadline(time.Time{})
+	dialer := &net.Dialer{Timeout: time.Duration(config.Timeout) * time.Second}
+	var upstream net.Conn
+	var err error
+	if u.Scheme == "https" {
+		upstream, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		upstream, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		netutil.PrintErr(err, config.Verbose)
+		return
+	}
+	defer upstream.Close()
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+}
+
+// connListener is a listener accepting a single conn
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+// Accept returns the conn once, then io.EOF so the server stops accepting while the conn is served
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn == nil {
+		return nil, io.EOF
+	}
+	return conn, nil
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,96 @@
+package xfallback
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+func newUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "upstream")
+		io.WriteString(w, r.Host+" "+r.URL.Path+" "+r.Header.Get("X-Forwarded-For"))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestHandlerDefault(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler(config.Config{}).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != "follow" {
+		t.Errorf("got %q, want the default page", rec.Body.String())
+	}
+}
+
+func TestHandlerProxy(t *testing.T) {
+	upstream := newUpstream(t)
+	srv := httptest.NewServer(Handler(config.Config{Fallback: upstream.URL}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.TrimPrefix(upstream.URL, "http://") + " /index.html "
+	if got := body(t, resp); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if resp.Header.Get("Server") != "upstream" {
+		t.Error("the upstream headers should be passed through")
+	}
+}
+
+func TestHandlerWebRoot(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("hello"), 0600)
+	srv := httptest.NewServer(Handler(config.Config{Fallback: dir}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := body(t, resp); got != "hello" {
+		t.Errorf("got %q, want the web root index", got)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	upstream := newUpstream(t)
+	c := config.Config{Fallback: upstream.URL, Timeout: 5}
+	for _, isHTTP := range []bool{true, false} {
+		client, server := net.Pipe()
+		go ServeConn(c, server, isHTTP)
+		req, _ := http.NewRequest("GET", "http://vtun/probe", nil)
+		go req.Write(client)
+		resp, err := http.ReadResponse(bufio.NewReader(client), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := body(t, resp); !strings.Contains(got, "/probe") {
+			t.Errorf("http %v got %q, want the upstream answer", isHTTP, got)
+		}
+		client.Close()
+	}
+	client, server := net.Pipe()
+	go ServeConn(config.Config{Fallback: t.TempDir()}, server, false)
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("raw data should not be answered without a fallback url")
+	}
+}
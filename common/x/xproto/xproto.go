@@ -2,7 +2,12 @@ package xproto
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/net-byte/vtun/common/config"
@@ -118,6 +123,14 @@ func ParseServerSendPacketHeader(data []byte) *ServerSendPacketHeader {
 
 const HeaderLength = 2
 
+// KeepAlivePacket is the keepalive of datagram transports, it can't be mistaken for an ip packet
+var KeepAlivePacket = []byte{0x00}
+
+// IsKeepAlive returns true if the packet is a keepalive
+func IsKeepAlive(b []byte) bool {
+	return len(b) == 1 && b[0] == 0x00
+}
+
 // ReadLength []byte length to int length
 func ReadLength(header []byte) int {
 	length := 0
@@ -135,6 +148,40 @@ func WriteLength(header []byte, length int) {
 	}
 }
 
+// EncodeBatch returns the packets each prefixed by its length
+func EncodeBatch(packets [][]byte) []byte {
+	size := 0
+	for _, b := range packets {
+		size += HeaderLength + len(b)
+	}
+	data := make([]byte, 0, size)
+	header := make([]byte, HeaderLength)
+	for _, b := range packets {
+		WriteLength(header, len(b))
+		data = append(data, header...)
+		data = append(data, b...)
+	}
+	return data
+}
+
+// DecodeBatch returns the packets of a batch, the packets share the memory of the batch
+func DecodeBatch(data []byte) ([][]byte, error) {
+	var packets [][]byte
+	for len(data) > 0 {
+		if len(data) < HeaderLength {
+			return nil, errors.New("truncated batch header")
+		}
+		length := ReadLength(data)
+		data = data[HeaderLength:]
+		if len(data) < length {
+			return nil, errors.New("truncated batch packet")
+		}
+		packets = append(packets, data[:length])
+		data = data[length:]
+	}
+	return packets, nil
+}
+
 func Copy(b []byte) []byte {
 	c := make([]byte, len(b))
 	copy(c, b)
@@ -187,3 +234,92 @@ func ParseAuthKeyFromString(str string) *AuthKey {
 	copy(authKey[:], r[:16])
 	return &authKey
 }
+
+const UDPHeaderLength = 9
+const UDPKeepAlivePacketLength = 53
+
+const (
+	UDPTypeData            = 0x01
+	UDPTypeKeepAlive       = 0x02
+	UDPTypeKeepAliveAck    = 0x03
+	UDPTypeKeepAliveReject = 0x04 // the addresses of the keepalive are owned by another session
+)
+
+type SessionID [8]byte
+
+// GenSessionID returns a random session id
+func GenSessionID() SessionID {
+	var sid SessionID
+	_, _ = rand.Read(sid[:])
+	return sid
+}
+
+func (s SessionID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+type UDPHeader struct {
+	Type      uint8     //1 byte
+	SessionID SessionID //8 byte
+}
+
+func (p *UDPHeader) Bytes() []byte {
+	data := make([]byte, UDPHeaderLength)
+	data[0] = p.Type
+	copy(data[1:9], p.SessionID[:])
+	return data
+}
+
+func ParseUDPHeader(data []byte) *UDPHeader {
+	if len(data) < UDPHeaderLength {
+		return nil
+	}
+	var obj = &UDPHeader{Type: data[0]}
+	copy(obj.SessionID[:], data[1:9])
+	return obj
+}
+
+type UDPKeepAlivePacket struct {
+	UDPHeader        //9 byte
+	Counter   uint64 //8 byte
+	CIDRv4    net.IP //4 byte
+	CIDRv6    net.IP //16 byte
+	// HMAC-SHA256 truncated to 16 byte
+}
+
+// Bytes returns the packet signed with the key
+func (p *UDPKeepAlivePacket) Bytes(key []byte) []byte {
+	data := make([]byte, UDPKeepAlivePacketLength)
+	copy(data[0:9], p.UDPHeader.Bytes())
+	binary.BigEndian.PutUint64(data[9:17], p.Counter)
+	if v4 := p.CIDRv4.To4(); v4 != nil {
+		copy(data[17:21], v4)
+	}
+	if v6 := p.CIDRv6.To16(); v6 != nil {
+		copy(data[21:37], v6)
+	}
+	copy(data[37:53], keepAliveMAC(key, data[:37]))
+	return data
+}
+
+// ParseUDPKeepAlivePacket returns nil if the packet is malformed or the MAC doesn't match
+func ParseUDPKeepAlivePacket(data []byte, key []byte) *UDPKeepAlivePacket {
+	if len(data) != UDPKeepAlivePacketLength {
+		return nil
+	}
+	if !hmac.Equal(data[37:53], keepAliveMAC(key, data[:37])) {
+		return nil
+	}
+	var obj = &UDPKeepAlivePacket{}
+	obj.UDPHeader = *ParseUDPHeader(data)
+	obj.Counter = binary.BigEndian.Uint64(data[9:17])
+	obj.CIDRv4 = Copy(data[17:21])
+	obj.CIDRv6 = Copy(data[21:37])
+	return obj
+}
+
+func keepAliveMAC(key []byte, data []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(data)
+	return m.Sum(nil)[:16]
+}
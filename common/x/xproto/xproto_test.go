@@ -3,6 +3,7 @@ package xproto
 import (
 	"encoding/hex"
 	"github.com/net-byte/vtun/common/config"
+	"net"
 	"testing"
 )
 
@@ -17,3 +18,47 @@ func TestClientHandshakePacket_Bytes(t *testing.T) {
 	}
 	t.Logf("bytes: %v\n", hex.EncodeToString(ch.Bytes()))
 }
+
+func TestUDPKeepAlivePacket(t *testing.T) {
+	key := []byte("flyflygogo")
+	ka := &UDPKeepAlivePacket{
+		UDPHeader: UDPHeader{Type: UDPTypeKeepAlive, SessionID: GenSessionID()},
+		Counter:   42,
+		CIDRv4:    net.ParseIP("172.16.0.10"),
+		CIDRv6:    net.ParseIP("fced:9999::9999"),
+	}
+	data := ka.Bytes(key)
+	obj := ParseUDPKeepAlivePacket(data, key)
+	if obj == nil {
+		t.Fatal("failed to parse keepalive packet")
+	}
+	if obj.SessionID != ka.SessionID || obj.Counter != 42 || !obj.CIDRv4.Equal(ka.CIDRv4) || !obj.CIDRv6.Equal(ka.CIDRv6) {
+		t.Errorf("unexpected keepalive packet: %+v", obj)
+	}
+	if ParseUDPKeepAlivePacket(data, []byte("wrong key")) != nil {
+		t.Error("accepted keepalive packet signed with another key")
+	}
+	data[10] ^= 0xff
+	if ParseUDPKeepAlivePacket(data, key) != nil {
+		t.Error("accepted tampered keepalive packet")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	packets := [][]byte{[]byte("first"), {}, []byte("second")}
+	decoded, err := DecodeBatch(EncodeBatch(packets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(packets) {
+		t.Fatalf("got %d packets, want %d", len(decoded), len(packets))
+	}
+	for i := range packets {
+		if string(decoded[i]) != string(packets[i]) {
+			t.Errorf("packet %d got %q, want %q", i, decoded[i], packets[i])
+		}
+	}
+	if _, err := DecodeBatch(EncodeBatch(packets)[:8]); err == nil {
+		t.Error("a truncated batch should fail")
+	}
+}
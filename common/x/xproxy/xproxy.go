@@ -0,0 +1,151 @@
+package xproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// URL returns the upstream proxy of the address, nil means the address is dialed directly,
+// the configured proxy takes precedence over HTTPS_PROXY and NO_PROXY applies to both
+func URL(config config.Config, addr string) (*url.URL, error) {
+	if strings.EqualFold(config.Proxy, "direct") {
+		return nil, nil
+	}
+	c := httpproxy.FromEnvironment()
+	if config.Proxy != "" {
+		c.HTTPSProxy = config.Proxy
+	}
+	// httpproxy takes socks5h for a host name, the socks5 dialer sends the names to the proxy anyway
+	if rest, ok := strings.CutPrefix(c.HTTPSProxy, "socks5h://"); ok {
+		c.HTTPSProxy = "socks5://" + rest
+	}
+	return c.ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+}
+
+// Authorization returns the Proxy-Authorization header of the proxy,
+// the bearer token takes precedence over the basic auth of the url
+func Authorization(config config.Config, u *url.URL) string {
+	if config.ProxyToken != "" {
+		return "Bearer " + config.ProxyToken
+	}
+	if u.User == nil {
+		return ""
+	}
+	password, _ := u.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+}
+
+// Dial dials the tcp address through the upstream proxy if any
+func Dial(config config.Config, addr string) (net.Conn, error) {
+	return DialContext(context.Background(), config, addr)
+}
+
+// DialContext dials the tcp address through the upstream proxy if any
+func DialContext(ctx context.Context, config config.Config, addr string) (net.Conn, error) {
+	u, err := URL(config, addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout(config)}
+	if u == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	case "http", "https":
+		return connect(ctx, config, u, addr)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %v", u.Scheme)
+}
+
+// DialProxy dials the http proxy itself, over tls for https proxies
+func DialProxy(ctx context.Context, config config.Config, u *url.URL) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+	}
+	dialer := &net.Dialer{Timeout: timeout(config)}
+	if u.Scheme == "https" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname()}}
+		return tlsDialer.DialContext(ctx, "tcp", host)
+	}
+	return dialer.DialContext(ctx, "tcp", host)
+}
+
+// connect opens a tunnel to the address through the http proxy with a CONNECT request
+func connect(ctx context.Context, config config.Config, u *url.URL, addr string) (net.Conn, error) {
+	conn, err := DialProxy(ctx, config, u)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if auth := Authorization(config, u); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	conn.SetDeadline(time.Now().Add(timeout(config)))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %v refused the connect: %v", u.Host, res.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// the data sent by the server right after the proxy answer
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// timeout returns the dial timeout of the config
+func timeout(config config.Config) time.Duration {
+	if config.Timeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(config.Timeout) * time.Second
+}
+
+// bufferedConn is a conn reading first the data buffered by the proxy handshake
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,163 @@
+package xretry
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// State is the connection state of a client
+type State int32
+
+const (
+	StateConnecting State = iota
+	StateHandshaking
+	StateConnected
+	StateBackoff
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateHandshaking:
+		return "handshaking"
+	case StateConnected:
+		return "connected"
+	case StateBackoff:
+		return "backoff"
+	default:
+		return "unknown"
+	}
+}
+
+// The current state and listener shared by the client
+var _state int32 = int32(StateConnecting)
+var _listener func(State)
+var _listenerLock sync.RWMutex
+
+// SetStateListener sets the callback invoked on every state change
+func SetStateListener(fn func(State)) {
+	_listenerLock.Lock()
+	defer _listenerLock.Unlock()
+	_listener = fn
+}
+
+// GetState returns the current state
+func GetState() State {
+	return State(atomic.LoadInt32(&_state))
+}
+
+func setState(s State) {
+	if State(atomic.SwapInt32(&_state, int32(s))) == s {
+		return
+	}
+	_listenerLock.RLock()
+	fn := _listener
+	_listenerLock.RUnlock()
+	if fn != nil {
+		fn(s)
+	}
+}
+
+// MinUptime is how long a connection must stay up to reset the backoff
+const MinUptime = 10 * time.Second
+
+// Policy is the reconnect policy with exponential backoff and jitter
+type Policy struct {
+	MinDelay   time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+	Jitter     float64
+	// MinUptime is how long a connection must stay up to reset the backoff,
+	// the connections dropped sooner, e.g. refused by the server after the handshake, keep backing off
+	MinUptime time.Duration
+	attempt   int
+	connected time.Time
+}
+
+// NewPolicy returns a policy built from the config
+func NewPolicy(config config.Config) *Policy {
+	p := &Policy{
+		MinDelay:   time.Duration(config.ReconnectDelay) * time.Second,
+		MaxDelay:   time.Duration(config.ReconnectMaxDelay) * time.Second,
+		Multiplier: 2,
+		Jitter:     config.ReconnectJitter,
+		MinUptime:  MinUptime,
+	}
+	if p.MinDelay <= 0 {
+		p.MinDelay = time.Second
+	}
+	if p.MaxDelay < p.MinDelay {
+		p.MaxDelay = p.MinDelay
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		p.Jitter = 0
+	}
+	return p
+}
+
+// Next returns the delay before the next attempt
+func (p *Policy) Next() time.Duration {
+	d := float64(p.MinDelay)
+	for i := 0; i < p.attempt && d < float64(p.MaxDelay); i++ {
+		d *= p.Multiplier
+	}
+	if d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	p.attempt++
+	if p.Jitter > 0 {
+		// spread the delay over [d*(1-jitter), d*(1+jitter)]
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// Reset resets the attempt counter
+func (p *Policy) Reset() {
+	p.attempt = 0
+}
+
+// Connecting marks the client as dialing the server
+func (p *Policy) Connecting() {
+	setState(StateConnecting)
+}
+
+// Handshaking marks the client as handshaking with the server
+func (p *Policy) Handshaking() {
+	setState(StateHandshaking)
+}
+
+// Connected marks the client as connected, the backoff is reset when it disconnects after the min uptime
+func (p *Policy) Connected() {
+	p.connected = time.Now()
+	setState(StateConnected)
+}
+
+// Disconnected marks the connection as closed, it resets the backoff if the connection stayed up for
+// the min uptime and waits for the next backoff delay otherwise. It returns false if the context is done
+func (p *Policy) Disconnected(_ctx context.Context) bool {
+	if time.Since(p.connected) >= p.MinUptime {
+		p.Reset()
+		return _ctx.Err() == nil
+	}
+	return p.Wait(_ctx)
+}
+
+// Wait sleeps for the next backoff delay, returns false if the context is done
+func (p *Policy) Wait(_ctx context.Context) bool {
+	setState(StateBackoff)
+	timer := time.NewTimer(p.Next())
+	defer timer.Stop()
+	select {
+	case <-_ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,75 @@
+package xretry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy_Next(t *testing.T) {
+	p := NewPolicy(config.Config{ReconnectDelay: 1, ReconnectMaxDelay: 10})
+	assert.Equal(t, 1*time.Second, p.Next())
+	assert.Equal(t, 2*time.Second, p.Next())
+	assert.Equal(t, 4*time.Second, p.Next())
+	assert.Equal(t, 8*time.Second, p.Next())
+	assert.Equal(t, 10*time.Second, p.Next())
+	assert.Equal(t, 10*time.Second, p.Next())
+	p.Reset()
+	assert.Equal(t, 1*time.Second, p.Next())
+}
+
+func TestPolicy_Jitter(t *testing.T) {
+	p := NewPolicy(config.Config{ReconnectDelay: 4, ReconnectMaxDelay: 4, ReconnectJitter: 0.5})
+	for i := 0; i < 100; i++ {
+		d := p.Next()
+		assert.GreaterOrEqual(t, d, 2*time.Second)
+		assert.LessOrEqual(t, d, 6*time.Second)
+	}
+}
+
+func TestPolicy_Disconnected(t *testing.T) {
+	ctx := context.Background()
+	p := NewPolicy(config.Config{ReconnectDelay: 1, ReconnectMaxDelay: 10})
+	p.MinDelay, p.MaxDelay = time.Millisecond, 10*time.Millisecond
+	p.MinUptime = 50 * time.Millisecond
+	// the connections dropped right after they are up keep backing off
+	for i := 0; i < 3; i++ {
+		p.Connected()
+		start := time.Now()
+		assert.True(t, p.Disconnected(ctx))
+		assert.GreaterOrEqual(t, time.Since(start), time.Millisecond<<i)
+	}
+	assert.Equal(t, 8*time.Millisecond, p.Next())
+	// a connection up for the min uptime resets the backoff and reconnects at once
+	p.Connected()
+	time.Sleep(p.MinUptime)
+	start := time.Now()
+	assert.True(t, p.Disconnected(ctx))
+	assert.Less(t, time.Since(start), p.MinDelay*10)
+	assert.Equal(t, time.Millisecond, p.Next())
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	p.Connected()
+	assert.False(t, p.Disconnected(canceled))
+}
+
+func TestPolicy_State(t *testing.T) {
+	var states []State
+	SetStateListener(func(s State) { states = append(states, s) })
+	defer SetStateListener(nil)
+	p := NewPolicy(config.Config{})
+	p.Connecting()
+	p.Handshaking()
+	p.Connected()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, p.Wait(ctx))
+	assert.Equal(t, StateBackoff, GetState())
+	assert.Contains(t, states, StateHandshaking)
+	assert.Contains(t, states, StateConnected)
+	assert.Equal(t, StateBackoff, states[len(states)-1])
+}
@@ -0,0 +1,135 @@
+package xsession
+
+import (
+	"log"
+	"sync"
+
+	"github.com/net-byte/vtun/common/cache"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xproto"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// Session is a client of a datagram server identified by its session id rather than its address,
+// the session id owns the routes to the session so a client can't take over the addresses of another one
+// until that one is dead
+type Session[T any] struct {
+	*cache.Peer
+	ID      xproto.SessionID
+	State   T
+	mx      sync.Mutex
+	counter uint64
+	opened  bool
+}
+
+// Table is the table of the sessions of a datagram server, a session is opened by an authenticated keepalive
+// and dies when no keepalive refreshes it within the keepalive timeout
+type Table[T any] struct {
+	// Retries answers a keepalive repeated with the same counter again, e.g. a query retried by a resolver,
+	// otherwise it is dropped as a replay
+	Retries  bool
+	name     string
+	verbose  bool
+	open     func() T
+	mx       sync.Mutex
+	sessions *gocache.Cache
+}
+
+// NewTable returns the session table of the named transport, the function returns the state of a new session
+func NewTable[T any](name string, config config.Config, open func() T) *Table[T] {
+	t := &Table[T]{
+		name:     name,
+		verbose:  config.Verbose,
+		open:     open,
+		sessions: gocache.New(xalive.Timeout(config), xalive.Interval(config)),
+	}
+	t.sessions.OnEvicted(t.evict)
+	return t
+}
+
+// Get returns the session of the id
+func (t *Table[T]) Get(sid xproto.SessionID) (*Session[T], bool) {
+	if v, ok := t.sessions.Get(sid.String()); ok {
+		return v.(*Session[T]), true
+	}
+	return nil, false
+}
+
+// Lookup returns the session the key is routed to
+func (t *Table[T]) Lookup(key string) (*Session[T], bool) {
+	if v, ok := cache.GetCache().Get(key); ok {
+		sess, ok := v.(*Session[T])
+		return sess, ok
+	}
+	return nil, false
+}
+
+// Route routes the key to the session, it returns false if the key is owned by another session
+func (t *Table[T]) Route(key string, sess *Session[T]) bool {
+	if !sess.Route(key) {
+		netutil.PrintErrF(t.verbose, "%v is owned by another client, dropped\n", key)
+		return false
+	}
+	return true
+}
+
+// Close closes the session and releases its routes
+func (t *Table[T]) Close(sess *Session[T]) {
+	t.sessions.Delete(sess.ID.String())
+}
+
+// evict releases the routes and ip leases of a dead session
+func (t *Table[T]) evict(sid string, v interface{}) {
+	log.Printf("%v session %v is dead", t.name, sid)
+	v.(*Session[T]).Evict()
+}
+
+// session returns the session of the id, it is opened if there is none
+func (t *Table[T]) session(sid xproto.SessionID) *Session[T] {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if sess, ok := t.Get(sid); ok {
+		return sess
+	}
+	sess := &Session[T]{ID: sid, State: t.open()}
+	sess.Peer = cache.NewPeer(sess)
+	sess.SetIdentity(sid.String())
+	t.sessions.Set(sid.String(), sess, gocache.DefaultExpiration)
+	return sess
+}
+
+// KeepAlive opens or refreshes the session of the authenticated keepalive and routes its addresses to it,
+// the bind function updates the state of the session to the keepalive, e.g. rebinds it to a new address.
+// It returns the ack to answer with, or nil if the keepalive is replayed. If the addresses are owned by
+// another session it returns the reject and closes the session, so its client backs off rather than
+// sending packets that are dropped
+func (t *Table[T]) KeepAlive(ka *xproto.UDPKeepAlivePacket, bind func(sess *Session[T])) *xproto.UDPKeepAlivePacket {
+	sess := t.session(ka.SessionID)
+	sess.mx.Lock()
+	if sess.opened && (ka.Counter < sess.counter || ka.Counter == sess.counter && !t.Retries) {
+		// replayed or reordered keepalive
+		sess.mx.Unlock()
+		return nil
+	}
+	sess.opened = true
+	sess.counter = ka.Counter
+	if bind != nil {
+		bind(sess)
+	}
+	sess.mx.Unlock()
+	t.sessions.Set(ka.SessionID.String(), sess, gocache.DefaultExpiration)
+	reply := uint8(xproto.UDPTypeKeepAliveAck)
+	if !t.Route(ka.CIDRv4.String(), sess) || !t.Route(ka.CIDRv6.String(), sess) {
+		log.Printf("%v session %v rejected, its addresses are owned by another client", t.name, ka.SessionID)
+		t.Close(sess)
+		reply = xproto.UDPTypeKeepAliveReject
+	}
+	return &xproto.UDPKeepAlivePacket{
+		UDPHeader: xproto.UDPHeader{Type: reply, SessionID: ka.SessionID},
+		Counter:   ka.Counter,
+		CIDRv4:    ka.CIDRv4,
+		CIDRv6:    ka.CIDRv6,
+	}
+}
@@ -0,0 +1,97 @@
+package xsession
+
+import (
+	"net"
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproto"
+)
+
+func keepAlive(sid xproto.SessionID, counter uint64, v4 string, v6 string) *xproto.UDPKeepAlivePacket {
+	return &xproto.UDPKeepAlivePacket{
+		UDPHeader: xproto.UDPHeader{Type: xproto.UDPTypeKeepAlive, SessionID: sid},
+		Counter:   counter,
+		CIDRv4:    net.ParseIP(v4),
+		CIDRv6:    net.ParseIP(v6),
+	}
+}
+
+func TestRoute(t *testing.T) {
+	table := NewTable("test", config.Config{}, func() int { return 0 })
+	a, b := table.session(xproto.GenSessionID()), table.session(xproto.GenSessionID())
+	if !table.Route("172.16.1.10", a) || !table.Route("172.16.1.10", a) {
+		t.Error("the session should route its own address")
+	}
+	if table.Route("172.16.1.10", b) {
+		t.Error("another session should not take over the address")
+	}
+	if sess, _ := table.Lookup("172.16.1.10"); sess != a {
+		t.Error("the address should stay routed to its owner")
+	}
+	table.Close(a)
+	if _, ok := table.Lookup("172.16.1.10"); ok {
+		t.Error("the routes of a closed session should be released")
+	}
+	if !table.Route("172.16.1.10", b) {
+		t.Error("another session should take the address of a closed session")
+	}
+	table.Close(b)
+}
+
+func TestKeepAlive(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		retries bool
+		second  uint64
+		ack     bool
+	}{
+		{"next counter", false, 2, true},
+		{"replayed", false, 1, false},
+		{"reordered", false, 0, false},
+		{"retried", true, 1, true},
+		{"reordered with retries", true, 0, false},
+	} {
+		table := NewTable("test", config.Config{}, func() int { return 0 })
+		table.Retries = tt.retries
+		sid := xproto.GenSessionID()
+		binds := 0
+		bind := func(sess *Session[int]) { binds++ }
+		ack := table.KeepAlive(keepAlive(sid, 1, "172.16.2.10", "fced:2::10"), bind)
+		if ack == nil || ack.Type != xproto.UDPTypeKeepAliveAck || ack.Counter != 1 {
+			t.Fatalf("%v: the first keepalive should be acked, got %+v", tt.name, ack)
+		}
+		ack = table.KeepAlive(keepAlive(sid, tt.second, "172.16.2.10", "fced:2::10"), bind)
+		if (ack != nil) != tt.ack {
+			t.Errorf("%v: acked should be %v, got %+v", tt.name, tt.ack, ack)
+		}
+		if want := map[bool]int{true: 2, false: 1}[tt.ack]; binds != want {
+			t.Errorf("%v: the session should be bound %v times, got %v", tt.name, want, binds)
+		}
+		sess, _ := table.Get(sid)
+		table.Close(sess)
+	}
+}
+
+func TestKeepAliveReject(t *testing.T) {
+	table := NewTable("test", config.Config{}, func() int { return 0 })
+	a, b := xproto.GenSessionID(), xproto.GenSessionID()
+	if ack := table.KeepAlive(keepAlive(a, 1, "172.16.3.10", "fced:3::10"), nil); ack.Type != xproto.UDPTypeKeepAliveAck {
+		t.Fatalf("the first session should be acked, got type %v", ack.Type)
+	}
+	ack := table.KeepAlive(keepAlive(b, 1, "172.16.3.11", "fced:3::10"), nil)
+	if ack == nil || ack.Type != xproto.UDPTypeKeepAliveReject || ack.SessionID != b || ack.Counter != 1 {
+		t.Fatalf("a session claiming the address of another one should be rejected, got %+v", ack)
+	}
+	if _, ok := table.Get(b); ok {
+		t.Error("the rejected session should be closed")
+	}
+	if _, ok := table.Lookup("172.16.3.11"); ok {
+		t.Error("the rejected session should release the routes it got")
+	}
+	sess, _ := table.Lookup("fced:3::10")
+	if sess == nil || sess.ID != a {
+		t.Fatal("the address should stay routed to its owner")
+	}
+	table.Close(sess)
+}
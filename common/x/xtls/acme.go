@@ -0,0 +1,76 @@
+package xtls
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ServerCertificate sets the server certificate of the tls config,
+// it is obtained and renewed by acme if acme domains are configured, otherwise it is served by a CertStore
+func ServerCertificate(tlsConfig *tls.Config, config config.Config) error {
+	if len(config.ACME.Domains) == 0 {
+		store, err := NewCertStore(config)
+		if err != nil {
+			return err
+		}
+		tlsConfig.GetCertificate = store.GetCertificate
+		return nil
+	}
+	// the acme server presents no client certificate, so tls-alpn-01 can't be answered while one is required
+	clientAuth := config.TLSClientCAFilePath != ""
+	if clientAuth && config.ACME.HTTPAddr == "" {
+		return errors.New("acme requires the http-01 listener address when client certificates are required")
+	}
+	m, err := newManager(config)
+	if err != nil {
+		return err
+	}
+	if config.ACME.HTTPAddr != "" {
+		// answers http-01 challenges, other requests are redirected to https
+		go func() {
+			log.Printf("vtun acme http-01 listener started on %v", config.ACME.HTTPAddr)
+			if err := http.ListenAndServe(config.ACME.HTTPAddr, m.HTTPHandler(nil)); err != nil {
+				log.Printf("acme http-01 listener error %v", err)
+			}
+		}()
+	}
+	tlsConfig.GetCertificate = m.GetCertificate
+	if !clientAuth {
+		// answers tls-alpn-01 challenges on the tls listener itself
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	}
+	return nil
+}
+
+// newManager returns the acme certificate manager of the configured domains
+func newManager(config config.Config) (*autocert.Manager, error) {
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(config.ACME.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(config.ACME.Domains...),
+		RenewBefore: time.Duration(config.ACME.RenewBefore) * 24 * time.Hour,
+		Email:       config.ACME.Email,
+	}
+	if config.ACME.DirectoryURL != "" || config.ACME.CAFilePath != "" {
+		client := &acme.Client{DirectoryURL: config.ACME.DirectoryURL}
+		if config.ACME.CAFilePath != "" {
+			// trusts a private acme directory, e.g. a pebble test server
+			pool, err := LoadCertPool(config.ACME.CAFilePath)
+			if err != nil {
+				return nil, err
+			}
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+			client.HTTPClient = &http.Client{Transport: transport}
+		}
+		m.Client = client
+	}
+	return m, nil
+}
@@ -0,0 +1,245 @@
+package xtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+func TestServerCertificate(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	err := ServerCertificate(tlsConfig, config.Config{
+		TLSCertificateFilePath:    "../../../certs/server.pem",
+		TLSCertificateKeyFilePath: "../../../certs/server.key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.GetCertificate == nil {
+		t.Error("the certificate should be served from the files")
+	}
+	tlsConfig = &tls.Config{}
+	err = ServerCertificate(tlsConfig, config.Config{ACME: config.ACMEConfig{Domains: []string{"vtun.example"}, CacheDir: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.GetCertificate == nil || len(tlsConfig.NextProtos) != 1 || tlsConfig.NextProtos[0] != "acme-tls/1" {
+		t.Error("the certificate should be obtained by acme")
+	}
+	err = ServerCertificate(&tls.Config{}, config.Config{ACME: config.ACMEConfig{Domains: []string{"vtun.example"}, CAFilePath: "../../../certs/server.key"}})
+	if err == nil {
+		t.Error("a key file is not a ca bundle")
+	}
+}
+
+// acmeDirectory stands in for an acme directory issuing the certificates of the orders validated
+// by http-01 on the address, the requests are not authenticated
+func acmeDirectory(t *testing.T, httpAddr string) *httptest.Server {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acme test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	var mx sync.Mutex
+	var domain, status string
+	var chain []byte
+	var srv *httptest.Server
+	reply := func(w http.ResponseWriter, code int, location string, v interface{}) {
+		w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+		if location != "" {
+			w.Header().Set("Location", srv.URL+location)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+	payload := func(r *http.Request, v interface{}) {
+		var jws struct{ Payload string }
+		json.NewDecoder(r.Body).Decode(&jws)
+		b, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		json.Unmarshal(b, v)
+	}
+	order := func() map[string]interface{} {
+		return map[string]interface{}{
+			"status":         status,
+			"identifiers":    []map[string]string{{"type": "dns", "value": domain}},
+			"authorizations": []string{srv.URL + "/authz"},
+			"finalize":       srv.URL + "/finalize",
+			"certificate":    srv.URL + "/cert",
+		}
+	}
+	authz := func() map[string]interface{} {
+		chal := map[string]string{"type": "http-01", "url": srv.URL + "/chal", "token": "token", "status": "pending"}
+		s := "pending"
+		if status != "pending" {
+			s, chal["status"] = "valid", "valid"
+		}
+		return map[string]interface{}{
+			"status":     s,
+			"identifier": map[string]string{"type": "dns", "value": domain},
+			"challenges": []map[string]string{chal},
+		}
+	}
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		switch r.URL.Path {
+		case "/dir":
+			reply(w, http.StatusOK, "", map[string]string{
+				"newNonce":   srv.URL + "/nonce",
+				"newAccount": srv.URL + "/account",
+				"newOrder":   srv.URL + "/order",
+				"revokeCert": srv.URL + "/revoke",
+				"keyChange":  srv.URL + "/key",
+			})
+		case "/nonce":
+			w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+		case "/account":
+			reply(w, http.StatusCreated, "/account/1", map[string]string{"status": "valid"})
+		case "/order":
+			var o struct{ Identifiers []struct{ Value string } }
+			payload(r, &o)
+			domain, status = o.Identifiers[0].Value, "pending"
+			reply(w, http.StatusCreated, "/order/1", order())
+		case "/order/1":
+			reply(w, http.StatusOK, "", order())
+		case "/authz":
+			reply(w, http.StatusOK, "", authz())
+		case "/chal":
+			// validates the challenge served on the http-01 listener
+			req, _ := http.NewRequest("GET", "http://"+httpAddr+"/.well-known/acme-challenge/token", nil)
+			req.Host = domain
+			res, err := http.DefaultClient.Do(req)
+			if err == nil {
+				b, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+				if res.StatusCode == http.StatusOK && strings.HasPrefix(string(b), "token.") {
+					status = "ready"
+				}
+			}
+			reply(w, http.StatusOK, "", authz()["challenges"].([]map[string]string)[0])
+		case "/finalize":
+			var f struct{ CSR string }
+			payload(r, &f)
+			der, _ := base64.RawURLEncoding.DecodeString(f.CSR)
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil || status != "ready" {
+				reply(w, http.StatusForbidden, "", map[string]string{"type": "urn:ietf:params:acme:error:orderNotReady"})
+				return
+			}
+			leaf := &x509.Certificate{
+				SerialNumber: big.NewInt(2),
+				Subject:      pkix.Name{CommonName: domain},
+				DNSNames:     csr.DNSNames,
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(24 * time.Hour),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}
+			leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, csr.PublicKey, caKey)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+			status = "valid"
+			reply(w, http.StatusOK, "/order/1", order())
+		case "/cert":
+			w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+			w.Write(chain)
+		default:
+			reply(w, http.StatusNotFound, "", map[string]string{"type": "urn:ietf:params:acme:error:malformed"})
+		}
+	}))
+	return srv
+}
+
+// TestACMEClientAuth obtains the certificate by http-01 as tls-alpn-01 can't be answered
+// while client certificates are required
+func TestACMEClientAuth(t *testing.T) {
+	err := ServerCertificate(&tls.Config{}, config.Config{
+		TLSClientCAFilePath: "../../../certs/server.pem",
+		ACME:                config.ACMEConfig{Domains: []string{"vtun.example"}, CacheDir: t.TempDir()},
+	})
+	if err == nil {
+		t.Error("acme without the http-01 listener should be refused when client certificates are required")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddr := l.Addr().String()
+	l.Close()
+	directory := acmeDirectory(t, httpAddr)
+	defer directory.Close()
+	tlsConfig := &tls.Config{}
+	err = ServerCertificate(tlsConfig, config.Config{
+		TLSClientCAFilePath: "../../../certs/server.pem",
+		ACME: config.ACMEConfig{
+			Domains:      []string{"vtun.example"},
+			CacheDir:     t.TempDir(),
+			HTTPAddr:     httpAddr,
+			DirectoryURL: directory.URL + "/dir",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsConfig.NextProtos) != 0 {
+		t.Errorf("tls-alpn-01 should not be offered while client certificates are required, got %v", tlsConfig.NextProtos)
+	}
+	// the http-01 listener is started in the background
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", httpAddr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:       "vtun.example",
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || cert.Leaf.VerifyHostname("vtun.example") != nil || cert.Leaf.Issuer.CommonName != "acme test ca" {
+		t.Errorf("the certificate of the domain should be issued by the acme directory, got %+v", cert.Leaf)
+	}
+}
@@ -0,0 +1,141 @@
+package xtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// The interval of checking the certificate files for changes
+const reloadInterval = 10 * time.Second
+
+// CertStore serves the server certificates by sni,
+// the certificates are reloaded when their files change or on SIGHUP so rotating them needs no restart
+type CertStore struct {
+	files  []config.TLSCertificateConfig
+	mx     sync.RWMutex
+	certs  []*tls.Certificate
+	mtimes []time.Time
+}
+
+// NewCertStore loads the server certificate and the sni certificates and starts watching their files,
+// the server certificate is served when no sni certificate matches
+func NewCertStore(config config.Config) (*CertStore, error) {
+	s := &CertStore{}
+	s.files = append(s.files, configTLSCertificate(config))
+	s.files = append(s.files, config.TLSCertificates...)
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	// the pin clients can verify the server certificate with
+	log.Printf("tls certificate pin sha256/%v", base64.StdEncoding.EncodeToString(Pin(s.certs[0].Leaf)))
+	go s.watch()
+	return s, nil
+}
+
+func configTLSCertificate(c config.Config) config.TLSCertificateConfig {
+	return config.TLSCertificateConfig{CertificateFilePath: c.TLSCertificateFilePath, KeyFilePath: c.TLSCertificateKeyFilePath}
+}
+
+// load reads all certificate files, the loaded certificates are kept if any of them fails
+func (s *CertStore) load() error {
+	certs := make([]*tls.Certificate, 0, len(s.files))
+	mtimes := make([]time.Time, 0, len(s.files))
+	for _, f := range s.files {
+		mtime, err := modTime(f)
+		if err != nil {
+			return err
+		}
+		cert, err := tls.LoadX509KeyPair(f.CertificateFilePath, f.KeyFilePath)
+		if err != nil {
+			return err
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		certs = append(certs, &cert)
+		mtimes = append(mtimes, mtime)
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.certs = certs
+	s.mtimes = mtimes
+	return nil
+}
+
+// modTime returns the latest modification time of the certificate and key files
+func modTime(f config.TLSCertificateConfig) (time.Time, error) {
+	var mtime time.Time
+	for _, path := range []string{f.CertificateFilePath, f.KeyFilePath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return mtime, err
+		}
+		if info.ModTime().After(mtime) {
+			mtime = info.ModTime()
+		}
+	}
+	return mtime, nil
+}
+
+// changed returns true if any certificate or key file was modified since it was loaded
+func (s *CertStore) changed() bool {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	for i, f := range s.files {
+		mtime, err := modTime(f)
+		if err == nil && !mtime.Equal(s.mtimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *CertStore) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+		}
+		if err := s.load(); err != nil {
+			log.Printf("failed to reload tls certificates %v", err)
+			continue
+		}
+		log.Println("tls certificates reloaded")
+	}
+}
+
+// Certificate returns the certificate of the server name, or the server certificate if none matches
+func (s *CertStore) Certificate(serverName string) *tls.Certificate {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if serverName != "" {
+		for _, cert := range s.certs[1:] {
+			if cert.Leaf.VerifyHostname(serverName) == nil {
+				return cert
+			}
+		}
+	}
+	return s.certs[0]
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.Certificate(hello.ServerName), nil
+}
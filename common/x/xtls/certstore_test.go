@@ -0,0 +1,91 @@
+package xtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// writeCert writes a self-signed certificate of the name and returns its files
+func writeCert(t *testing.T, dir string, name string) config.TLSCertificateConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := config.TLSCertificateConfig{
+		CertificateFilePath: filepath.Join(dir, name+".pem"),
+		KeyFilePath:         filepath.Join(dir, name+".key"),
+	}
+	os.WriteFile(f.CertificateFilePath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(f.KeyFilePath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return f
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	main := writeCert(t, dir, "main.vtun")
+	sni := writeCert(t, dir, "sni.vtun")
+	s, err := NewCertStore(config.Config{
+		TLSCertificateFilePath:    main.CertificateFilePath,
+		TLSCertificateKeyFilePath: main.KeyFilePath,
+		TLSCertificates:           []config.TLSCertificateConfig{sni},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"": "main.vtun", "sni.vtun": "sni.vtun", "other.vtun": "main.vtun"} {
+		cert, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if cert.Leaf.Subject.CommonName != want {
+			t.Errorf("%q got %q, want %q", name, cert.Leaf.Subject.CommonName, want)
+		}
+	}
+	old := s.Certificate("sni.vtun")
+	if s.changed() {
+		t.Error("unchanged files should not be reloaded")
+	}
+	writeCert(t, dir, "sni.vtun")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(sni.KeyFilePath, later, later)
+	if !s.changed() {
+		t.Fatal("changed files should be reloaded")
+	}
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Certificate("sni.vtun") == old {
+		t.Error("the certificate should be reloaded")
+	}
+	os.WriteFile(sni.CertificateFilePath, []byte("broken"), 0600)
+	if err := s.load(); err == nil {
+		t.Error("a broken certificate should fail to load")
+	}
+	if s.Certificate("sni.vtun") == old || s.Certificate("sni.vtun") == nil {
+		t.Error("the loaded certificates should be kept when reloading fails")
+	}
+}
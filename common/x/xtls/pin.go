@@ -0,0 +1,128 @@
+package xtls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// ErrPinMismatch is returned when no certificate of the server matches a configured pin
+var ErrPinMismatch = errors.New("server certificate does not match any pin")
+
+// Pin returns the SHA-256 pin of the public key of a certificate
+func Pin(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// ParsePin parses a SHA-256 public key pin in base64 or hex, optionally prefixed with "sha256/"
+func ParsePin(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "sha256/")
+	pin, err := hex.DecodeString(s)
+	if err != nil || len(pin) != sha256.Size {
+		pin, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(pin) != sha256.Size {
+		return nil, errors.New("invalid sha256 pin " + s)
+	}
+	return pin, nil
+}
+
+// PeerVerifier returns the verifier of the server certificate against the ca bundle and the public key pins,
+// or nil if neither is configured. With pins only, a self-signed server certificate is accepted if its key is pinned.
+func PeerVerifier(config config.Config) (func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error, error) {
+	if config.TLSCAFilePath == "" && len(config.TLSPins) == 0 {
+		return nil, nil
+	}
+	var roots *x509.CertPool
+	if config.TLSCAFilePath != "" {
+		pool, err := LoadCertPool(config.TLSCAFilePath)
+		if err != nil {
+			return nil, err
+		}
+		roots = pool
+	}
+	var pins [][]byte
+	for _, s := range config.TLSPins {
+		pin, err := ParsePin(s)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	serverName := verifyName(config)
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) == 0 {
+			return errors.New("no server certificate")
+		}
+		if roots != nil {
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: serverName})
+			if err != nil {
+				return err
+			}
+		}
+		if len(pins) == 0 {
+			return nil
+		}
+		for _, cert := range certs {
+			for _, pin := range pins {
+				if bytes.Equal(Pin(cert), pin) {
+					return nil
+				}
+			}
+		}
+		return ErrPinMismatch
+	}, nil
+}
+
+// verifyName returns the name the server certificate is verified for
+func verifyName(config config.Config) string {
+	if config.TLSSni != "" {
+		return config.TLSSni
+	}
+	if config.Host != "" {
+		return config.Host
+	}
+	host, _, err := net.SplitHostPort(config.ServerAddr)
+	if err != nil {
+		return config.ServerAddr
+	}
+	return host
+}
+
+// VerifyServer replaces the verification of the server certificate by the PeerVerifier, if one is configured
+func VerifyServer(tlsConfig *tls.Config, config config.Config) error {
+	return SetVerifier(&tlsConfig.InsecureSkipVerify, &tlsConfig.VerifyPeerCertificate, config)
+}
+
+// SetVerifier sets the PeerVerifier, if one is configured, to the verification fields of a tls config of any package
+func SetVerifier(insecureSkipVerify *bool, verifyPeerCertificate *func([][]byte, [][]*x509.Certificate) error, config config.Config) error {
+	verify, err := PeerVerifier(config)
+	if err != nil || verify == nil {
+		return err
+	}
+	// the default verification against the system roots is replaced, not skipped
+	*insecureSkipVerify = true
+	*verifyPeerCertificate = verify
+	return nil
+}
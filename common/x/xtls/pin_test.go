@@ -0,0 +1,70 @@
+package xtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+func TestParsePin(t *testing.T) {
+	pin := make([]byte, 32)
+	pin[0] = 0x42
+	for _, s := range []string{hex.EncodeToString(pin), base64.StdEncoding.EncodeToString(pin), "sha256/" + base64.StdEncoding.EncodeToString(pin)} {
+		got, err := ParsePin(s)
+		if err != nil || string(got) != string(pin) {
+			t.Errorf("failed to parse pin %q", s)
+		}
+	}
+	if _, err := ParsePin("abcd"); err == nil {
+		t.Error("a short pin should be invalid")
+	}
+}
+
+func TestPeerVerifier(t *testing.T) {
+	dir := t.TempDir()
+	server := writeCert(t, dir, "server.vtun")
+	other := writeCert(t, dir, "other.vtun")
+	cert, err := tls.LoadX509KeyPair(server.CertificateFilePath, server.KeyFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, err := tls.LoadX509KeyPair(other.CertificateFilePath, other.KeyFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verify, err := PeerVerifier(config.Config{}); verify != nil || err != nil {
+		t.Error("no verifier should be configured")
+	}
+	cases := []struct {
+		config config.Config
+		ok     bool
+	}{
+		{config.Config{TLSCAFilePath: server.CertificateFilePath, TLSSni: "server.vtun"}, true},
+		{config.Config{TLSCAFilePath: server.CertificateFilePath, TLSSni: "other.vtun"}, false},
+		{config.Config{TLSCAFilePath: other.CertificateFilePath, ServerAddr: "server.vtun:443"}, false},
+		{config.Config{TLSPins: []string{base64.StdEncoding.EncodeToString(pinOf(t, cert))}}, true},
+		{config.Config{TLSPins: []string{hex.EncodeToString(pinOf(t, otherCert))}}, false},
+		{config.Config{TLSCAFilePath: server.CertificateFilePath, TLSSni: "server.vtun", TLSPins: []string{hex.EncodeToString(pinOf(t, otherCert))}}, false},
+	}
+	for i, c := range cases {
+		verify, err := PeerVerifier(c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verify(cert.Certificate, nil); (err == nil) != c.ok {
+			t.Errorf("case %d got %v, want ok %v", i, err, c.ok)
+		}
+	}
+}
+
+func pinOf(t *testing.T, cert tls.Certificate) []byte {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Pin(leaf)
+}
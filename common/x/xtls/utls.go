@@ -0,0 +1,76 @@
+package xtls
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// The uTLS fingerprints by name
+var fingerprints = map[string]utls.ClientHelloID{
+	"chrome":           utls.HelloChrome_Auto,
+	"firefox":          utls.HelloFirefox_Auto,
+	"safari":           utls.HelloSafari_Auto,
+	"ios":              utls.HelloIOS_Auto,
+	"edge":             utls.HelloEdge_Auto,
+	"randomized":       utls.HelloRandomized,
+	"randomizedalpn":   utls.HelloRandomizedALPN,
+	"randomizednoalpn": utls.HelloRandomizedNoALPN,
+}
+
+// ClientHelloID returns the uTLS fingerprint of the name, defaults to randomized
+func ClientHelloID(name string) utls.ClientHelloID {
+	if id, ok := fingerprints[strings.ToLower(name)]; ok {
+		return id
+	}
+	return utls.HelloRandomized
+}
+
+// UConfig returns the uTLS equivalent of a client tls config
+func UConfig(tlsConfig *tls.Config) *utls.Config {
+	c := &utls.Config{
+		ServerName:            tlsConfig.ServerName,
+		InsecureSkipVerify:    tlsConfig.InsecureSkipVerify,
+		RootCAs:               tlsConfig.RootCAs,
+		NextProtos:            tlsConfig.NextProtos,
+		VerifyPeerCertificate: tlsConfig.VerifyPeerCertificate,
+	}
+	for _, cert := range tlsConfig.Certificates {
+		c.Certificates = append(c.Certificates, utls.Certificate{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey, Leaf: cert.Leaf})
+	}
+	return c
+}
+
+// UClient performs a uTLS handshake with the fingerprint over the conn,
+// the alpn of the fingerprint is replaced by the NextProtos of the tls config if set
+func UClient(conn net.Conn, tlsConfig *tls.Config, fingerprint string) (*utls.UConn, error) {
+	id := ClientHelloID(fingerprint)
+	var uConn *utls.UConn
+	switch id {
+	case utls.HelloRandomized, utls.HelloRandomizedALPN, utls.HelloRandomizedNoALPN:
+		// the randomized fingerprints take the alpn from the config
+		uConn = utls.UClient(conn, UConfig(tlsConfig), id)
+	default:
+		spec, err := utls.UTLSIdToSpec(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(tlsConfig.NextProtos) > 0 {
+			for _, ext := range spec.Extensions {
+				if alpn, ok := ext.(*utls.ALPNExtension); ok {
+					alpn.AlpnProtocols = tlsConfig.NextProtos
+				}
+			}
+		}
+		uConn = utls.UClient(conn, UConfig(tlsConfig), utls.HelloCustom)
+		if err := uConn.ApplyPreset(&spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := uConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return uConn, nil
+}
@@ -0,0 +1,54 @@
+package xtls
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestClientHelloID(t *testing.T) {
+	if ClientHelloID("Chrome") != utls.HelloChrome_Auto || ClientHelloID("unknown") != utls.HelloRandomized {
+		t.Error("unexpected fingerprint")
+	}
+}
+
+func TestUClient(t *testing.T) {
+	f := writeCert(t, t.TempDir(), "server.vtun")
+	cert, err := tls.LoadX509KeyPair(f.CertificateFilePath, f.KeyFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	for _, fingerprint := range []string{"chrome", "firefox", "safari", "randomizedalpn"} {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		uConn, err := UClient(conn, &tls.Config{ServerName: "server.vtun", InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}}, fingerprint)
+		if err != nil {
+			t.Fatalf("%v: %v", fingerprint, err)
+		}
+		if p := uConn.ConnectionState().NegotiatedProtocol; p != "http/1.1" {
+			t.Errorf("%v negotiated %q, want http/1.1", fingerprint, p)
+		}
+		uConn.Close()
+	}
+}
@@ -0,0 +1,86 @@
+package xtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// LoadCertPool loads a PEM bundle of CA certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate found in " + path)
+	}
+	return pool, nil
+}
+
+// Identity returns the client identity of a certificate,
+// the subject common name or else its first DNS name, email address or URI
+func Identity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// IdentityFromRaw returns the client identity of the leaf of a raw certificate chain
+func IdentityFromRaw(chain [][]byte) string {
+	if len(chain) == 0 {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return ""
+	}
+	return Identity(cert)
+}
+
+// VerifyClients requires client certificates verified against the client CA bundle, if one is configured
+func VerifyClients(tlsConfig *tls.Config, config config.Config) error {
+	if config.TLSClientCAFilePath == "" {
+		return nil
+	}
+	pool, err := LoadCertPool(config.TLSClientCAFilePath)
+	if err != nil {
+		return err
+	}
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.ClientCAs = pool
+	return nil
+}
+
+// ClientCertificate makes the client present its certificate, if one is configured
+func ClientCertificate(tlsConfig *tls.Config, config config.Config) error {
+	if config.TLSClientCertificateFilePath == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSClientCertificateFilePath, config.TLSClientCertificateKeyFilePath)
+	if err != nil {
+		return err
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// StateIdentity returns the client identity of the verified certificate of a connection
+func StateIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return Identity(state.PeerCertificates[0])
+}
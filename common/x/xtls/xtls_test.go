@@ -0,0 +1,58 @@
+package xtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+func TestIdentity(t *testing.T) {
+	u, _ := url.Parse("spiffe://vtun/client")
+	cases := []struct {
+		cert *x509.Certificate
+		want string
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, DNSNames: []string{"bob"}}, "alice"},
+		{&x509.Certificate{DNSNames: []string{"bob"}}, "bob"},
+		{&x509.Certificate{EmailAddresses: []string{"carol@vtun"}}, "carol@vtun"},
+		{&x509.Certificate{URIs: []*url.URL{u}}, "spiffe://vtun/client"},
+		{&x509.Certificate{}, ""},
+	}
+	for _, c := range cases {
+		if got := Identity(c.cert); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+	if IdentityFromRaw(nil) != "" || IdentityFromRaw([][]byte{{0x01}}) != "" {
+		t.Error("invalid chain should have no identity")
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	if _, err := LoadCertPool("../../../certs/server.pem"); err != nil {
+		t.Error(err)
+	}
+	if _, err := LoadCertPool("../../../certs/server.key"); err == nil {
+		t.Error("a key file is not a ca bundle")
+	}
+}
+
+func TestVerifyClients(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	if err := VerifyClients(tlsConfig, config.Config{}); err != nil || tlsConfig.ClientAuth != tls.NoClientCert {
+		t.Error("client certificates should not be required without a ca bundle")
+	}
+	if err := VerifyClients(tlsConfig, config.Config{TLSClientCAFilePath: "../../../certs/server.pem"}); err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert || tlsConfig.ClientCAs == nil {
+		t.Error("client certificates should be required with a ca bundle")
+	}
+	if StateIdentity(nil) != "" || StateIdentity(&tls.ConnectionState{}) != "" {
+		t.Error("a connection without certificate should have no identity")
+	}
+}
@@ -0,0 +1,159 @@
+package xws
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xauth"
+)
+
+// The default user agent of the handshake
+const userAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// EarlyDataHeader is the handshake header carrying the early data
+const EarlyDataHeader = "Sec-WebSocket-Protocol"
+
+// LegacyKeyHeader is the header carrying the plain key before the auth token
+const LegacyKeyHeader = "key"
+
+// BatchHeader is the handshake header of a client in the batch mode, the binary frames of its conn are batches
+const BatchHeader = "Vtun-Batch"
+
+// Header returns the handshake header of the client with the configured headers and the auth token
+func Header(config config.Config) http.Header {
+	header := make(http.Header)
+	header.Set("User-Agent", userAgent)
+	for name, value := range config.WSHeaders {
+		header.Set(name, value)
+	}
+	if config.BatchSize > 0 {
+		header.Set(BatchHeader, "1")
+	}
+	if config.Key != "" {
+		value := xauth.Token(config.Key, time.Now())
+		if strings.EqualFold(tokenHeader(config), "Authorization") {
+			value = xauth.BearerPrefix + value
+		}
+		header.Set(tokenHeader(config), value)
+	}
+	return header
+}
+
+// tokenHeader returns the header carrying the auth token
+func tokenHeader(config config.Config) string {
+	if config.WSTokenHeader == "" {
+		return "Authorization"
+	}
+	return config.WSTokenHeader
+}
+
+// tokenTTL returns how long an auth token is valid, the ws one overrides the shared one
+func tokenTTL(config config.Config) time.Duration {
+	if config.WSTokenTTL > 0 {
+		return time.Duration(config.WSTokenTTL) * time.Second
+	}
+	return xauth.TTL(config)
+}
+
+// Authorized returns true if the request carries a valid auth token,
+// or the plain key of an older client if those are accepted
+func Authorized(config config.Config, r *http.Request) bool {
+	if key := r.Header.Get(LegacyKeyHeader); config.WSLegacyKey && key != "" {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(config.Key)) == 1
+	}
+	return xauth.Verify(config.Key, r.Header.Get(tokenHeader(config)), tokenTTL(config))
+}
+
+// EncodeEarlyData encodes the early data into a value of the EarlyDataHeader,
+// it returns false if the encoded data is over the limit of the config
+func EncodeEarlyData(config config.Config, b []byte) (string, bool) {
+	if base64.RawURLEncoding.EncodedLen(len(b)) > config.WSEarlyData {
+		return "", false
+	}
+	return base64.RawURLEncoding.EncodeToString(b), true
+}
+
+// EarlyData returns the early data of the request, or nil if there is none
+func EarlyData(r *http.Request) []byte {
+	value := r.Header.Get(EarlyDataHeader)
+	if value == "" {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// Batched returns true if the client of the request is in the batch mode
+func Batched(r *http.Request) bool {
+	return r.Header.Get(BatchHeader) != ""
+}
+
+// ClientIP returns the ip of the client of the request, the X-Real-IP and X-Forwarded-For headers
+// are only honored when the request comes from a trusted proxy
+func ClientIP(config config.Config, r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	trusted := parseTrusted(config.TrustedProxies)
+	if !isTrusted(trusted, ip) {
+		return ip
+	}
+	// the right most address not added by a trusted proxy is the client
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrusted(trusted, hop) {
+			return ip
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil && isTrusted(trusted, ip) {
+		return realIP
+	}
+	return ip
+}
+
+// parseTrusted parses the trusted proxy cidrs, a single ip is a cidr of itself
+func parseTrusted(proxies []string) []*net.IPNet {
+	var trusted []*net.IPNet
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		if _, ipNet, err := net.ParseCIDR(p); err == nil {
+			trusted = append(trusted, ipNet)
+		}
+	}
+	return trusted
+}
+
+// isTrusted returns true if the ip is in the trusted cidrs
+func isTrusted(trusted []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range trusted {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package xws
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+func TestAuthorized(t *testing.T) {
+	c := config.Config{Key: "secret", WSHeaders: map[string]string{"User-Agent": "vtun"}}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header = Header(c)
+	if r.Header.Get("User-Agent") != "vtun" {
+		t.Error("the configured headers should override the defaults")
+	}
+	if !Authorized(c, r) {
+		t.Error("the request with the token should be authorized")
+	}
+	if Batched(r) {
+		t.Error("the request without batching should not be batched")
+	}
+	r.Header = Header(config.Config{BatchSize: 4096})
+	if !Batched(r) {
+		t.Error("the request in the batch mode should be batched")
+	}
+	r.Header.Set("Authorization", "secret")
+	if Authorized(c, r) {
+		t.Error("the request with the key should not be authorized")
+	}
+}
+
+func TestAuthorizedLegacyKey(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		legacy bool
+		key    string
+		want   bool
+	}{
+		{"key", true, "secret", true},
+		{"wrong key", true, "other", false},
+		{"key not accepted", false, "secret", false},
+	} {
+		r := httptest.NewRequest("GET", "/register/list/ip", nil)
+		r.Header.Set(LegacyKeyHeader, tt.key)
+		if got := Authorized(config.Config{Key: "secret", WSLegacyKey: tt.legacy}, r); got != tt.want {
+			t.Errorf("%v: authorized should be %v, got %v", tt.name, tt.want, got)
+		}
+	}
+	r := httptest.NewRequest("GET", "/register/list/ip", nil)
+	r.Header = Header(config.Config{Key: "secret"})
+	if !Authorized(config.Config{Key: "secret", WSLegacyKey: true}, r) {
+		t.Error("the token should still be authorized while the key is accepted")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	c := config.Config{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}}
+	for _, tt := range []struct {
+		remote, forwarded, realIP, want string
+	}{
+		{"1.2.3.4:80", "5.6.7.8", "", "1.2.3.4"},
+		{"10.0.0.1:80", "5.6.7.8, 9.9.9.9", "", "9.9.9.9"},
+		{"10.0.0.1:80", "5.6.7.8, 192.168.1.1", "", "5.6.7.8"},
+		{"192.168.1.1:80", "", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:80", "", "", "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := ClientIP(c, r); got != tt.want {
+			t.Errorf("%+v got %v, want %v", tt, got, tt.want)
+		}
+	}
+}
+
+func TestEarlyData(t *testing.T) {
+	c := config.Config{WSEarlyData: 16}
+	if _, ok := EncodeEarlyData(c, make([]byte, 32)); ok {
+		t.Error("the data over the limit should not be encoded")
+	}
+	value, ok := EncodeEarlyData(c, []byte("packet"))
+	if !ok {
+		t.Fatal("the data within the limit should be encoded")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(EarlyDataHeader, value)
+	if string(EarlyData(r)) != "packet" {
+		t.Errorf("got %q, want the early data", EarlyData(r))
+	}
+}
@@ -14,6 +14,7 @@ require (
 	github.com/refraction-networking/utls v1.3.2
 	github.com/stretchr/testify v1.8.3
 	github.com/xtaci/kcp-go v5.4.20+incompatible
+	github.com/xtaci/smux v1.5.24
 	golang.org/x/crypto v0.12.0
 	golang.org/x/net v0.14.0
 	google.golang.org/grpc v1.53.0
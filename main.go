@@ -2,17 +2,20 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/net-byte/vtun/common"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/net-byte/vtun/app"
 	"github.com/net-byte/vtun/common/config"
 )
 
-var cfg = config.Config{}
+// the kcp, acme and h1 sections have no flags for every field, so they start from the defaults
+var cfg = config.Config{KCP: config.DefaultConfig.KCP, ACME: config.DefaultConfig.ACME, H1: config.DefaultConfig.H1}
 var configFile string
 
 func init() {
@@ -26,7 +29,7 @@ func init() {
 	flag.StringVar(&cfg.ServerIP, "sip", config.DefaultConfig.ServerIP, "server ip")
 	flag.StringVar(&cfg.ServerIPv6, "sip6", config.DefaultConfig.ServerIPv6, "server ipv6")
 	flag.StringVar(&cfg.Key, "k", config.DefaultConfig.Key, "key")
-	flag.StringVar(&cfg.Protocol, "p", config.DefaultConfig.Protocol, "protocol udp/tls/grpc/quic/utls/dtls/h2/http/tcp/https/ws/wss")
+	flag.StringVar(&cfg.Protocol, "p", config.DefaultConfig.Protocol, "protocol udp/tls/grpc/quic/utls/dtls/h2/http/tcp/https/http-poll/https-poll/ws/wss/icmp/dns")
 	flag.StringVar(&cfg.Path, "path", config.DefaultConfig.Path, "path")
 	flag.BoolVar(&cfg.ServerMode, "S", config.DefaultConfig.ServerMode, "server mode")
 	flag.BoolVar(&cfg.GlobalMode, "g", config.DefaultConfig.GlobalMode, "client global mode")
@@ -37,9 +40,76 @@ func init() {
 	flag.StringVar(&cfg.TLSCertificateKeyFilePath, "privatekey", config.DefaultConfig.TLSCertificateKeyFilePath, "tls certificate key file path")
 	flag.StringVar(&cfg.TLSSni, "sni", config.DefaultConfig.TLSSni, "tls handshake sni")
 	flag.BoolVar(&cfg.TLSInsecureSkipVerify, "isv", config.DefaultConfig.TLSInsecureSkipVerify, "tls insecure skip verify")
+	flag.StringVar(&cfg.TLSCAFilePath, "ca", config.DefaultConfig.TLSCAFilePath, "ca file path to verify the server certificate (client only)")
+	flag.Func("pin", "comma separated sha256 pins of the server public key in base64 or hex (client only)", func(s string) error {
+		cfg.TLSPins = strings.Split(s, ",")
+		return nil
+	})
+	flag.StringVar(&cfg.UTLSFingerprint, "fp", config.DefaultConfig.UTLSFingerprint, "utls fingerprint chrome/firefox/safari/ios/edge/randomized/randomizedalpn/randomizednoalpn (client only)")
+	flag.Func("alpn", "comma separated alpn protocols (utls client only)", func(s string) error {
+		cfg.TLSALPN = strings.Split(s, ",")
+		return nil
+	})
+	flag.BoolVar(&cfg.UTLSHTTP, "utlshttp", config.DefaultConfig.UTLSHTTP, "use the utls fingerprint for the wss/h2/https clients (client only)")
 	flag.BoolVar(&cfg.Verbose, "v", config.DefaultConfig.Verbose, "enable verbose output")
 	flag.BoolVar(&cfg.PSKMode, "psk", config.DefaultConfig.PSKMode, "enable psk mode (dtls only)")
 	flag.StringVar(&cfg.Host, "host", config.DefaultConfig.Host, "http host")
+	flag.StringVar(&cfg.Fallback, "fallback", config.DefaultConfig.Fallback, "url or web root serving the requests not for the tunnel (server only)")
+	flag.StringVar(&cfg.Proxy, "proxy", config.DefaultConfig.Proxy, "upstream proxy url http/https/socks5, empty uses HTTPS_PROXY and direct disables it (client only)")
+	flag.StringVar(&cfg.ProxyToken, "proxytoken", config.DefaultConfig.ProxyToken, "bearer token of the upstream proxy (client only)")
+	flag.BoolVar(&cfg.ProxyForward, "proxyforward", config.DefaultConfig.ProxyForward, "send the http requests through the proxy without CONNECT (http only)")
+	flag.Func("wsheader", "request header of the websocket handshake as name:value, repeatable (ws/wss client only)", func(s string) error {
+		name, value, ok := strings.Cut(s, ":")
+		if !ok {
+			return fmt.Errorf("invalid header %q", s)
+		}
+		if cfg.WSHeaders == nil {
+			cfg.WSHeaders = make(map[string]string)
+		}
+		cfg.WSHeaders[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		return nil
+	})
+	flag.StringVar(&cfg.WSTokenHeader, "wstokenheader", config.DefaultConfig.WSTokenHeader, "header carrying the websocket auth token (ws/wss only)")
+	flag.BoolVar(&cfg.WSLegacyKey, "wslegacykey", config.DefaultConfig.WSLegacyKey, "also accept the plain key header of the clients older than the auth token (ws/wss server only)")
+	flag.IntVar(&cfg.WSEarlyData, "wsearlydata", config.DefaultConfig.WSEarlyData, "max bytes of the first packet sent in the websocket handshake, 0 disables it (ws/wss client only)")
+	flag.IntVar(&cfg.WSMaxConns, "wsmaxconns", config.DefaultConfig.WSMaxConns, "max concurrent connections of the websocket server, 0 is unlimited (ws/wss server only)")
+	flag.Func("trustedproxies", "comma separated cidrs of the proxies whose X-Forwarded-For is trusted (ws/wss server only)", func(s string) error {
+		cfg.TrustedProxies = strings.Split(s, ",")
+		return nil
+	})
+	flag.StringVar(&cfg.GrpcService, "grpcservice", config.DefaultConfig.GrpcService, "grpc service name, must match between client and server (grpc only)")
+	flag.StringVar(&cfg.GrpcMethod, "grpcmethod", config.DefaultConfig.GrpcMethod, "grpc method name, must match between client and server (grpc only)")
+	flag.BoolVar(&cfg.GrpcH2C, "grpch2c", config.DefaultConfig.GrpcH2C, "plaintext h2c without tls, for a server behind a tls terminating proxy such as nginx grpc_pass (grpc only)")
+	flag.IntVar(&cfg.ReconnectDelay, "rd", config.DefaultConfig.ReconnectDelay, "initial reconnect delay in seconds")
+	flag.IntVar(&cfg.ReconnectMaxDelay, "rmd", config.DefaultConfig.ReconnectMaxDelay, "max reconnect delay in seconds")
+	flag.Float64Var(&cfg.ReconnectJitter, "rj", config.DefaultConfig.ReconnectJitter, "reconnect delay jitter from 0 to 1, the delay is spread over delay*(1±jitter)")
+	flag.IntVar(&cfg.KeepAliveInterval, "ka", config.DefaultConfig.KeepAliveInterval, "keepalive interval in seconds")
+	flag.IntVar(&cfg.KeepAliveTimeout, "kt", config.DefaultConfig.KeepAliveTimeout, "keepalive timeout in seconds")
+	flag.IntVar(&cfg.SendQueueSize, "sq", config.DefaultConfig.SendQueueSize, "per client send queue size in packets (server only)")
+	flag.StringVar(&cfg.DropPolicy, "dp", config.DefaultConfig.DropPolicy, "drop policy tail/oldest when a send queue is full (server only)")
+	flag.IntVar(&cfg.BatchSize, "batch", config.DefaultConfig.BatchSize, "max bytes of the packets coalesced into one message, 0 disables batching (grpc/ws/wss/h2 only)")
+	flag.IntVar(&cfg.BatchDelay, "batchdelay", config.DefaultConfig.BatchDelay, "max microseconds a packet waits for a batch (grpc/ws/wss/h2 only)")
+	flag.IntVar(&cfg.RawProto, "rawproto", config.DefaultConfig.RawProto, "raw ip protocol number carrying the packets instead of icmp echo, 0 uses icmp echo (icmp only)")
+	flag.StringVar(&cfg.DNSDomain, "dnsdomain", config.DefaultConfig.DNSDomain, "domain delegated to the server, the packets are carried in its subdomains (dns only)")
+	flag.StringVar(&cfg.DNSType, "dnstype", config.DefaultConfig.DNSType, "record type carrying the packets to the client txt/null/cname (dns only)")
+	flag.IntVar(&cfg.Streams, "streams", config.DefaultConfig.Streams, "number of parallel streams per connection (quic/h2/grpc only)")
+	flag.BoolVar(&cfg.QuicDatagram, "qd", config.DefaultConfig.QuicDatagram, "enable quic datagram mode (quic only)")
+	flag.BoolVar(&cfg.Quic0RTT, "q0rtt", config.DefaultConfig.Quic0RTT, "enable quic 0-rtt resumption, the client reconnects rather than migrates when its local address changes (quic only)")
+	flag.IntVar(&cfg.QuicMaxIdleTimeout, "qidle", config.DefaultConfig.QuicMaxIdleTimeout, "quic max idle timeout in seconds, 0 uses the keepalive timeout (quic only)")
+	flag.StringVar(&cfg.KCP.Mode, "kcpmode", config.DefaultConfig.KCP.Mode, "kcp mode normal/fast/fast2/fast3/manual, manual applies the nodelay settings of the config file (kcp only)")
+	flag.StringVar(&cfg.KCP.Crypt, "kcpcrypt", config.DefaultConfig.KCP.Crypt, "kcp crypt aes/salsa20/none (kcp only)")
+	flag.BoolVar(&cfg.KCP.Smux, "kcpsmux", config.DefaultConfig.KCP.Smux, "enable smux multiplexing (kcp only)")
+	flag.IntVar(&cfg.KCP.Conns, "kcpconns", config.DefaultConfig.KCP.Conns, "number of kcp sessions in the smux pool (kcp only)")
+	flag.StringVar(&cfg.PSKIdentity, "pskid", config.DefaultConfig.PSKIdentity, "psk identity of the client (dtls only)")
+	flag.StringVar(&cfg.TLSClientCAFilePath, "clientca", config.DefaultConfig.TLSClientCAFilePath, "ca file path to require and verify client certificates (server only)")
+	flag.StringVar(&cfg.TLSClientCertificateFilePath, "clientcert", config.DefaultConfig.TLSClientCertificateFilePath, "client certificate file path")
+	flag.StringVar(&cfg.TLSClientCertificateKeyFilePath, "clientkey", config.DefaultConfig.TLSClientCertificateKeyFilePath, "client certificate key file path")
+	flag.Func("acme", "comma separated domains to obtain the server certificate for by acme (server only)", func(s string) error {
+		cfg.ACME.Domains = strings.Split(s, ",")
+		return nil
+	})
+	flag.StringVar(&cfg.ACME.Email, "acmeemail", config.DefaultConfig.ACME.Email, "acme account email (server only)")
+	flag.StringVar(&cfg.ACME.HTTPAddr, "acmehttp", config.DefaultConfig.ACME.HTTPAddr, "acme http-01 challenge listen address, empty uses tls-alpn-01 only, required with -clientca (server only)")
 	flag.Parse()
 }
 
@@ -3,10 +3,16 @@ package kc
 import (
 	"encoding/json"
 	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xretry"
 )
 
 var Config = config.Config{}
 
+// StateListener receives the client connection state changes
+type StateListener interface {
+	OnStateChange(state string)
+}
+
 func Init(str []byte) error {
 	err := json.Unmarshal(str, &Config)
 	if err != nil {
@@ -24,3 +30,19 @@ func Init(str []byte) error {
 	//Config.ServerIPv6 = ip6Net.String()
 	return nil
 }
+
+// SetStateListener sets the listener of the connection state
+func SetStateListener(l StateListener) {
+	if l == nil {
+		xretry.SetStateListener(nil)
+		return
+	}
+	xretry.SetStateListener(func(s xretry.State) {
+		l.OnStateChange(s.String())
+	})
+}
+
+// GetState returns the current connection state
+func GetState() string {
+	return xretry.GetState().String()
+}
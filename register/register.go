@@ -4,6 +4,7 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
@@ -12,6 +13,12 @@ import (
 // The global cache for register
 var _register *cache.Cache
 
+// The client identities owning the client ips
+var _owners = cache.New(cache.NoExpiration, 0)
+
+// The lock of the owners
+var _ownerLock sync.Mutex
+
 func init() {
 	_register = cache.New(30*time.Minute, 3*time.Minute)
 }
@@ -24,6 +31,27 @@ func AddClientIP(ip string) {
 // DeleteClientIP deletes a client ip from the register
 func DeleteClientIP(ip string) {
 	_register.Delete(ip)
+	_owners.Delete(ip)
+}
+
+// ClaimClientIP records the identity as the owner of the client ip,
+// it returns false if the ip is owned by another identity
+func ClaimClientIP(ip string, identity string) bool {
+	_ownerLock.Lock()
+	defer _ownerLock.Unlock()
+	if v, ok := _owners.Get(ip); ok && v.(string) != identity {
+		return false
+	}
+	_owners.Set(ip, identity, cache.NoExpiration)
+	return true
+}
+
+// GetClientIdentity returns the identity owning the client ip
+func GetClientIdentity(ip string) string {
+	if v, ok := _owners.Get(ip); ok {
+		return v.(string)
+	}
+	return ""
 }
 
 // ExistClientIP checks if the client ip is in the register
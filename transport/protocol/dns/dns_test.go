@@ -0,0 +1,249 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xcrypto"
+	"github.com/net-byte/vtun/common/x/xsession"
+	"github.com/net-byte/water"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// tun stands in for the tun device, the packets written to it are received on out
+type tun struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newTun() (*tun, *water.Interface) {
+	t := &tun{in: make(chan []byte, 16), out: make(chan []byte, 16)}
+	return t, &water.Interface{ReadWriteCloser: t}
+}
+
+func (t *tun) Read(b []byte) (int, error) {
+	p, ok := <-t.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, p), nil
+}
+
+func (t *tun) Write(b []byte) (int, error) {
+	t.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (t *tun) Close() error {
+	close(t.in)
+	return nil
+}
+
+// receive returns the next packet written to the tun
+func (t *tun) receive() ([]byte, error) {
+	select {
+	case b := <-t.out:
+		return b, nil
+	case <-time.After(10 * time.Second):
+		return nil, errors.New("no packet")
+	}
+}
+
+// packet returns an ipv4 packet of the size from src to dst
+func packet(src, dst net.IP, size int) []byte {
+	b := make([]byte, size)
+	b[0] = 0x45
+	b[9] = 17
+	copy(b[12:16], src.To4())
+	copy(b[16:20], dst.To4())
+	for i := 20; i < size; i++ {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// resolve stands in for a recursive resolver: it forwards every query to the server under its own id
+// and with the case of the name randomized, sends it twice as the resolvers retry the queries,
+// and relays the first response to the client
+func resolve(t *testing.T, server *net.UDPAddr) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buffer[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			go forward(conn, addr, server, query)
+		}
+	}()
+	return conn
+}
+
+func forward(conn *net.UDPConn, client *net.UDPAddr, server *net.UDPAddr, query dnsmessage.Message) {
+	id := query.ID
+	query.ID = uint16(rand.Uint32())
+	name := []rune(query.Questions[0].Name.String())
+	for i, r := range name {
+		if rand.Intn(2) == 0 {
+			name[i] = unicode.ToUpper(r)
+		}
+	}
+	query.Questions[0].Name = dnsmessage.MustNewName(string(name))
+	b, err := query.Pack()
+	if err != nil {
+		return
+	}
+	upstream, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	upstream.Write(b)
+	upstream.Write(b)
+	upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 65535)
+	for {
+		n, err := upstream.Read(buffer)
+		if err != nil {
+			return
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(buffer[:n]); err != nil || response.ID != query.ID {
+			continue
+		}
+		response.ID = id
+		if b, err := response.Pack(); err == nil {
+			conn.WriteToUDP(b, client)
+		}
+		return
+	}
+}
+
+// TestTunnel carries packets both ways through the resolver stand-in for every record type
+func TestTunnel(t *testing.T) {
+	for _, qtype := range []string{"txt", "null", "cname"} {
+		t.Run(qtype, func(t *testing.T) {
+			cfg := config.Config(config.DefaultConfig)
+			cfg.Key = "secret"
+			cfg.BufferSize = 65535
+			cfg.DNSDomain = "t.Example.com"
+			cfg.DNSType = qtype
+			// every client claims its own addresses as the server routes them to one session only
+			cfg.CIDR = map[string]string{"txt": "172.16.0.10/24", "null": "172.16.0.11/24", "cname": "172.16.0.12/24"}[qtype]
+			cfg.CIDRv6 = map[string]string{"txt": "fced:9999::10/64", "null": "fced:9999::11/64", "cname": "fced:9999::12/64"}[qtype]
+			client, _, _ := net.ParseCIDR(cfg.CIDR)
+			gateway := net.IPv4(172, 16, 0, 1)
+
+			serverTun, serverIFace := newTun()
+			defer serverTun.Close()
+			xp := &xcrypto.XCrypto{}
+			if err := xp.Init(cfg.Key); err != nil {
+				t.Fatal(err)
+			}
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			s := &Server{
+				config:   cfg,
+				iFace:    serverIFace,
+				xp:       xp,
+				conn:     conn,
+				sessions: xsession.NewTable("dns", cfg, newStream),
+			}
+			s.sessions.Retries = true
+			go s.tunToDns()
+			go s.dnsToTun()
+			// the routes are owned by the session until it dies, it is closed once the server is
+			t.Cleanup(func() {
+				if sess, ok := s.sessions.Lookup(client.String()); ok {
+					s.sessions.Close(sess)
+				}
+			})
+
+			resolver := resolve(t, conn.LocalAddr().(*net.UDPAddr))
+			defer resolver.Close()
+			cfg.ServerAddr = resolver.LocalAddr().String()
+			clientTun, clientIFace := newTun()
+			defer clientTun.Close()
+			go StartClient(clientIFace, cfg)
+
+			// larger than a query carries so the packets are cut in fragments both ways
+			up := packet(client, gateway, 600)
+			clientTun.in <- up
+			got, err := serverTun.receive()
+			if err != nil || !bytes.Equal(got, up) {
+				t.Fatalf("the packet should reach the server tun: %v", err)
+			}
+			down := packet(gateway, client, 900)
+			serverTun.in <- down
+			got, err = clientTun.receive()
+			if err != nil || !bytes.Equal(got, down) {
+				t.Fatalf("the packet should reach the client tun: %v", err)
+			}
+		})
+	}
+}
+
+// TestRefused checks the server refuses the names outside its domain and answers the others without data
+func TestRefused(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cfg := config.Config{Key: "secret", DNSDomain: "t.example.com", BufferSize: 65535}
+	s := &Server{config: cfg, conn: conn, sessions: xsession.NewTable("dns", cfg, newStream)}
+	go s.dnsToTun()
+	for _, tt := range []struct {
+		name  string
+		rcode dnsmessage.RCode
+	}{
+		{"www.example.org.", dnsmessage.RCodeRefused},
+		{"t.example.com.", dnsmessage.RCodeSuccess},
+		{"_.t.example.com.", dnsmessage.RCodeSuccess},
+		{strings.Repeat("a", 40) + ".t.example.com.", dnsmessage.RCodeRefused},
+	} {
+		c, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 1},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(tt.name), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}},
+		}
+		b, _ := q.Pack()
+		c.Write(b)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buffer := make([]byte, 65535)
+		n, err := c.Read(buffer)
+		c.Close()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(buffer[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if response.RCode != tt.rcode || len(response.Answers) != 0 {
+			t.Errorf("%v: the response should be %v without answers, got %v with %v", tt.name, tt.rcode, response.RCode, len(response.Answers))
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/net-byte/vtun/common/cipher"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/counter"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xcrypto"
+	"github.com/net-byte/vtun/common/x/xdns"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xretry"
+	"github.com/net-byte/water"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// errRejected is returned when the server rejects the keepalive
+var errRejected = errors.New("rejected by the server, the addresses are owned by another client")
+
+// Client The client struct
+type Client struct {
+	config     config.Config
+	iFace      *water.Interface
+	xp         *xcrypto.XCrypto
+	session    xproto.SessionID
+	qtype      dnsmessage.Type
+	upstream   chan []byte
+	downstream *xdns.Assembler
+	seq        atomic.Uint32
+	counter    atomic.Uint64
+	lastRecv   atomic.Int64
+}
+
+// StartClient starts the dns client, the server address is the resolver or the server itself
+func StartClient(iFace *water.Interface, config config.Config) {
+	if config.DNSDomain == "" {
+		log.Fatalln("the dns domain is required")
+	}
+	log.Printf("vtun dns client started for %v", config.DNSDomain)
+	xp := &xcrypto.XCrypto{}
+	if err := xp.Init(config.Key); err != nil {
+		netutil.PrintErr(err, config.Verbose)
+		return
+	}
+	c := &Client{
+		config:     config,
+		iFace:      iFace,
+		xp:         xp,
+		session:    xproto.GenSessionID(),
+		qtype:      xdns.ParseType(config.DNSType),
+		upstream:   make(chan []byte, maxQueued),
+		downstream: xdns.NewAssembler(),
+	}
+	size := xdns.NameCapacity(config.DNSDomain) - seqLength - xproto.UDPHeaderLength - xdns.FragmentHeaderLength
+	if size < 16 {
+		log.Fatalln("the dns domain is too long:", config.DNSDomain)
+	}
+	go c.tunToDns(size)
+	policy := xretry.NewPolicy(config)
+	for {
+		policy.Connecting()
+		serverAddr, err := net.ResolveUDPAddr("udp", address(config.ServerAddr))
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(context.Background())
+			continue
+		}
+		conns, err := dial(serverAddr, workers+1)
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(context.Background())
+			continue
+		}
+		if err := c.sendKeepAlive(conns[0]); err != nil {
+			if errors.Is(err, errRejected) {
+				log.Println(err)
+			} else {
+				netutil.PrintErr(err, config.Verbose)
+			}
+			closeAll(conns)
+			policy.Wait(context.Background())
+			continue
+		}
+		c.lastRecv.Store(time.Now().UnixNano())
+		policy.Connected()
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		for _, conn := range conns[1:] {
+			wg.Add(1)
+			go func(conn *net.UDPConn) {
+				defer wg.Done()
+				c.worker(ctx, conn)
+			}(conn)
+		}
+		c.keepAlive(ctx, conns[0], serverAddr)
+		cancel()
+		closeAll(conns)
+		wg.Wait()
+		policy.Disconnected(context.Background())
+	}
+}
+
+// dial returns n sockets to the server, each one carries a single query at a time
+func dial(serverAddr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	var conns []*net.UDPConn
+	for i := 0; i < n; i++ {
+		conn, err := net.DialUDP("udp", nil, serverAddr)
+		if err != nil {
+			closeAll(conns)
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+func closeAll(conns []*net.UDPConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// exchange sends the message in a query and returns the data of the answer
+func (c *Client) exchange(conn *net.UDPConn, msg []byte) ([]byte, error) {
+	payload := make([]byte, seqLength, seqLength+len(msg))
+	binary.BigEndian.PutUint16(payload, uint16(c.seq.Add(1)))
+	name, err := xdns.EncodeName(append(payload, msg...), c.config.DNSDomain)
+	if err != nil {
+		return nil, err
+	}
+	id := uint16(rand.Uint32())
+	query, err := xdns.Query(id, name, c.qtype)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(queryTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, xdns.MaxSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(buffer[:n]); err != nil || !response.Response || response.ID != id {
+			continue
+		}
+		if len(response.Questions) != 1 || !strings.EqualFold(response.Questions[0].Name.String(), name.String()) {
+			// a late response to an earlier query
+			continue
+		}
+		if response.RCode != dnsmessage.RCodeSuccess {
+			return nil, errors.New("dns query failed: " + response.RCode.String())
+		}
+		return xdns.AnswerData(&response, c.config.DNSDomain)
+	}
+}
+
+// worker keeps a query in flight, it sends the fragments from tun or polls for the fragments to the client,
+// it polls again at once while the server has more and waits a while for a fragment to send after an empty poll
+func (c *Client) worker(ctx context.Context, conn *net.UDPConn) {
+	header := (&xproto.UDPHeader{Type: xproto.UDPTypeData, SessionID: c.session}).Bytes()
+	idle := false
+	for {
+		var fragment []byte
+		if idle {
+			timer := time.NewTimer(idleTimeout)
+			select {
+			case fragment = <-c.upstream:
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+			timer.Stop()
+		} else {
+			select {
+			case fragment = <-c.upstream:
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+		resp, err := c.exchange(conn, xproto.Merge(header, fragment))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			netutil.PrintErr(err, c.config.Verbose)
+			idle = true
+			continue
+		}
+		c.lastRecv.Store(time.Now().UnixNano())
+		if len(resp) == 0 {
+			idle = true
+			continue
+		}
+		f := xdns.ParseFragment(resp[1:])
+		if f != nil {
+			if packet := c.downstream.Add(f); packet != nil {
+				c.write(packet)
+			}
+		}
+		idle = f == nil && resp[0]&flagMore == 0
+	}
+}
+
+// write opens the packet from the server and writes it to tun
+func (c *Client) write(packet []byte) {
+	b, err := open(c.xp, c.session, dirDown, packet)
+	if err != nil {
+		netutil.PrintErr(err, c.config.Verbose)
+		return
+	}
+	n := len(packet)
+	if c.config.Compress {
+		b, err = snappy.Decode(nil, b)
+		if err != nil {
+			netutil.PrintErr(err, c.config.Verbose)
+			return
+		}
+	}
+	if c.config.Obfs {
+		b = cipher.XOR(b)
+	}
+	c.iFace.Write(b)
+	counter.IncrReadBytes(n)
+}
+
+// tunToDns seals the packets from tun and queues their fragments of up to size bytes to the workers
+func (c *Client) tunToDns(size int) {
+	packet := make([]byte, c.config.BufferSize)
+	var id uint16
+	for {
+		n, err := c.iFace.Read(packet)
+		if err != nil {
+			netutil.PrintErr(err, c.config.Verbose)
+			break
+		}
+		b := packet[:n]
+		if c.config.Obfs {
+			b = cipher.XOR(b)
+		}
+		if c.config.Compress {
+			b = snappy.Encode(nil, b)
+		}
+		ci, err := seal(c.xp, c.session, dirUp, b)
+		if err != nil {
+			netutil.PrintErr(err, c.config.Verbose)
+			continue
+		}
+		id++
+		for _, f := range xdns.Split(id, ci, size) {
+			c.upstream <- f.Bytes()
+		}
+		counter.IncrWrittenBytes(n)
+	}
+}
+
+// sendKeepAlive opens or refreshes the session on the server
+func (c *Client) sendKeepAlive(conn *net.UDPConn) error {
+	ka, err := xproto.GenClientHandshakePacket(c.config)
+	if err != nil {
+		return err
+	}
+	key := []byte(c.config.Key)
+	k := &xproto.UDPKeepAlivePacket{
+		UDPHeader: xproto.UDPHeader{Type: xproto.UDPTypeKeepAlive, SessionID: c.session},
+		Counter:   c.counter.Add(1),
+		CIDRv4:    ka.CIDRv4,
+		CIDRv6:    ka.CIDRv6,
+	}
+	resp, err := c.exchange(conn, k.Bytes(key))
+	if err != nil {
+		return err
+	}
+	ack := xproto.ParseUDPKeepAlivePacket(resp, key)
+	if ack == nil || ack.SessionID != c.session {
+		return errors.New("invalid keepalive ack")
+	}
+	if ack.Type == xproto.UDPTypeKeepAliveReject && ack.Counter == k.Counter {
+		return errRejected
+	}
+	if ack.Type != xproto.UDPTypeKeepAliveAck {
+		return errors.New("invalid keepalive ack")
+	}
+	c.lastRecv.Store(time.Now().UnixNano())
+	return nil
+}
+
+// keepAlive sends the keepalives until the server stops answering
+func (c *Client) keepAlive(_ctx context.Context, conn *net.UDPConn, serverAddr *net.UDPAddr) {
+	ticker := time.NewTicker(xalive.Interval(c.config))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-_ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(time.Unix(0, c.lastRecv.Load())) > xalive.Timeout(c.config) {
+			log.Printf("no response from server %v, reconnecting", serverAddr)
+			return
+		}
+		if err := c.sendKeepAlive(conn); err != nil {
+			if errors.Is(err, errRejected) {
+				log.Println(err)
+				return
+			}
+			netutil.PrintErr(err, c.config.Verbose)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/net-byte/vtun/common/x/xcrypto"
+	"github.com/net-byte/vtun/common/x/xdns"
+	"github.com/net-byte/vtun/common/x/xproto"
+)
+
+// The directions authenticated with the sealed packets
+const (
+	dirUp   byte = 0x01
+	dirDown byte = 0x02
+)
+
+// seqLength is the length of the sequence prefixing the queries, so a resolver never answers one from its cache
+const seqLength = 2
+
+// flagMore tells the client the server has more fragments queued for it
+const flagMore byte = 0x01
+
+// holdTimeout is how long the server holds a poll while it has nothing to send
+const holdTimeout = 500 * time.Millisecond
+
+// idleTimeout is how long a client worker waits for a packet to send after an empty poll
+const idleTimeout = time.Second
+
+// queryTimeout is how long the client waits for the response to a query
+const queryTimeout = 3 * time.Second
+
+// workers is the number of queries the client keeps in flight
+const workers = 4
+
+// maxQueued is the max number of packets queued for a client
+const maxQueued = 256
+
+// maxAnswers is the max number of responses a session keeps for the queries retried by the resolvers
+const maxAnswers = 64
+
+// seal returns the packet of the session sealed in the direction
+func seal(xp *xcrypto.XCrypto, sid xproto.SessionID, dir byte, b []byte) ([]byte, error) {
+	return xp.Seal(b, ad(sid, dir))
+}
+
+// open returns the packet of the session sealed in the direction
+func open(xp *xcrypto.XCrypto, sid xproto.SessionID, dir byte, ci []byte) ([]byte, error) {
+	return xp.Open(ci, ad(sid, dir))
+}
+
+// ad returns the additional data authenticated with the packets
+func ad(sid xproto.SessionID, dir byte) []byte {
+	h := &xproto.UDPHeader{Type: xproto.UDPTypeData, SessionID: sid}
+	return append(h.Bytes(), dir)
+}
+
+// address returns the address with the dns port if it has none
+func address(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, "53")
+	}
+	return addr
+}
+
+// downstream is the queue of the sealed packets to a client, they are cut in fragments
+// as the polls come in since every query has room for a different size
+type downstream struct {
+	mx      sync.Mutex
+	packets [][]byte
+	offset  int
+	index   uint8
+	id      uint16
+	ready   chan struct{}
+}
+
+func newDownstream() *downstream {
+	return &downstream{ready: make(chan struct{}, 1)}
+}
+
+// push queues the packet, the oldest one is dropped when the queue is full
+func (d *downstream) push(b []byte) {
+	d.mx.Lock()
+	if len(d.packets) == maxQueued {
+		d.drop()
+	}
+	d.packets = append(d.packets, b)
+	d.mx.Unlock()
+	select {
+	case d.ready <- struct{}{}:
+	default:
+	}
+}
+
+// drop removes the head packet
+func (d *downstream) drop() {
+	d.packets = d.packets[1:]
+	d.offset = 0
+	d.index = 0
+	d.id++
+}
+
+// next returns the next fragment of up to size bytes of data, or nil if there is none,
+// and whether more fragments are queued after it
+func (d *downstream) next(size int) (*xdns.Fragment, bool) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if len(d.packets) == 0 || size <= 0 {
+		return nil, false
+	}
+	head := d.packets[0]
+	n := min(size, len(head)-d.offset)
+	f := &xdns.Fragment{ID: d.id, Index: d.index, Last: d.offset+n == len(head), Data: head[d.offset : d.offset+n]}
+	if f.Last || d.index == 0xff {
+		d.drop()
+	} else {
+		d.offset += n
+		d.index++
+	}
+	return f, len(d.packets) > 0
+}
+
+// wait waits until a packet is queued or the timeout expires
+func (d *downstream) wait(timeout time.Duration) {
+	d.mx.Lock()
+	empty := len(d.packets) == 0
+	if empty {
+		// the signal of a packet already sent
+		select {
+		case <-d.ready:
+		default:
+		}
+	}
+	d.mx.Unlock()
+	if !empty {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-d.ready:
+	case <-timer.C:
+	}
+}
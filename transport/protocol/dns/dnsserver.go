@@ -0,0 +1,283 @@
+package dns
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/net-byte/vtun/common/cipher"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/counter"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xcrypto"
+	"github.com/net-byte/vtun/common/x/xdns"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xsession"
+	"github.com/net-byte/water"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Server the server struct
+type Server struct {
+	config   config.Config
+	iFace    *water.Interface
+	xp       *xcrypto.XCrypto
+	conn     *net.UDPConn
+	sessions *xsession.Table[*stream]
+}
+
+// session is a client identified by its session id, the queries come through any resolver
+type session = xsession.Session[*stream]
+
+// stream is the fragments exchanged with a session and the responses to its last queries
+type stream struct {
+	mx         sync.Mutex
+	upstream   *xdns.Assembler
+	downstream *downstream
+	answers    map[string][]byte
+	names      []string
+	pending    map[string]chan struct{}
+}
+
+func newStream() *stream {
+	return &stream{
+		upstream:   xdns.NewAssembler(),
+		downstream: newDownstream(),
+		answers:    make(map[string][]byte),
+		pending:    make(map[string]chan struct{}),
+	}
+}
+
+// answer returns the response to a query name already answered, the resolvers retry the queries.
+// A retry of a query still held waits for its response, so the two never take a fragment each
+// while the resolver relays one of them only. Otherwise the name is claimed until its response is remembered
+func (s *stream) answer(name string) ([]byte, bool) {
+	for {
+		s.mx.Lock()
+		if data, ok := s.answers[name]; ok {
+			s.mx.Unlock()
+			return data, true
+		}
+		done, ok := s.pending[name]
+		if !ok {
+			s.pending[name] = make(chan struct{})
+			s.mx.Unlock()
+			return nil, false
+		}
+		s.mx.Unlock()
+		<-done
+	}
+}
+
+// remember keeps the response to the query name, the oldest one is forgotten when there are too many
+func (s *stream) remember(name string, data []byte) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if len(s.names) == maxAnswers {
+		delete(s.answers, s.names[0])
+		s.names = s.names[1:]
+	}
+	s.answers[name] = data
+	s.names = append(s.names, name)
+	if done, ok := s.pending[name]; ok {
+		close(done)
+		delete(s.pending, name)
+	}
+}
+
+// StartServer starts the dns server, it must be the authoritative nameserver of the domain
+func StartServer(iFace *water.Interface, config config.Config) {
+	if config.DNSDomain == "" {
+		log.Fatalln("the dns domain is required")
+	}
+	log.Printf("vtun dns server started on %v for %v", config.LocalAddr, config.DNSDomain)
+	xp := &xcrypto.XCrypto{}
+	if err := xp.Init(config.Key); err != nil {
+		log.Panic(err)
+	}
+	localAddr, err := net.ResolveUDPAddr("udp", address(config.LocalAddr))
+	if err != nil {
+		log.Fatalln("failed to get udp socket:", err)
+	}
+	conn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		log.Fatalln("failed to listen on udp socket:", err)
+	}
+	defer conn.Close()
+	s := &Server{
+		config:   config,
+		iFace:    iFace,
+		xp:       xp,
+		conn:     conn,
+		sessions: xsession.NewTable("dns", config, newStream),
+	}
+	// the resolvers retry the queries, the keepalives among them
+	s.sessions.Retries = true
+	go s.tunToDns()
+	s.dnsToTun()
+}
+
+// tunToDns queues packets from tun to the sessions
+func (s *Server) tunToDns() {
+	packet := make([]byte, s.config.BufferSize)
+	for {
+		n, err := s.iFace.Read(packet)
+		if err != nil {
+			netutil.PrintErr(err, s.config.Verbose)
+			break
+		}
+		b := packet[:n]
+		if key := netutil.GetDstKey(b); key != "" {
+			if sess, ok := s.sessions.Lookup(key); ok {
+				if s.config.Obfs {
+					b = cipher.XOR(b)
+				}
+				if s.config.Compress {
+					b = snappy.Encode(nil, b)
+				}
+				ci, err := seal(s.xp, sess.ID, dirDown, b)
+				if err != nil {
+					netutil.PrintErr(err, s.config.Verbose)
+					continue
+				}
+				sess.State.downstream.push(ci)
+				counter.IncrWrittenBytes(n)
+			}
+		}
+	}
+}
+
+// dnsToTun answers the queries, every query is answered in its own goroutine as the polls are held
+func (s *Server) dnsToTun() {
+	buffer := make([]byte, xdns.MaxSize)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			netutil.PrintErr(err, s.config.Verbose)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buffer[:n]); err != nil || query.Response || len(query.Questions) != 1 {
+			continue
+		}
+		go s.handle(&query, addr)
+	}
+}
+
+// handle answers the query, the names under the domain that carry no tunnel message get an empty answer
+// so the resolvers minimizing the query names go on, and the names outside it are refused
+func (s *Server) handle(query *dnsmessage.Message, addr *net.UDPAddr) {
+	q := query.Questions[0]
+	var resp []byte
+	var err error
+	data, ok := xdns.DecodeName(q.Name, s.config.DNSDomain)
+	switch {
+	case !xdns.InDomain(q.Name, s.config.DNSDomain):
+		resp, err = xdns.Reply(query, dnsmessage.RCodeRefused)
+	case !ok || len(data) < seqLength+xproto.UDPHeaderLength || !tunnelType(q.Type):
+		resp, err = xdns.Reply(query, dnsmessage.RCodeSuccess)
+	default:
+		resp, err = s.tunnel(query, data[seqLength:])
+	}
+	if err != nil {
+		netutil.PrintErr(err, s.config.Verbose)
+		return
+	}
+	if _, err := s.conn.WriteToUDP(resp, addr); err != nil {
+		netutil.PrintErr(err, s.config.Verbose)
+	}
+}
+
+// tunnelType returns true if the answers of the type carry data
+func tunnelType(t dnsmessage.Type) bool {
+	return t == dnsmessage.TypeTXT || t == xdns.TypeNULL || t == dnsmessage.TypeCNAME
+}
+
+// tunnel handles the tunnel message of the query and returns the response
+func (s *Server) tunnel(query *dnsmessage.Message, msg []byte) ([]byte, error) {
+	h := xproto.ParseUDPHeader(msg)
+	if h.Type == xproto.UDPTypeKeepAlive {
+		ka := xproto.ParseUDPKeepAlivePacket(msg, []byte(s.config.Key))
+		if ka == nil {
+			netutil.PrintErr(errors.New("authentication failed"), s.config.Verbose)
+			return xdns.Reply(query, dnsmessage.RCodeRefused)
+		}
+		return s.keepAlive(query, ka)
+	}
+	if h.Type != xproto.UDPTypeData {
+		return xdns.Reply(query, dnsmessage.RCodeRefused)
+	}
+	sess, ok := s.sessions.Get(h.SessionID)
+	if !ok {
+		// the session must be opened by an authenticated keepalive first
+		return xdns.Reply(query, dnsmessage.RCodeRefused)
+	}
+	st := sess.State
+	name := strings.ToLower(query.Questions[0].Name.String())
+	if resp, ok := st.answer(name); ok {
+		return xdns.Answer(query, resp, s.config.DNSDomain)
+	}
+	if fragment := msg[xproto.UDPHeaderLength:]; len(fragment) > 0 {
+		if f := xdns.ParseFragment(fragment); f != nil {
+			if packet := st.upstream.Add(f); packet != nil {
+				s.write(sess, packet)
+			}
+		}
+	} else {
+		// poll
+		st.downstream.wait(holdTimeout)
+	}
+	resp := []byte{0}
+	size := xdns.Capacity(query, s.config.DNSDomain) - len(resp) - xdns.FragmentHeaderLength
+	if f, more := st.downstream.next(size); f != nil {
+		if more {
+			resp[0] |= flagMore
+		}
+		resp = append(resp, f.Bytes()...)
+	}
+	st.remember(name, resp)
+	return xdns.Answer(query, resp, s.config.DNSDomain)
+}
+
+// write opens the packet of the session and writes it to tun
+func (s *Server) write(sess *session, packet []byte) {
+	b, err := open(s.xp, sess.ID, dirUp, packet)
+	if err != nil {
+		netutil.PrintErr(err, s.config.Verbose)
+		return
+	}
+	n := len(packet)
+	if s.config.Compress {
+		b, err = snappy.Decode(nil, b)
+		if err != nil {
+			netutil.PrintErr(err, s.config.Verbose)
+			return
+		}
+	}
+	if s.config.Obfs {
+		b = cipher.XOR(b)
+	}
+	if srcKey := netutil.GetSrcKey(b); srcKey != "" {
+		if !s.sessions.Route(srcKey, sess) {
+			return
+		}
+		s.iFace.Write(b)
+		counter.IncrReadBytes(n)
+	}
+}
+
+// keepAlive opens or refreshes the session and answers with the ack, or the reject if its addresses are owned
+// by another session, a keepalive retried by the resolver is answered again
+func (s *Server) keepAlive(query *dnsmessage.Message, ka *xproto.UDPKeepAlivePacket) ([]byte, error) {
+	ack := s.sessions.KeepAlive(ka, nil)
+	if ack == nil {
+		return xdns.Reply(query, dnsmessage.RCodeRefused)
+	}
+	return xdns.Answer(query, ack.Bytes([]byte(s.config.Key)), s.config.DNSDomain)
+}
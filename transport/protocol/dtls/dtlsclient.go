@@ -2,10 +2,14 @@ package dtls
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/golang/snappy"
 	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/counter"
+	"github.com/net-byte/vtun/common/x/xalive"
 	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xretry"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/vtun/common/x/xtun"
 	"github.com/pion/dtls/v2"
 	"log"
@@ -28,9 +32,9 @@ func StartClientForApi(config config.Config, outputStream <-chan []byte, inputSt
 	if config.PSKMode {
 		tlsConfig = &dtls.Config{
 			PSK: func(bytes []byte) ([]byte, error) {
-				return []byte{0x09, 0x46, 0x59, 0x02, 0x49}, nil
+				return lookupPSK(config, pskIdentity(config))
 			},
-			PSKIdentityHint:      []byte(config.Key),
+			PSKIdentityHint:      []byte(pskIdentity(config)),
 			CipherSuites:         []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256, dtls.TLS_PSK_WITH_AES_128_CCM_8},
 			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
 		}
@@ -42,27 +46,45 @@ func StartClientForApi(config config.Config, outputStream <-chan []byte, inputSt
 		if config.TLSSni != "" {
 			tlsConfig.ServerName = config.TLSSni
 		}
+		if config.TLSClientCertificateFilePath != "" {
+			certificate, err := tls.LoadX509KeyPair(config.TLSClientCertificateFilePath, config.TLSClientCertificateKeyFilePath)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+		if err := xtls.SetVerifier(&tlsConfig.InsecureSkipVerify, &tlsConfig.VerifyPeerCertificate, config); err != nil {
+			log.Fatalln(err)
+		}
 	}
 	go tun2Conn(config, outputStream, _ctx, readCallback)
+	policy := xretry.NewPolicy(config)
 	for xtun.ContextOpened(_ctx) {
-		ctx, cancel := context.WithTimeout(_ctx, 30*time.Second)
-		defer cancel()
+		policy.Connecting()
 		addr, err := net.ResolveUDPAddr("udp", config.ServerAddr)
 		if err != nil {
-			time.Sleep(3 * time.Second)
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
+		policy.Handshaking()
+		ctx, cancel := context.WithTimeout(_ctx, 30*time.Second)
 		conn, err := dtls.DialWithContext(ctx, "udp", addr, tlsConfig)
+		cancel()
 		if err != nil {
-			time.Sleep(3 * time.Second)
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
 		cache.GetCache().Set(ConnTag, conn, 24*time.Hour)
+		policy.Connected()
+		kaCtx, kaCancel := context.WithCancel(_ctx)
+		go keepAlive(config, conn, kaCtx)
 		conn2Tun(config, conn, inputStream, _ctx, writeCallback)
+		kaCancel()
 		cache.GetCache().Delete(ConnTag)
 		conn.Close()
+		policy.Disconnected(_ctx)
 	}
 }
 
@@ -104,17 +126,26 @@ func tun2Conn(config config.Config, outputStream <-chan []byte, _ctx context.Con
 	}
 }
 
+// keepAlive sends keepalive packets to the server until the context is done
+func keepAlive(config config.Config, conn *dtls.Conn, _ctx context.Context) {
+	xalive.Run(_ctx, config, func() error {
+		_, err := conn.Write(xproto.KeepAlivePacket)
+		return err
+	})
+}
+
 // conn2Tun sends packets from conn to tun
 func conn2Tun(config config.Config, conn *dtls.Conn, inputStream chan<- []byte, _ctx context.Context, callback func(int)) {
 	defer conn.Close()
 	buffer := make([]byte, config.BufferSize)
 	for xtun.ContextOpened(_ctx) {
+		conn.SetReadDeadline(xalive.Deadline(config))
 		count, err := conn.Read(buffer)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
 			break
 		}
-		if count == 0 {
+		if count == 0 || xproto.IsKeepAlive(buffer[:count]) {
 			continue
 		}
 		b := buffer[:count]
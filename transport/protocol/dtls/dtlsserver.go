@@ -9,7 +9,10 @@ import (
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xchan"
 	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/water"
 	"github.com/pion/dtls/v2"
 	"log"
@@ -25,10 +28,9 @@ func StartServer(iFace *water.Interface, config config.Config) {
 	var tlsConfig *dtls.Config
 	if config.PSKMode {
 		tlsConfig = &dtls.Config{
-			PSK: func(bytes []byte) ([]byte, error) {
-				return []byte{0x09, 0x46, 0x59, 0x02, 0x49}, nil
+			PSK: func(identity []byte) ([]byte, error) {
+				return lookupPSK(config, string(identity))
 			},
-			PSKIdentityHint:      []byte(config.Key),
 			CipherSuites:         []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256, dtls.TLS_PSK_WITH_AES_128_CCM_8},
 			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
 			ConnectContextMaker: func() (context.Context, func()) {
@@ -36,18 +38,28 @@ func StartServer(iFace *water.Interface, config config.Config) {
 			},
 		}
 	} else {
-		certificate, err := tls.LoadX509KeyPair(config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
+		store, err := xtls.NewCertStore(config)
 		if err != nil {
 			log.Panic(err)
 		}
 		tlsConfig = &dtls.Config{
-			Certificates:         []tls.Certificate{certificate},
+			GetCertificate: func(hello *dtls.ClientHelloInfo) (*tls.Certificate, error) {
+				return store.Certificate(hello.ServerName), nil
+			},
 			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
 			ClientAuth:           dtls.NoClientCert,
 			ConnectContextMaker: func() (context.Context, func()) {
 				return context.WithTimeout(_ctx, 30*time.Second)
 			},
 		}
+		if config.TLSClientCAFilePath != "" {
+			pool, err := xtls.LoadCertPool(config.TLSClientCAFilePath)
+			if err != nil {
+				log.Panic(err)
+			}
+			tlsConfig.ClientAuth = dtls.RequireAndVerifyClientCert
+			tlsConfig.ClientCAs = pool
+		}
 	}
 	addr, err := net.ResolveUDPAddr("udp", config.LocalAddr)
 	if err != nil {
@@ -89,14 +101,7 @@ func toClient(config config.Config, iFace *water.Interface) {
 				if config.Compress {
 					b = snappy.Encode(nil, b)
 				}
-				conn := v.(*dtls.Conn)
-				n, err = conn.Write(xproto.Copy(b))
-				if err != nil {
-					cache.GetCache().Delete(key)
-					netutil.PrintErr(err, config.Verbose)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
+				v.(*xchan.SendQueue).Push(xproto.Copy(b))
 			}
 		}
 	}
@@ -106,8 +111,32 @@ func toClient(config config.Config, iFace *water.Interface) {
 func toServer(config config.Config, conn *dtls.Conn, iFace *water.Interface) {
 	buffer := make([]byte, config.BufferSize)
 	defer conn.Close()
+	queue := xchan.NewSendQueue(config.SendQueueSize, xchan.ParseDropPolicy(config.DropPolicy), func(b []byte) error {
+		n, err := conn.Write(b)
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			conn.Close()
+			return err
+		}
+		counter.IncrWrittenBytes(n)
+		return nil
+	})
+	defer queue.Close()
+	peer := cache.NewPeer(queue)
+	defer peer.Evict()
+	// the psk identity or the subject of the verified client certificate
+	state := conn.ConnectionState()
+	identity := string(state.IdentityHint)
+	if len(state.PeerCertificates) > 0 {
+		identity = xtls.IdentityFromRaw(state.PeerCertificates)
+	}
+	peer.SetIdentity(identity)
+	if config.Verbose {
+		log.Printf("dtls client %v identity %q", conn.RemoteAddr(), identity)
+	}
 	for {
 		var n int
+		conn.SetReadDeadline(xalive.Deadline(config))
 		count, err := conn.Read(buffer)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -116,6 +145,10 @@ func toServer(config config.Config, conn *dtls.Conn, iFace *water.Interface) {
 		if count == 0 {
 			continue
 		}
+		if xproto.IsKeepAlive(buffer[:count]) {
+			queue.Push(xproto.KeepAlivePacket)
+			continue
+		}
 		b := buffer[:count]
 		if config.Compress {
 			b, err = snappy.Decode(nil, b)
@@ -128,7 +161,10 @@ func toServer(config config.Config, conn *dtls.Conn, iFace *water.Interface) {
 			b = cipher.XOR(b)
 		}
 		if key := netutil.GetSrcKey(b); key != "" {
-			cache.GetCache().Set(key, conn, 24*time.Hour)
+			if !peer.Route(key) {
+				netutil.PrintErrF(config.Verbose, "%v is owned by another client, dropped\n", key)
+				continue
+			}
 			n, err = iFace.Write(b)
 			if err != nil {
 				netutil.PrintErr(err, config.Verbose)
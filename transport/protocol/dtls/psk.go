@@ -0,0 +1,43 @@
+package dtls
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// DefaultPSKIdentity is the psk identity of clients without one
+const DefaultPSKIdentity = "vtun"
+
+// ErrUnknownIdentity is returned by the server for identities missing from psk_identities
+var ErrUnknownIdentity = errors.New("unknown psk identity")
+
+// pskIdentity returns the psk identity of the client
+func pskIdentity(config config.Config) string {
+	if config.PSKIdentity == "" {
+		return DefaultPSKIdentity
+	}
+	return config.PSKIdentity
+}
+
+// lookupPSK returns the psk of the identity from psk_identities, or derives it from the key,
+// the server only accepts the listed identities when psk_identities is set
+func lookupPSK(config config.Config, identity string) ([]byte, error) {
+	if psk, ok := config.PSKIdentities[identity]; ok {
+		return []byte(psk), nil
+	}
+	if config.ServerMode && len(config.PSKIdentities) > 0 {
+		return nil, ErrUnknownIdentity
+	}
+	return DerivePSK(config.Key, identity), nil
+}
+
+// DerivePSK derives the psk of an identity from the key
+func DerivePSK(key string, identity string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("vtun dtls psk"))
+	mac.Write([]byte(identity))
+	return mac.Sum(nil)
+}
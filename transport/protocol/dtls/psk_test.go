@@ -0,0 +1,51 @@
+package dtls
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+func TestDerivePSK(t *testing.T) {
+	a := DerivePSK("secret", "alice")
+	if len(a) != 32 || !bytes.Equal(a, DerivePSK("secret", "alice")) {
+		t.Error("the psk should be a deterministic sha256 hmac of the key and identity")
+	}
+	if bytes.Equal(a, DerivePSK("secret", "bob")) || bytes.Equal(a, DerivePSK("other", "alice")) {
+		t.Error("the psk should differ between identities and keys")
+	}
+}
+
+func TestLookupPSK(t *testing.T) {
+	identities := map[string]string{"alice": "alice-psk", "bob": "bob-psk"}
+	for _, tt := range []struct {
+		name     string
+		config   config.Config
+		identity string
+		want     []byte
+		err      error
+	}{
+		{"derived on the client", config.Config{Key: "secret"}, "alice", DerivePSK("secret", "alice"), nil},
+		{"derived on the server", config.Config{Key: "secret", ServerMode: true}, "alice", DerivePSK("secret", "alice"), nil},
+		{"default identity", config.Config{Key: "secret"}, pskIdentity(config.Config{}), DerivePSK("secret", DefaultPSKIdentity), nil},
+		{"listed on the client", config.Config{Key: "secret", PSKIdentities: identities}, "alice", []byte("alice-psk"), nil},
+		{"listed on the server", config.Config{Key: "secret", ServerMode: true, PSKIdentities: identities}, "bob", []byte("bob-psk"), nil},
+		{"unlisted on the client", config.Config{Key: "secret", PSKIdentities: identities}, "carol", DerivePSK("secret", "carol"), nil},
+		{"unknown on the server", config.Config{Key: "secret", ServerMode: true, PSKIdentities: identities}, "carol", nil, ErrUnknownIdentity},
+	} {
+		got, err := lookupPSK(tt.config, tt.identity)
+		if err != tt.err || !bytes.Equal(got, tt.want) {
+			t.Errorf("%v: got %x %v, want %x %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestPSKIdentity(t *testing.T) {
+	if got := pskIdentity(config.Config{}); got != DefaultPSKIdentity {
+		t.Errorf("a client without an identity should use %v, got %v", DefaultPSKIdentity, got)
+	}
+	if got := pskIdentity(config.Config{PSKIdentity: "alice"}); got != "alice" {
+		t.Errorf("the configured identity should be used, got %v", got)
+	}
+}
@@ -0,0 +1,175 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/water"
+)
+
+// tun stands in for the tun device, the packets written to it are received on out
+type tun struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func (t *tun) Read(b []byte) (int, error) {
+	p, ok := <-t.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, p), nil
+}
+
+func (t *tun) Write(b []byte) (int, error) {
+	t.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (t *tun) Close() error {
+	close(t.in)
+	return nil
+}
+
+// packet returns an ipv4 packet from src to dst
+func packet(src, dst net.IP) []byte {
+	b := make([]byte, 64)
+	b[0] = 0x45
+	b[9] = 17
+	copy(b[12:16], src.To4())
+	copy(b[16:20], dst.To4())
+	return b
+}
+
+// serve serves the tunnel service of the config on a buffer listener, over h2c in the h2c mode
+func serve(t *testing.T, cfg config.Config) (*bufconn.Listener, *tun) {
+	tun := &tun{in: make(chan []byte, 16), out: make(chan []byte, 16)}
+	iface := &water.Interface{ReadWriteCloser: tun}
+	lis := bufconn.Listen(1 << 20)
+	if cfg.GrpcH2C {
+		srv := &http.Server{Handler: newHandler(cfg, newGrpcServer(cfg, iface))}
+		go srv.Serve(lis)
+		t.Cleanup(func() { srv.Close() })
+	} else {
+		cert, err := tls.LoadX509KeyPair("../../../certs/server.pem", "../../../certs/server.key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		grpcServer := newGrpcServer(cfg, iface, grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+		go grpcServer.Serve(lis)
+		t.Cleanup(grpcServer.Stop)
+	}
+	go toClient(cfg, iface)
+	t.Cleanup(func() { tun.Close() })
+	return lis, tun
+}
+
+// dial dials the buffer listener as the client of the config does
+func dial(t *testing.T, cfg config.Config, lis *bufconn.Listener) *grpc.ClientConn {
+	creds := credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	if cfg.GrpcH2C {
+		creds = insecure.NewCredentials()
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+	}
+	if cfg.Key != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{config: cfg}))
+	}
+	conn, err := grpc.Dial("bufnet", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestTunnel(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		h2c    bool
+		client net.IP
+	}{
+		{"tls", false, net.IPv4(172, 16, 47, 10)},
+		{"h2c", true, net.IPv4(172, 16, 47, 11)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Config{
+				Key:         "secret",
+				BufferSize:  65535,
+				GrpcService: "vtun.Custom",
+				GrpcMethod:  "Pipe",
+				GrpcH2C:     tt.h2c,
+			}
+			lis, tun := serve(t, cfg)
+			gateway := net.IPv4(172, 16, 47, 1)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			tunnels, err := openTunnels(cfg, dial(t, cfg, lis), ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			up := packet(tt.client, gateway)
+			if err := tunnels[0].send(up); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case got := <-tun.out:
+				if !bytes.Equal(got, up) {
+					t.Fatal("the packet should reach the server tun as sent")
+				}
+			case <-ctx.Done():
+				t.Fatal("the packet should reach the server tun")
+			}
+			down := packet(gateway, tt.client)
+			tun.in <- down
+			m, err := tunnels[0].Recv()
+			if err != nil || len(packets(m)) != 1 || !bytes.Equal(packets(m)[0], down) {
+				t.Fatalf("the packet should reach the client: %v", err)
+			}
+		})
+	}
+}
+
+func TestTunnelRejected(t *testing.T) {
+	cfg := config.Config{Key: "secret", BufferSize: 65535, GrpcService: "vtun.Custom", GrpcMethod: "Pipe", GrpcH2C: true}
+	lis, _ := serve(t, cfg)
+	for _, tt := range []struct {
+		name string
+		cfg  config.Config
+		code codes.Code
+	}{
+		{"token of another key", config.Config{Key: "other", GrpcService: "vtun.Custom", GrpcMethod: "Pipe", GrpcH2C: true}, codes.Unauthenticated},
+		{"no token", config.Config{GrpcService: "vtun.Custom", GrpcMethod: "Pipe", GrpcH2C: true}, codes.Unauthenticated},
+		{"default names", config.Config{Key: "secret", GrpcH2C: true}, codes.Unimplemented},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		tunnels, err := openTunnels(tt.cfg, dial(t, tt.cfg, lis), ctx)
+		if err == nil {
+			// the stream is rejected by its first answer
+			_, err = tunnels[0].Recv()
+		}
+		cancel()
+		if status.Code(err) != tt.code {
+			t.Errorf("%v: the stream should be rejected with %v, got %v", tt.name, tt.code, err)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"crypto/tls"
 	"log"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/net-byte/vtun/transport/protocol/grpc/proto"
@@ -11,111 +13,210 @@ import (
 	"github.com/golang/snappy"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/net-byte/vtun/common/cache"
 	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xchan"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xproxy"
+	"github.com/net-byte/vtun/common/x/xretry"
+	"github.com/net-byte/vtun/common/x/xtls"
+	"github.com/net-byte/vtun/common/x/xtun"
 	"github.com/net-byte/water"
 )
 
+// SessionMetadata is the metadata key carrying the session id shared by the streams of a client
+const SessionMetadata = "vtun-session"
+
+// tunnel is a client stream, grpc streams don't support concurrent sends
+type tunnel struct {
+	proto.GrpcServe_TunnelClient
+	mx sync.Mutex
+}
+
+// send sends the packets in one message, no packet is a keepalive
+func (t *tunnel) send(batch ...[]byte) error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.Send(newPacketData(batch))
+}
+
 // StartClient starts the grpc client
 func StartClient(iface *water.Interface, config config.Config) {
 	log.Println("vtun grpc client started")
-	go tunToGrpc(config, iface)
+	outputStream := make(chan []byte, 1000)
+	go xtun.ReadFromTun(iface, config, outputStream, context.Background())
+	go tunToGrpc(config, outputStream)
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: config.TLSInsecureSkipVerify,
 	}
 	if config.TLSSni != "" {
 		tlsConfig.ServerName = config.TLSSni
 	}
+	if err := xtls.ClientCertificate(tlsConfig, config); err != nil {
+		log.Fatalln(err)
+	}
+	if err := xtls.VerifyServer(tlsConfig, config); err != nil {
+		log.Fatalln(err)
+	}
 
 	creds := credentials.NewTLS(tlsConfig)
+	if config.GrpcH2C {
+		creds = insecure.NewCredentials()
+	}
 
 	var heartbeat = keepalive.ClientParameters{
-		Time:                10 * time.Second, // send pings every 10 seconds if there is no activity
-		Timeout:             10 * time.Second, // wait 10 second for ping ack before considering the connection dead
-		PermitWithoutStream: true,             // send pings even without active streams
+		Time:                xalive.Interval(config), // send pings every interval if there is no activity
+		Timeout:             xalive.Timeout(config),  // wait for ping ack before considering the connection dead
+		PermitWithoutStream: true,                    // send pings even without active streams
+	}
+	opts := []grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithKeepaliveParams(heartbeat),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return xproxy.DialContext(ctx, config, addr)
+		}),
 	}
+	if config.Key != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{config: config}))
+	}
+	policy := xretry.NewPolicy(config)
 	for {
-		conn, err := grpc.Dial(config.ServerAddr,
-			grpc.WithBlock(),
-			grpc.WithTransportCredentials(creds),
-			grpc.WithKeepaliveParams(heartbeat),
-		)
+		policy.Connecting()
+		conn, err := grpc.Dial(config.ServerAddr, opts...)
 		if err != nil {
-			time.Sleep(3 * time.Second)
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(context.Background())
 			continue
 		}
-		streamClient := proto.NewGrpcServeClient(conn)
-		stream, err := streamClient.Tunnel(context.Background())
+		policy.Handshaking()
+		// the streams of a connection share a session so the server groups them
+		ctx, cancel := context.WithCancel(context.Background())
+		ctx = metadata.AppendToOutgoingContext(ctx, SessionMetadata, xproto.GenSessionID().String())
+		tunnels, err := openTunnels(config, conn, ctx)
 		if err != nil {
+			cancel()
 			conn.Close()
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(context.Background())
 			continue
 		}
-		cache.GetCache().Set("grpcconn", stream, 24*time.Hour)
-		grpcToTun(config, stream, iface)
+		cache.GetCache().Set("grpcconn", tunnels, 24*time.Hour)
+		policy.Connected()
+		var wg sync.WaitGroup
+		for _, t := range tunnels {
+			wg.Add(1)
+			go func(t *tunnel) {
+				defer wg.Done()
+				go keepAlive(config, t, ctx)
+				grpcToTun(config, t, iface, cancel)
+				// one broken stream takes the whole connection down
+				cancel()
+			}(t)
+		}
+		wg.Wait()
 		cache.GetCache().Delete("grpcconn")
 		conn.Close()
+		policy.Disconnected(context.Background())
 	}
 }
 
-// tunToGrpc sends packets from tun to grpc
-func tunToGrpc(config config.Config, iface *water.Interface) {
-	packet := make([]byte, config.BufferSize)
-	for {
-		n, err := iface.Read(packet)
+// openTunnels opens the streams of a session on the connection
+func openTunnels(config config.Config, conn *grpc.ClientConn, ctx context.Context) ([]*tunnel, error) {
+	var tunnels []*tunnel
+	for i := 0; i < config.Streams || i == 0; i++ {
+		stream, err := newTunnelStream(ctx, config, conn)
 		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
+			return nil, err
+		}
+		tunnels = append(tunnels, &tunnel{GrpcServe_TunnelClient: stream})
+	}
+	return tunnels, nil
+}
+
+// tunToGrpc sends packets from tun to grpc, in the batch mode the packets of a stream are coalesced into one message
+func tunToGrpc(config config.Config, outputStream <-chan []byte) {
+	for b := range outputStream {
+		batch := [][]byte{b}
+		if config.BatchSize > 0 {
+			batch = xchan.Collect(outputStream, b, config.BatchSize, xchan.BatchDelay(config))
 		}
-		if v, ok := cache.GetCache().Get("grpcconn"); ok {
-			b := packet[:n]
+		v, ok := cache.GetCache().Get("grpcconn")
+		if !ok {
+			continue
+		}
+		tunnels := v.([]*tunnel)
+		// the packets of a flow stay on one stream
+		streams := make([][][]byte, len(tunnels))
+		sizes := make([]int, len(tunnels))
+		for _, b := range batch {
+			i := netutil.FlowHash(b) % uint32(len(tunnels))
+			sizes[i] += len(b)
 			if config.Obfs {
 				b = cipher.XOR(b)
 			}
 			if config.Compress {
 				b = snappy.Encode(nil, b)
 			}
-			grpcconn := v.(proto.GrpcServe_TunnelClient)
-			err = grpcconn.Send(&proto.PacketData{Data: b})
-			if err != nil {
+			streams[i] = append(streams[i], b)
+		}
+		for i, packets := range streams {
+			if len(packets) == 0 {
+				continue
+			}
+			if err := tunnels[i].send(packets...); err != nil {
 				netutil.PrintErr(err, config.Verbose)
 				continue
 			}
-			counter.IncrWrittenBytes(n)
+			counter.IncrWrittenBytes(sizes[i])
 		}
 	}
 }
 
+// keepAlive sends empty packets to the server until the context is done
+func keepAlive(config config.Config, t *tunnel, _ctx context.Context) {
+	xalive.Run(_ctx, config, func() error {
+		return t.send()
+	})
+}
+
 // grpcToTun sends packets from grpc to tun
-func grpcToTun(config config.Config, stream proto.GrpcServe_TunnelClient, iface *water.Interface) {
+func grpcToTun(config config.Config, stream *tunnel, iface *water.Interface, cancel context.CancelFunc) {
+	watchdog := xalive.NewWatchdog(xalive.Timeout(config), cancel)
+	defer watchdog.Stop()
 	for {
 		packet, err := stream.Recv()
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
 			break
 		}
-		b := packet.Data[:]
-		if config.Compress {
-			b, err = snappy.Decode(nil, b)
+		watchdog.Touch()
+		// an empty message is a keepalive
+		for _, b := range packets(packet) {
+			if config.Compress {
+				b, err = snappy.Decode(nil, b)
+				if err != nil {
+					netutil.PrintErr(err, config.Verbose)
+					return
+				}
+			}
+			if config.Obfs {
+				b = cipher.XOR(b)
+			}
+			_, err = iface.Write(b)
 			if err != nil {
 				netutil.PrintErr(err, config.Verbose)
-				break
+				return
 			}
+			counter.IncrReadBytes(len(b))
 		}
-		if config.Obfs {
-			b = cipher.XOR(b)
-		}
-		_, err = iface.Write(b)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		counter.IncrReadBytes(len(b))
 	}
 }
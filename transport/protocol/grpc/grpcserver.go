@@ -1,21 +1,32 @@
 package grpc
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"github.com/net-byte/vtun/transport/protocol/grpc/proto"
 	"log"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/golang/snappy"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 
 	"github.com/net-byte/vtun/common/cache"
 	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xchan"
+	"github.com/net-byte/vtun/common/x/xfallback"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/water"
 )
 
@@ -28,38 +39,116 @@ type StreamService struct {
 
 // Tunnel implements the StreamServer interface
 func (s *StreamService) Tunnel(srv proto.GrpcServe_TunnelServer) error {
-	toServer(srv, s.config, s.iface)
+	if err := authorize(srv.Context(), s.config); err != nil {
+		netutil.PrintErrF(s.config.Verbose, "grpc stream rejected: %v\n", err)
+		return err
+	}
+	ctx, cancel := context.WithCancel(srv.Context())
+	defer cancel()
+	watchdog := xalive.NewWatchdog(xalive.Timeout(s.config), cancel)
+	defer watchdog.Stop()
+	queue := xchan.NewBatchQueue(s.config.SendQueueSize, xchan.ParseDropPolicy(s.config.DropPolicy), s.config.BatchSize, xchan.BatchDelay(s.config), func(batch [][]byte) error {
+		err := srv.Send(newPacketData(batch))
+		if err != nil {
+			netutil.PrintErr(err, s.config.Verbose)
+			cancel()
+			return err
+		}
+		for _, b := range batch {
+			counter.IncrWrittenBytes(len(b))
+		}
+		return nil
+	})
+	defer queue.Close()
+	session := fmt.Sprintf("%p", srv)
+	if md, ok := metadata.FromIncomingContext(srv.Context()); ok && len(md.Get(SessionMetadata)) > 0 {
+		session = md.Get(SessionMetadata)[0]
+	}
+	identity := ""
+	if p, ok := peer.FromContext(srv.Context()); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			identity = xtls.StateIdentity(&info.State)
+		}
+	}
+	// a client can only join the sessions of its own identity
+	session = identity + "/" + session
+	group := cache.JoinGroup(session, queue)
+	defer cache.LeaveGroup(session, queue)
+	group.SetIdentity(identity)
+	go func() {
+		toServer(srv, s.config, s.iface, queue, group, watchdog)
+		cancel()
+	}()
+	// returning ends the stream and unblocks the pending Recv
+	<-ctx.Done()
 	return nil
 }
 
 // GetHTTPServeMux common HTTP Server
-func GetHTTPServeMux() *http.ServeMux {
+func GetHTTPServeMux(config config.Config) *http.ServeMux {
 	mux := http.NewServeMux()
+	if xfallback.Enabled(config) {
+		mux.Handle("/", xfallback.Handler(config))
+		return mux
+	}
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("follow"))
 	})
 	return mux
 }
 
-// StartServer starts the grpc server
-func StartServer(iface *water.Interface, config config.Config) {
-	log.Printf("vtun grpc server started on %v", config.LocalAddr)
-	creds, err := credentials.NewServerTLSFromFile(config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
-	if err != nil {
-		log.Panic(err)
-	}
-	mux := GetHTTPServeMux()
-	grpcServer := grpc.NewServer(grpc.Creds(creds))
-	proto.RegisterGrpcServeServer(grpcServer, &StreamService{config: config, iface: iface})
-	go toClient(config, iface)
-	err = http.ListenAndServeTLS(config.LocalAddr, config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// newGrpcServer returns the grpc server of the tunnel service registered under the configured names
+func newGrpcServer(config config.Config, iface *water.Interface, opts ...grpc.ServerOption) *grpc.Server {
+	grpcServer := grpc.NewServer(opts...)
+	grpcServer.RegisterService(serviceDesc(config), &StreamService{config: config, iface: iface})
+	return grpcServer
+}
+
+// newHandler returns the handler of the grpc requests and the other ones, over h2c in the h2c mode
+func newHandler(config config.Config, grpcServer *grpc.Server) http.Handler {
+	mux := GetHTTPServeMux(config)
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.ProtoMajor == 2 && strings.Contains(r.Header.Get("Content-Type"), "application/grpc") {
 			grpcServer.ServeHTTP(w, r)
 		} else {
 			mux.ServeHTTP(w, r)
 		}
-		return
-	}))
+	})
+	if config.GrpcH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	return handler
+}
+
+// StartServer starts the grpc server, in the h2c mode it serves plaintext behind a tls terminating proxy
+func StartServer(iface *water.Interface, config config.Config) {
+	log.Printf("vtun grpc server started on %v", config.LocalAddr)
+	var opts []grpc.ServerOption
+	tlsConfig := &tls.Config{}
+	if !config.GrpcH2C {
+		err := xtls.ServerCertificate(tlsConfig, config)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = xtls.VerifyClients(tlsConfig, config)
+		if err != nil {
+			log.Panic(err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := newGrpcServer(config, iface, opts...)
+	go toClient(config, iface)
+	srv := &http.Server{
+		Addr:      config.LocalAddr,
+		TLSConfig: tlsConfig,
+		Handler:   newHandler(config, grpcServer),
+	}
+	var err error
+	if config.GrpcH2C {
+		err = srv.ListenAndServe()
+	} else {
+		err = srv.ListenAndServeTLS("", "")
+	}
 	if err != nil {
 		log.Fatalf("grpc server error: %v", err)
 	}
@@ -76,6 +165,7 @@ func toClient(config config.Config, iface *water.Interface) {
 		}
 		b := packet[:n]
 		if key := netutil.GetDstKey(b); key != "" {
+			hash := netutil.FlowHash(b)
 			if v, ok := cache.GetCache().Get(key); ok {
 				if config.Obfs {
 					b = cipher.XOR(b)
@@ -83,40 +173,46 @@ func toClient(config config.Config, iface *water.Interface) {
 				if config.Compress {
 					b = snappy.Encode(nil, b)
 				}
-				err := v.(proto.GrpcServe_TunnelServer).Send(&proto.PacketData{Data: b})
-				if err != nil {
-					cache.GetCache().Delete(key)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
+				v.(*cache.Group).Push(hash, xproto.Copy(b))
 			}
 		}
 	}
 }
 
 // toServer sends packets from grpc to tun
-func toServer(srv proto.GrpcServe_TunnelServer, config config.Config, iface *water.Interface) {
+func toServer(srv proto.GrpcServe_TunnelServer, config config.Config, iface *water.Interface, queue *xchan.SendQueue, group *cache.Group, watchdog *xalive.Watchdog) {
 	for {
 		packet, err := srv.Recv()
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
 			break
 		}
-		b := packet.Data[:]
-		if config.Compress {
-			b, err = snappy.Decode(nil, b)
-			if err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				break
-			}
-		}
-		if config.Obfs {
-			b = cipher.XOR(b)
+		watchdog.Touch()
+		batch := packets(packet)
+		if len(batch) == 0 {
+			// keepalive
+			queue.Push(nil)
+			continue
 		}
-		if key := netutil.GetSrcKey(b); key != "" {
-			cache.GetCache().Set(key, srv, 24*time.Hour)
-			iface.Write(b)
-			counter.IncrReadBytes(len(b))
+		for _, b := range batch {
+			if config.Compress {
+				b, err = snappy.Decode(nil, b)
+				if err != nil {
+					netutil.PrintErr(err, config.Verbose)
+					return
+				}
+			}
+			if config.Obfs {
+				b = cipher.XOR(b)
+			}
+			if key := netutil.GetSrcKey(b); key != "" {
+				if !group.Route(key) {
+					netutil.PrintErrF(config.Verbose, "%v is owned by another client, dropped\n", key)
+					continue
+				}
+				iface.Write(b)
+				counter.IncrReadBytes(len(b))
+			}
 		}
 	}
 }
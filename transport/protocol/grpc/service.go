@@ -0,0 +1,150 @@
+package grpc
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xauth"
+	"github.com/net-byte/vtun/transport/protocol/grpc/proto"
+)
+
+// AuthMetadata is the metadata key carrying the auth token
+const AuthMetadata = "authorization"
+
+// serviceName returns the configured service name, the generated one by default
+func serviceName(config config.Config) string {
+	if config.GrpcService == "" {
+		return proto.GrpcServe_ServiceDesc.ServiceName
+	}
+	return config.GrpcService
+}
+
+// methodName returns the configured method name, the generated one by default
+func methodName(config config.Config) string {
+	if config.GrpcMethod == "" {
+		return proto.GrpcServe_ServiceDesc.Streams[0].StreamName
+	}
+	return config.GrpcMethod
+}
+
+// serviceDesc returns the tunnel service registered under the configured names
+func serviceDesc(config config.Config) *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: serviceName(config),
+		HandlerType: (*proto.GrpcServeServer)(nil),
+		Methods:     []grpc.MethodDesc{},
+		Streams: []grpc.StreamDesc{
+			{
+				StreamName: methodName(config),
+				Handler: func(srv interface{}, stream grpc.ServerStream) error {
+					return srv.(proto.GrpcServeServer).Tunnel(&serverStream{stream})
+				},
+				ServerStreams: true,
+				ClientStreams: true,
+			},
+		},
+		Metadata: proto.GrpcServe_ServiceDesc.Metadata,
+	}
+}
+
+// newTunnelStream opens a tunnel stream by the configured names
+func newTunnelStream(ctx context.Context, config config.Config, conn *grpc.ClientConn) (proto.GrpcServe_TunnelClient, error) {
+	desc := serviceDesc(config)
+	stream, err := conn.NewStream(ctx, &desc.Streams[0], "/"+desc.ServiceName+"/"+desc.Streams[0].StreamName)
+	if err != nil {
+		return nil, err
+	}
+	return &clientStream{stream}, nil
+}
+
+// clientStream is the client side of a tunnel stream
+type clientStream struct {
+	grpc.ClientStream
+}
+
+func (x *clientStream) Send(m *proto.PacketData) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *clientStream) Recv() (*proto.PacketData, error) {
+	m := new(proto.PacketData)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// serverStream is the server side of a tunnel stream
+type serverStream struct {
+	grpc.ServerStream
+}
+
+func (x *serverStream) Send(m *proto.PacketData) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *serverStream) Recv() (*proto.PacketData, error) {
+	m := new(proto.PacketData)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// newPacketData returns the message carrying the packets, a single packet goes in the data field
+// so the peers without batching read it, and no packet is a keepalive
+func newPacketData(batch [][]byte) *proto.PacketData {
+	var packets [][]byte
+	for _, b := range batch {
+		if len(b) > 0 {
+			packets = append(packets, b)
+		}
+	}
+	if len(packets) == 1 {
+		return &proto.PacketData{Data: packets[0]}
+	}
+	return &proto.PacketData{Batch: packets}
+}
+
+// packets returns the packets of the message, there is none in a keepalive
+func packets(m *proto.PacketData) [][]byte {
+	if len(m.Data) > 0 {
+		return append([][]byte{m.Data}, m.Batch...)
+	}
+	return m.Batch
+}
+
+// tokenCredentials attaches a fresh auth token of the key to every stream
+type tokenCredentials struct {
+	config config.Config
+}
+
+func (c tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{AuthMetadata: xauth.BearerPrefix + xauth.Token(c.config.Key, time.Now())}, nil
+}
+
+// RequireTransportSecurity allows the token over h2c, the tls is terminated by the proxy in front of the server
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return !c.config.GrpcH2C
+}
+
+// authorize checks the auth token of the stream, any stream is accepted without a key
+func authorize(ctx context.Context, config config.Config) error {
+	if config.Key == "" {
+		return nil
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, value := range md.Get(AuthMetadata) {
+			if xauth.Verify(config.Key, value, xauth.TTL(config)) {
+				return nil
+			}
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid auth token")
+}
@@ -10,6 +10,8 @@ import (
 type Conn struct {
 	R io.ReadCloser
 	W net.Conn //io.WriteCloser
+	// Identity is the verified client identity of both halves of a server side conn
+	Identity string
 }
 
 func (c Conn) Read(data []byte) (n int, err error)  { return c.R.Read(data) }
@@ -44,6 +46,11 @@ func (c Conn) RemoteAddr() net.Addr {
 }
 
 func (c Conn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.R.(interface {
+		SetReadDeadline(t time.Time) error
+	}); ok {
+		return d.SetReadDeadline(t)
+	}
 	return nil
 }
 
@@ -70,7 +77,16 @@ func (c CloseableReader) Close() error {
 	return c.r0.Close()
 }
 
-func mkConn(p1 net.Conn, p2 net.Conn, rBuf []byte) net.Conn {
+func (c CloseableReader) SetReadDeadline(t time.Time) error {
+	if d, ok := c.r0.(interface {
+		SetReadDeadline(t time.Time) error
+	}); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func mkConn(p1 net.Conn, p2 net.Conn, rBuf []byte) Conn {
 	rem := bytes.NewReader(rBuf)
 	r := io.MultiReader(rem, p1)
 	rc := CloseableReader{r, p1}
@@ -23,4 +23,9 @@ const (
 	timeout    = 10 * time.Second
 	tokenTTL   = 20 * time.Second
 	tokenClean = 10 * time.Second
+
+	pollWait  = 5 * time.Second
+	pollBatch = 256 * 1024
+	// pollBuffer is the max bytes written to a poll conn and not yet pulled, the writes block past it
+	pollBuffer = 4 * pollBatch
 )
@@ -0,0 +1,62 @@
+package h1
+
+import (
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// The candidates of the disguise parameters picked by the key
+var (
+	txMethods     = []string{"POST", "PUT", "PATCH"}
+	rxMethods     = []string{"GET", "POST"}
+	serverHeaders = []string{"nginx", "Apache", "openresty", "cloudflare", "LiteSpeed", "Microsoft-IIS/10.0", "Caddy"}
+)
+
+// pick picks an item of the list by the key and nonce
+func pick(list []string, key string, nonce int64) string {
+	return list[String2Int64(key)*nonce%int64(len(list))]
+}
+
+// disguise returns the h1 disguise parameters, the empty ones are derived from the key
+// so client and server agree on them while every deployment looks different
+func disguise(config config.Config) config.H1Config {
+	h := config.H1
+	if h.TxMethod == "" {
+		h.TxMethod = pick(txMethods, config.Key, 1013)
+	}
+	if h.RxMethod == "" {
+		h.RxMethod = pick(rxMethods, config.Key, 1019)
+	}
+	if h.TxFlag == "" {
+		h.TxFlag = RandomStringByStringNonce(24, config.Key, 1021)
+	}
+	if h.RxFlag == "" {
+		h.RxFlag = RandomStringByStringNonce(28, config.Key, 1031)
+	}
+	if h.TokenCookieA == "" {
+		h.TokenCookieA = RandomStringByStringNonce(16, config.Key, 123)
+	}
+	if h.TokenCookieB == "" {
+		h.TokenCookieB = RandomStringByStringNonce(32, config.Key, 456)
+	}
+	if h.TokenCookieC == "" {
+		h.TokenCookieC = RandomStringByStringNonce(64, config.Key, 789)
+	}
+	if h.UserAgent == "" {
+		h.UserAgent = RandomUserAgent(config.Key)
+	}
+	if h.ServerHeader == "" {
+		h.ServerHeader = pick(serverHeaders, config.Key, 1033)
+	}
+	if h.Path == "" {
+		h.Path = "/" + RandomStringByInt64(32, time.Now().UnixMilli())
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = int(timeout / time.Second)
+	}
+	if h.TokenTTL <= 0 {
+		h.TokenTTL = int(tokenTTL / time.Second)
+	}
+	return h
+}
@@ -0,0 +1,58 @@
+package h1
+
+import (
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// shared returns the parameters both sides must agree on, the path is random per client unless it is set
+func shared(h config.H1Config) config.H1Config {
+	h.Path = ""
+	return h
+}
+
+func TestDisguise(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		a, b  config.Config
+		equal bool
+	}{
+		{"same key", config.Config{Key: "secret"}, config.Config{Key: "secret"}, true},
+		{"different keys", config.Config{Key: "secret"}, config.Config{Key: "other"}, false},
+		{"same key and overrides", config.Config{Key: "secret", H1: config.H1Config{TxFlag: "tx"}}, config.Config{Key: "secret", H1: config.H1Config{TxFlag: "tx"}}, true},
+	} {
+		a, b := shared(disguise(tt.a)), shared(disguise(tt.b))
+		if (a == b) != tt.equal {
+			t.Errorf("%v: equal should be %v, got %+v and %+v", tt.name, tt.equal, a, b)
+		}
+		if !tt.equal && (a.TxFlag == b.TxFlag || a.RxFlag == b.RxFlag || a.TokenCookieA == b.TokenCookieA) {
+			t.Errorf("%v: the flags and cookies should differ, got %+v and %+v", tt.name, a, b)
+		}
+	}
+}
+
+func TestDisguiseOverrides(t *testing.T) {
+	h := config.H1Config{
+		TxMethod:     "PUT",
+		RxMethod:     "GET",
+		TxFlag:       "tx",
+		RxFlag:       "rx",
+		TokenCookieA: "a",
+		TokenCookieB: "b",
+		TokenCookieC: "c",
+		UserAgent:    "ua",
+		ServerHeader: "server",
+		Path:         "/path",
+		Timeout:      3,
+		TokenTTL:     7,
+	}
+	for _, key := range []string{"secret", "other"} {
+		if got := disguise(config.Config{Key: key, H1: h}); got != h {
+			t.Errorf("the explicit parameters should override the ones of key %q, got %+v", key, got)
+		}
+	}
+	if got := disguise(config.Config{Key: "secret", H1: config.H1Config{TxFlag: "tx"}}); got.TxFlag != "tx" || got.RxFlag == "" {
+		t.Errorf("a single override should keep the other parameters derived, got %+v", got)
+	}
+}
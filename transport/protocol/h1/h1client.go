@@ -3,9 +3,12 @@ package h1
 import (
 	"context"
 	"github.com/net-byte/vtun/common/counter"
+	"github.com/net-byte/vtun/common/x/xretry"
 	"github.com/net-byte/vtun/common/x/xtun"
 	"github.com/net-byte/vtun/transport/protocol/tcp"
 	"log"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/net-byte/vtun/common/cache"
@@ -19,36 +22,53 @@ var cancel context.CancelFunc
 
 func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), _ctx context.Context) {
 	var cl *Client
-	tcA := RandomStringByStringNonce(16, config.Key, 123)
-	tcB := RandomStringByStringNonce(32, config.Key, 456)
-	tcC := RandomStringByStringNonce(64, config.Key, 789)
-	ua := RandomUserAgent(config.Key)
-	if config.Protocol == "https" {
-		cl = NewTLSClient(config)
+	if strings.HasPrefix(config.Protocol, "https") {
+		var err error
+		if cl, err = NewTLSClient(config); err != nil {
+			log.Fatalln(err)
+		}
 	} else {
-		cl = NewClient(config.ServerAddr, config.Host)
+		cl = NewHTTPClient(config)
 	}
-	cl.TokenCookieA = tcA
-	cl.TokenCookieB = tcB
-	cl.TokenCookieC = tcC
-	cl.Path = "/" + RandomStringByInt64(32, time.Now().UnixMilli())
-	cl.UserAgent = ua
+	d := disguise(config)
+	cl.TxMethod = d.TxMethod
+	cl.RxMethod = d.RxMethod
+	cl.TxFlag = d.TxFlag
+	cl.RxFlag = d.RxFlag
+	cl.TokenCookieA = d.TokenCookieA
+	cl.TokenCookieB = d.TokenCookieB
+	cl.TokenCookieC = d.TokenCookieC
+	cl.Path = d.Path
+	cl.UserAgent = d.UserAgent
+	cl.Timeout = time.Duration(d.Timeout) * time.Second
 	go tcp.Tun2Conn(config, outputStream, _ctx, readCallback)
+	policy := xretry.NewPolicy(config)
 	for xtun.ContextOpened(_ctx) {
-		conn, err := cl.Dial()
+		policy.Connecting()
+		var conn net.Conn
+		var err error
+		if strings.HasSuffix(config.Protocol, "-poll") {
+			conn, err = cl.DialPoll()
+		} else {
+			conn, err = cl.Dial()
+		}
 		if err != nil {
-			time.Sleep(3 * time.Second)
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
+		policy.Handshaking()
 		err = tcp.Handshake(config, conn)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
 		cache.GetCache().Set(tcp.ConnTag, conn, 24*time.Hour)
+		policy.Connected()
 		tcp.Conn2Tun(config, conn, inputStream, _ctx, writeCallback)
 		cache.GetCache().Delete(tcp.ConnTag)
+		policy.Disconnected(_ctx)
 	}
 }
 
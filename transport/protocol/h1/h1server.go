@@ -3,25 +3,38 @@ package h1
 import (
 	"crypto/tls"
 	"github.com/net-byte/vtun/common/config"
-	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xfallback"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/vtun/transport/protocol/tcp"
 	"github.com/net-byte/water"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // StartServer starts the h1 server
 func StartServer(iFace *water.Interface, config config.Config) {
 	log.Printf("vtun h1 server started on %v", config.LocalAddr)
-	webSrv := NewHandle(netutil.GetDefaultHttpHandleFunc())
-	webSrv.TokenCookieA = RandomStringByStringNonce(16, config.Key, 123)
-	webSrv.TokenCookieB = RandomStringByStringNonce(32, config.Key, 456)
-	webSrv.TokenCookieC = RandomStringByStringNonce(64, config.Key, 789)
+	webSrv := NewHandle(xfallback.Handler(config))
+	d := disguise(config)
+	webSrv.TxMethod = d.TxMethod
+	webSrv.RxMethod = d.RxMethod
+	webSrv.TxFlag = d.TxFlag
+	webSrv.RxFlag = d.RxFlag
+	webSrv.TokenCookieA = d.TokenCookieA
+	webSrv.TokenCookieB = d.TokenCookieB
+	webSrv.TokenCookieC = d.TokenCookieC
+	webSrv.HeaderServer = d.ServerHeader
+	webSrv.TokenTTL = time.Duration(d.TokenTTL) * time.Second
+	webSrv.Poll = strings.HasSuffix(config.Protocol, "-poll")
+	// the path is random per client unless it is set, so the server only restricts the tunnel to a set one
+	webSrv.Path = config.H1.Path
 	http.Handle("/", webSrv)
 	srv := &http.Server{Addr: config.LocalAddr, Handler: nil}
 	go func(srv *http.Server) {
 		var err error
-		if config.Protocol == "https" {
+		if strings.HasPrefix(config.Protocol, "https") {
 			tlsConfig := &tls.Config{
 				MinVersion:       tls.VersionTLS13,
 				CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -34,8 +47,16 @@ func StartServer(iFace *water.Interface, config config.Config) {
 					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 				},
 			}
+			err = xtls.ServerCertificate(tlsConfig, config)
+			if err != nil {
+				log.Panic(err)
+			}
+			err = xtls.VerifyClients(tlsConfig, config)
+			if err != nil {
+				log.Panic(err)
+			}
 			srv.TLSConfig = tlsConfig
-			err = srv.ListenAndServeTLS(config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
+			err = srv.ListenAndServeTLS("", "")
 		} else {
 			err = srv.ListenAndServe()
 		}
@@ -51,6 +72,13 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		if err != nil {
 			continue
 		}
-		go tcp.ToServer(config, conn, iFace)
+		identity := ""
+		switch c := conn.(type) {
+		case Conn:
+			identity = c.Identity
+		case *pollConn:
+			identity = c.Identity
+		}
+		go tcp.ToServer(config, conn, iFace, identity)
 	}
 }
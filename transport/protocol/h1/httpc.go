@@ -2,6 +2,7 @@ package h1
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -21,19 +22,33 @@ type NetDialer interface {
 	DialTimeout(host string, timeout time.Duration) (net.Conn, error)
 }
 
-type dialer Client
+type dialer struct {
+	// DialContext dials the server, directly or through the upstream proxy
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	Transport   *http.Transport
+}
 
-func (dl dialer) GetProto() string {
+func newDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *dialer {
+	return &dialer{
+		DialContext: dial,
+		Transport:   &http.Transport{DialContext: dial},
+	}
+}
+
+func (dl *dialer) GetProto() string {
 	return "http://"
 }
-func (dl dialer) Do(req *http.Request, timeout time.Duration) (*http.Response, error) {
+func (dl *dialer) Do(req *http.Request, timeout time.Duration) (*http.Response, error) {
 	client := &http.Client{
-		Timeout: timeout,
+		Timeout:   timeout,
+		Transport: dl.Transport,
 	}
 	return client.Do(req)
 }
-func (dl dialer) DialTimeout(serverAddr string, timeout time.Duration) (net.Conn, error) {
-	return net.DialTimeout("tcp", serverAddr, timeout)
+func (dl *dialer) DialTimeout(serverAddr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return dl.DialContext(ctx, "tcp", serverAddr)
 }
 
 type Client struct {
@@ -111,14 +126,18 @@ func (cl *Client) getTx(token string) (net.Conn, []byte, error) { //io.WriteClos
 	req.Header.Set("Pragma", "no-cache")
 	req.Header.Set("Cache-Control", "private, no-store, no-cache, max-age=0")
 	req.Header.Set("User-Agent", cl.UserAgent)
-	req.Header.Set("Cookie", fmt.Sprintf("Tag=follow; %s=%s; %s=%s", cl.TokenCookieB, token, cl.TokenCookieC, cl.TxFlag))
+	req.Header.Set("Cookie", fmt.Sprintf("%s=%s; %s=%s", cl.TokenCookieB, token, cl.TokenCookieC, cl.TxFlag))
 
 	tx, err := cl.Dialer.DialTimeout(cl.ServerAddr, cl.Timeout)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	req.Write(tx)
+	if dl, ok := cl.Dialer.(*dialerF); ok {
+		tx = dl.upload(req, tx)
+	} else {
+		req.Write(tx)
+	}
 
 	txBuf := bufio.NewReaderSize(tx, 1024)
 	res, err := http.ReadResponse(txBuf, req)
@@ -149,12 +168,16 @@ func (cl *Client) getRx(token string) (net.Conn, []byte, error) { //io.ReadClose
 	req.Header.Set("Pragma", "no-cache")
 	req.Header.Set("Cache-Control", "private, no-store, no-cache, max-age=0")
 	req.Header.Set("User-Agent", cl.UserAgent)
-	req.Header.Set("Cookie", fmt.Sprintf("Tag=follow; %s=%s; %s=%s", cl.TokenCookieB, token, cl.TokenCookieC, cl.RxFlag))
+	req.Header.Set("Cookie", fmt.Sprintf("%s=%s; %s=%s", cl.TokenCookieB, token, cl.TokenCookieC, cl.RxFlag))
 	rx, err := cl.Dialer.DialTimeout(cl.ServerAddr, cl.Timeout)
 	if err != nil {
 		return nil, nil, err
 	}
-	req.Write(rx)
+	if dl, ok := cl.Dialer.(*dialerF); ok {
+		dl.write(req, rx)
+	} else {
+		req.Write(rx)
+	}
 	rxBuf := bufio.NewReaderSize(rx, 1024)
 	res, err := http.ReadResponse(rxBuf, req)
 	if err != nil {
@@ -168,6 +191,10 @@ func (cl *Client) getRx(token string) (net.Conn, []byte, error) { //io.ReadClose
 		return nil, nil, ErrTokenTimeout
 	}
 
+	if _, ok := cl.Dialer.(*dialerF); ok {
+		// the proxy may change the framing of the download, so it is read as the response body
+		return &bodyConn{Conn: rx, body: res.Body}, nil, nil
+	}
 	n := rxBuf.Buffered()
 	if n > 0 {
 		buf := make([]byte, n)
@@ -196,7 +223,7 @@ func NewClient(serverAddr, host string) *Client {
 		Host:         host,
 		ServerAddr:   serverAddr,
 	}
-	cl.Dialer = dialer(*cl)
+	cl.Dialer = newDialer((&net.Dialer{}).DialContext)
 	return cl
 }
 
@@ -0,0 +1,85 @@
+package h1
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// DialPoll returns the conn carried by short request/response exchanges, it works through
+// the proxies buffering the bodies at the cost of latency
+func (cl *Client) DialPoll() (net.Conn, error) {
+	token, err := cl.getToken()
+	if token == "" || err != nil {
+		return nil, err
+	}
+	p := newPollConn(nil, nil)
+	go cl.pollUpload(p, token)
+	go cl.pollDownload(p, token)
+	return p, nil
+}
+
+// pollUpload sends the data written to the conn, the data written while a request is in flight
+// is batched into the next one
+func (cl *Client) pollUpload(p *pollConn, token string) {
+	defer p.Close()
+	for {
+		data := p.pull(pollBatch, -1)
+		if data == nil {
+			return
+		}
+		if _, err := cl.exchange(cl.TxMethod, cl.TxFlag, token, data); err != nil {
+			return
+		}
+	}
+}
+
+// pollDownload polls the server for the data to the client
+func (cl *Client) pollDownload(p *pollConn, token string) {
+	defer p.Close()
+	for {
+		select {
+		case <-p.closed():
+			return
+		default:
+		}
+		data, err := cl.exchange(cl.RxMethod, cl.RxFlag, token, nil)
+		if err != nil {
+			return
+		}
+		p.push(data)
+	}
+}
+
+// exchange sends a poll request and returns the response body,
+// a lost exchange fails the conn as the data can not be resent in order
+func (cl *Client) exchange(method, flag, token string, data []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, cl.getURL(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cl.Host != "" {
+		req.Header.Set("Host", cl.Host)
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	req.Header.Set("Pragma", "no-cache")
+	req.Header.Set("Cache-Control", "private, no-store, no-cache, max-age=0")
+	req.Header.Set("User-Agent", cl.UserAgent)
+	req.Header.Set("Cookie", fmt.Sprintf("%s=%s; %s=%s", cl.TokenCookieB, token, cl.TokenCookieC, flag))
+	res, err := cl.Dialer.Do(req, cl.Timeout+pollWait)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if _, err := cl.checkToken(res); err == nil {
+		return nil, ErrTokenTimeout
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected poll status %v", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, pollBatch))
+}
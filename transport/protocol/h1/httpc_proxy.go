@@ -0,0 +1,115 @@
+package h1
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproxy"
+)
+
+// dialerF sends the requests to an http proxy in absolute form instead of tunneling them with CONNECT,
+// the upload is a chunked request body so the proxy streams it to the server
+type dialerF struct {
+	Config        config.Config
+	Proxy         *url.URL
+	Authorization string
+	Transport     *http.Transport
+}
+
+func (dl *dialerF) GetProto() string {
+	return "http://"
+}
+
+func (dl *dialerF) Do(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: dl.Transport,
+	}
+	dl.authorize(req)
+	return client.Do(req)
+}
+
+// DialTimeout dials the proxy instead of the server
+func (dl *dialerF) DialTimeout(_ string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return xproxy.DialProxy(ctx, dl.Config, dl.Proxy)
+}
+
+func (dl *dialerF) authorize(req *http.Request) {
+	if dl.Authorization != "" {
+		req.Header.Set("Proxy-Authorization", dl.Authorization)
+	}
+}
+
+// write writes the request to the proxy
+func (dl *dialerF) write(req *http.Request, conn net.Conn) error {
+	dl.authorize(req)
+	return req.WriteProxy(conn)
+}
+
+// upload writes the request to the proxy and returns the conn whose writes are the chunks of its body
+func (dl *dialerF) upload(req *http.Request, conn net.Conn) net.Conn {
+	pr, pw := io.Pipe()
+	req.Body = pr
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	go func() {
+		pr.CloseWithError(dl.write(req, conn))
+	}()
+	return &uploadConn{Conn: conn, w: pw}
+}
+
+// uploadConn is the conn writing to a streamed request body
+type uploadConn struct {
+	net.Conn
+	w *io.PipeWriter
+}
+
+func (c *uploadConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *uploadConn) Close() error {
+	c.w.Close()
+	return c.Conn.Close()
+}
+
+// bodyConn is the conn reading from a response body
+type bodyConn struct {
+	net.Conn
+	body io.ReadCloser
+}
+
+func (c *bodyConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+// NewHTTPClient returns the http client dialing the server through the upstream proxy if any,
+// in the forward mode the requests are sent to the http proxy without CONNECT
+func NewHTTPClient(config config.Config) *Client {
+	cl := NewClient(config.ServerAddr, config.Host)
+	if config.ProxyForward {
+		u, err := xproxy.URL(config, config.ServerAddr)
+		if err == nil && u != nil && (u.Scheme == "http" || u.Scheme == "https") {
+			cl.Dialer = &dialerF{
+				Config:        config,
+				Proxy:         u,
+				Authorization: xproxy.Authorization(config, u),
+				Transport:     &http.Transport{Proxy: http.ProxyURL(u)},
+			}
+			return cl
+		}
+		log.Printf("no http proxy for %v, the forward mode is ignored", config.ServerAddr)
+	}
+	cl.Dialer = newDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return xproxy.DialContext(ctx, config, addr)
+	})
+	return cl
+}
@@ -0,0 +1,137 @@
+package h1
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// forwardProxy stands in for a forward http proxy requiring the bearer token, it relays the requests
+// in absolute form to the servers of hosts and streams their bodies both ways
+func forwardProxy(t *testing.T, hosts map[string]string) *httptest.Server {
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Host = hosts[r.In.URL.Host]
+			r.SetXForwarded()
+		},
+		// the proxies relay the body as is, the fake gzip encoding isn't decoded
+		Transport:     &http.Transport{DisableCompression: true},
+		FlushInterval: -1,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() || r.Header.Get("Proxy-Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		// the upload is streamed while the response is
+		http.NewResponseController(w).EnableFullDuplex()
+		rp.ServeHTTP(w, r)
+	}))
+}
+
+// roundTrip checks the data goes both ways between the client conn and the accepted one
+func roundTrip(t *testing.T, srv *Server, conn net.Conn) {
+	t.Helper()
+	up := bytes.Repeat([]byte("up"), 4096)
+	go conn.Write(up)
+	accepted, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	accepted.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(up))
+	if _, err := io.ReadFull(accepted, got); err != nil || !bytes.Equal(got, up) {
+		t.Fatalf("the upload should reach the server: %v", err)
+	}
+	down := bytes.Repeat([]byte("down"), 4096)
+	go accepted.Write(down)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got = make([]byte, len(down))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, down) {
+		t.Fatalf("the download should reach the client: %v", err)
+	}
+}
+
+func TestDialDirect(t *testing.T) {
+	srv := NewHandle(http.NotFoundHandler())
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	cl := NewHTTPClient(config.Config{ServerAddr: strings.TrimPrefix(ts.URL, "http://"), Proxy: "direct"})
+	conn, err := cl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, srv, conn)
+}
+
+// TestDialForward sends the chunked upload and reads the download through the forward proxy
+func TestDialForward(t *testing.T) {
+	srv := NewHandle(http.NotFoundHandler())
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	// the loopback addresses are never proxied, so the proxy resolves the name
+	proxy := forwardProxy(t, map[string]string{"h1.vtun:80": strings.TrimPrefix(ts.URL, "http://")})
+	defer proxy.Close()
+	cl := NewHTTPClient(config.Config{ServerAddr: "h1.vtun:80", Proxy: proxy.URL, ProxyToken: "token", ProxyForward: true})
+	if _, ok := cl.Dialer.(*dialerF); !ok {
+		t.Fatal("the client should send the requests to the http proxy")
+	}
+	conn, err := cl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, srv, conn)
+}
+
+// TestFraming checks the server only drops the chunked framing of the download for the chunked uploads
+// and the requests relayed by a proxy, the plain clients keep the framing they always got
+func TestFraming(t *testing.T) {
+	srv := NewHandle(http.NotFoundHandler())
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+	cl := NewClient(addr, "")
+	for _, tt := range []struct {
+		name    string
+		header  string
+		chunked bool
+	}{
+		{"plain", "", true},
+		{"via", "Via: 1.1 proxy\r\n", false},
+		{"x-forwarded-for", "X-Forwarded-For: 192.0.2.1\r\n", false},
+		{"chunked upload", "Transfer-Encoding: chunked\r\n", false},
+	} {
+		token, err := cl.getToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "%v / HTTP/1.1\r\nHost: %v\r\nCookie: %v=%v; %v=%v\r\n%v\r\n",
+			srv.TxMethod, addr, srv.TokenCookieB, token, srv.TokenCookieC, srv.TxFlag, tt.header)
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if chunked := len(res.TransferEncoding) > 0 && res.TransferEncoding[0] == "chunked"; chunked != tt.chunked {
+			t.Errorf("%v: the download should be chunked %v, got %v", tt.name, tt.chunked, res.TransferEncoding)
+		}
+	}
+}
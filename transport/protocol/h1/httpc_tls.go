@@ -1,16 +1,23 @@
 package h1
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproxy"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"net"
 	"net/http"
 	"time"
 )
 
 type dialerT struct {
-	Transport *http.Transport
-	TLSConfig *tls.Config
+	// DialContext dials the server, directly or through the upstream proxy
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	Transport   *http.Transport
+	TLSConfig   *tls.Config
+	// Fingerprint is the utls fingerprint of the handshakes, empty uses crypto/tls
+	Fingerprint string
 }
 
 func (dl *dialerT) GetProto() string {
@@ -26,15 +33,36 @@ func (dl *dialerT) Do(req *http.Request, timeout time.Duration) (*http.Response,
 }
 
 func (dl *dialerT) DialTimeout(host string, timeout time.Duration) (net.Conn, error) {
-	tx, err := net.DialTimeout("tcp", host, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tx, err := dl.DialContext(ctx, "tcp", host)
 	if err != nil {
 		return nil, err
 	}
-	tx = tls.Client(tx, dl.TLSConfig)
-	return tx, nil
+	return dl.client(tx, host)
 }
 
-func NewTLSClient(config config.Config) *Client {
+// client starts tls over the conn
+func (dl *dialerT) client(conn net.Conn, addr string) (net.Conn, error) {
+	if dl.Fingerprint == "" {
+		return tls.Client(conn, dl.TLSConfig), nil
+	}
+	c := dl.TLSConfig.Clone()
+	if c.ServerName == "" {
+		c.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	// the tunnel speaks http/1.1 whatever the fingerprint offers
+	c.NextProtos = []string{"http/1.1"}
+	uConn, err := xtls.UClient(conn, c, dl.Fingerprint)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return uConn, nil
+}
+
+// NewTLSClient returns the https client, it fails if the client certificate or the server verification can't be loaded
+func NewTLSClient(config config.Config) (*Client, error) {
 	cl := NewClient(config.ServerAddr, config.Host)
 
 	tlsConfig := &tls.Config{
@@ -54,15 +82,37 @@ func NewTLSClient(config config.Config) *Client {
 	if config.TLSSni != "" {
 		tlsConfig.ServerName = config.TLSSni
 	}
+	if err := xtls.ClientCertificate(tlsConfig, config); err != nil {
+		return nil, err
+	}
+	if err := xtls.VerifyServer(tlsConfig, config); err != nil {
+		return nil, err
+	}
 
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return xproxy.DialContext(ctx, config, addr)
+	}
 	Transport := &http.Transport{
+		DialContext:     dial,
 		TLSClientConfig: tlsConfig,
 	}
 
-	cl.Dialer = &dialerT{
-		TLSConfig: tlsConfig,
-		Transport: Transport,
+	dl := &dialerT{
+		DialContext: dial,
+		TLSConfig:   tlsConfig,
+		Transport:   Transport,
+	}
+	if config.UTLSHTTP {
+		dl.Fingerprint = config.UTLSFingerprint
+		Transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return dl.client(conn, addr)
+		}
 	}
+	cl.Dialer = dl
 
-	return cl
+	return cl, nil
 }
@@ -5,9 +5,12 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/net-byte/vtun/common/x/xtls"
 )
 
 var (
@@ -34,15 +37,34 @@ type Server struct {
 	HeaderServer string
 	HttpHandler  http.Handler
 	TokenTTL     time.Duration
+	// Path is the only path of the tunnel if set, the requests to the others are served by HttpHandler
+	Path string
+	// Poll carries the conns by short request/response exchanges instead of two streams
+	Poll bool
 }
 
 type state struct {
-	IP    string
-	mx    sync.Mutex
-	connR net.Conn
-	bufR  *bufio.ReadWriter
-	connW net.Conn
-	ttl   time.Time
+	IP        string
+	mx        sync.Mutex
+	connR     net.Conn
+	bufR      *bufio.ReadWriter
+	connW     net.Conn
+	identityR string
+	identityW string
+	chunkedR  bool
+	poll      *pollConn
+	expired   bool
+	ttl       time.Time
+}
+
+// expire closes the poll conn of the state dropped with its token, no exchange opens a new one after it
+func (cc *state) expire() {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	cc.expired = true
+	if cc.poll != nil {
+		cc.poll.Close()
+	}
 }
 
 func NewHandle(handler http.Handler) *Server {
@@ -117,6 +139,11 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var ok bool
 	var err error
 	var c, ct *http.Cookie
+	if srv.Path != "" && r.URL.Path != srv.Path {
+		w.Header().Set("Server", srv.HeaderServer)
+		srv.HttpHandler.ServeHTTP(w, r)
+		return
+	}
 	c, err = r.Cookie(srv.TokenCookieB)
 	if err != nil {
 		goto FILE
@@ -131,6 +158,10 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		} else {
 			goto FILE
 		}
+		if srv.Poll {
+			srv.handlePoll(w, r, c.Value, ct.Value, cc)
+			return
+		}
 		srv.handleHttp(w, r, c.Value, ct.Value, cc)
 		return
 	}
@@ -158,6 +189,14 @@ func (srv *Server) handleHttp(w http.ResponseWriter, r *http.Request, token stri
 	header := w.Header()
 	header.Set("Cache-Control", "private, no-store, no-cache, max-age=0")
 	header.Set("Content-Encoding", "gzip")
+	// the upload is chunked when it is sent through a forward proxy
+	chunked := len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+	if chunked || proxied(r) {
+		// the body is delimited by the close instead of chunks, so proxies stream it as is
+		header.Set("Transfer-Encoding", "identity")
+		// the chunked upload is still being read after the headers are flushed
+		http.NewResponseController(w).EnableFullDuplex()
+	}
 	flusher.Flush()
 	hj, ok := w.(http.Hijacker)
 	if !ok {
@@ -170,23 +209,44 @@ func (srv *Server) handleHttp(w http.ResponseWriter, r *http.Request, token stri
 	bufRW.Flush()
 	cc.mx.Lock()
 	defer cc.mx.Unlock()
+	identity := xtls.StateIdentity(r.TLS)
 	if r.Method == srv.RxMethod && flag == srv.RxFlag {
 		cc.connW = conn
+		cc.identityW = identity
 	}
 	if r.Method == srv.TxMethod && flag == srv.TxFlag {
 		cc.connR = conn
 		cc.bufR = bufRW
+		cc.identityR = identity
+		cc.chunkedR = chunked
 	}
 	if cc.connR != nil && cc.connW != nil {
 		srv.rmToken(token)
+		if cc.identityR != cc.identityW {
+			// both halves must be opened by the same client
+			cc.connR.Close()
+			cc.connW.Close()
+			return
+		}
 
 		n := cc.bufR.Reader.Buffered()
 		buf := make([]byte, n)
 		cc.bufR.Reader.Read(buf[:n])
-		srv.accepts <- mkConn(cc.connR, cc.connW, buf[:n])
+		c := mkConn(cc.connR, cc.connW, buf[:n])
+		if cc.chunkedR {
+			c.R = CloseableReader{httputil.NewChunkedReader(c.R), cc.connR}
+		}
+		c.Identity = identity
+		srv.accepts <- c
 	}
 }
 
+// proxied returns true if the request came through a proxy, the proxies must add the Via header
+// and most add the X-Forwarded-For one
+func proxied(r *http.Request) bool {
+	return r.Header.Get("Via") != "" || r.Header.Get("X-Forwarded-For") != ""
+}
+
 func (srv *Server) regToken(token string) {
 	srv.mx.Lock()
 	defer srv.mx.Unlock()
@@ -200,18 +260,31 @@ func (srv *Server) regToken(token string) {
 
 func (srv *Server) checkToken(token string) (*state, bool) {
 	srv.mx.Lock()
-	defer srv.mx.Unlock()
 	c, ok := srv.states[token]
 	if !ok {
+		srv.mx.Unlock()
 		return nil, false
 	}
 	if time.Now().After(c.ttl) {
 		delete(srv.states, token)
+		srv.mx.Unlock()
+		// the state is locked after the server as an exchange removes its token under the state lock
+		c.expire()
 		return nil, false
 	}
+	srv.mx.Unlock()
 	return c, true
 }
 
+// refreshToken extends the ttl of the token of an active poll conn
+func (srv *Server) refreshToken(token string) {
+	srv.mx.Lock()
+	defer srv.mx.Unlock()
+	if c, ok := srv.states[token]; ok {
+		c.ttl = time.Now().Add(srv.TokenTTL)
+	}
+}
+
 func (srv *Server) rmToken(token string) {
 	srv.mx.Lock()
 	defer srv.mx.Unlock()
@@ -255,6 +328,7 @@ func (srv *Server) tokenCleaner() {
 
 			}
 			cc.mx.Unlock()
+			cc.expire()
 		}
 	}
 }
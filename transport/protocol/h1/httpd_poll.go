@@ -0,0 +1,69 @@
+package h1
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/net-byte/vtun/common/x/xtls"
+)
+
+// handlePoll serves an exchange of a poll conn, the uploads carry the data from the client
+// and the downloads wait for the data to the client
+func (srv *Server) handlePoll(w http.ResponseWriter, r *http.Request, token string, flag string, cc *state) {
+	identity := xtls.StateIdentity(r.TLS)
+	cc.mx.Lock()
+	if cc.expired {
+		cc.mx.Unlock()
+		srv.handleBase(w, r)
+		return
+	}
+	opened := cc.poll == nil
+	if opened {
+		local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		cc.poll = newPollConn(local, remote)
+		cc.poll.Identity = identity
+	}
+	p := cc.poll
+	cc.mx.Unlock()
+	if opened {
+		// the other exchanges of the conn go on while it waits to be accepted
+		srv.accepts <- p
+	}
+	if p.Identity != identity {
+		// every exchange must be sent by the client which opened the conn
+		srv.handleBase(w, r)
+		return
+	}
+	select {
+	case <-p.closed():
+		// the new token tells the client the conn is gone
+		srv.rmToken(token)
+		srv.handleBase(w, r)
+		return
+	default:
+	}
+	srv.refreshToken(token)
+	var data []byte
+	switch {
+	case r.Method == srv.TxMethod && flag == srv.TxFlag:
+		body, err := io.ReadAll(io.LimitReader(r.Body, pollBatch))
+		if err != nil {
+			return
+		}
+		p.push(body)
+	case r.Method == srv.RxMethod && flag == srv.RxFlag:
+		data = p.pull(pollBatch, pollWait)
+	default:
+		srv.handleBase(w, r)
+		return
+	}
+	header := w.Header()
+	header.Set("Server", srv.HeaderServer)
+	header.Set("Cache-Control", "private, no-store, no-cache, max-age=0")
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
@@ -0,0 +1,64 @@
+package h1
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// TestPath checks a set path is the only one of the tunnel, the others are served by the fallback
+func TestPath(t *testing.T) {
+	srv := NewHandle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "fallback")
+	}))
+	srv.Path = "/tunnel"
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	cl := NewHTTPClient(config.Config{ServerAddr: addr, Proxy: "direct"})
+	cl.Path = "/other"
+	if _, err := cl.Dial(); err != ErrNotServer {
+		t.Fatalf("the server should not hand a token out on another path, got %v", err)
+	}
+	res, err := http.Get(ts.URL + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "fallback" || len(res.Cookies()) != 0 {
+		t.Errorf("another path should be served by the fallback alone, got %q with %v", body, res.Cookies())
+	}
+
+	// a token of the tunnel path doesn't open the tunnel on another one
+	cl.Path = srv.Path
+	token, err := cl.getToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(srv.TxMethod, ts.URL+"/other", nil)
+	req.Header.Set("Cookie", fmt.Sprintf("%v=%v; %v=%v", srv.TokenCookieB, token, srv.TokenCookieC, srv.TxFlag))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "fallback" {
+		t.Errorf("the tunnel should not be opened on another path, got %q", body)
+	}
+
+	cl.Path = srv.Path
+	conn, err := cl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, srv, conn)
+}
@@ -0,0 +1,196 @@
+package h1
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pollConn is a conn carried by short request/response exchanges,
+// the exchanges push the received data into it and pull the data written to it
+type pollConn struct {
+	mx        sync.Mutex
+	rBuf      bytes.Buffer
+	wBuf      bytes.Buffer
+	rReady    chan struct{}
+	wReady    chan struct{}
+	wSpace    chan struct{}
+	die       chan struct{}
+	dieOnce   sync.Once
+	rDeadline time.Time
+	wDeadline time.Time
+	local     net.Addr
+	remote    net.Addr
+	// Identity is the verified client identity of a server side conn
+	Identity string
+}
+
+func newPollConn(local, remote net.Addr) *pollConn {
+	return &pollConn{
+		rReady: make(chan struct{}, 1),
+		wReady: make(chan struct{}, 1),
+		wSpace: make(chan struct{}, 1),
+		die:    make(chan struct{}),
+		local:  local,
+		remote: remote,
+	}
+}
+
+func (c *pollConn) Read(b []byte) (int, error) {
+	for {
+		c.mx.Lock()
+		if c.rBuf.Len() > 0 {
+			n, _ := c.rBuf.Read(b)
+			c.mx.Unlock()
+			return n, nil
+		}
+		deadline := c.rDeadline
+		c.mx.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if err := c.wait(c.rReady, deadline, io.EOF); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait waits for a signal of the channel until the deadline, the error is returned when the conn is closed
+func (c *pollConn) wait(ch chan struct{}, deadline time.Time, closed error) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-c.die:
+		return closed
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Write buffers the data for the exchanges, it blocks while pollBuffer bytes are waiting to be pulled
+// so a slow exchange pushes back on the writer rather than piling up the data
+func (c *pollConn) Write(b []byte) (int, error) {
+	for {
+		select {
+		case <-c.die:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+		c.mx.Lock()
+		if c.wBuf.Len() < pollBuffer {
+			c.wBuf.Write(b)
+			c.mx.Unlock()
+			signal(c.wReady)
+			return len(b), nil
+		}
+		deadline := c.wDeadline
+		c.mx.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if err := c.wait(c.wSpace, deadline, io.ErrClosedPipe); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// push adds the data received by an exchange
+func (c *pollConn) push(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	c.mx.Lock()
+	c.rBuf.Write(data)
+	c.mx.Unlock()
+	signal(c.rReady)
+}
+
+// pull takes up to max bytes written to the conn, it waits for the data until the wait elapses,
+// a negative wait waits until the conn is closed
+func (c *pollConn) pull(max int, wait time.Duration) []byte {
+	var timeout <-chan time.Time
+	if wait >= 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		c.mx.Lock()
+		if c.wBuf.Len() > 0 {
+			data := make([]byte, min(max, c.wBuf.Len()))
+			c.wBuf.Read(data)
+			if c.wBuf.Len() > 0 {
+				signal(c.wReady)
+			}
+			c.mx.Unlock()
+			signal(c.wSpace)
+			return data
+		}
+		c.mx.Unlock()
+		select {
+		case <-c.wReady:
+		case <-c.die:
+			return nil
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// closed returns the channel closed with the conn
+func (c *pollConn) closed() <-chan struct{} {
+	return c.die
+}
+
+func (c *pollConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+	})
+	return nil
+}
+
+func (c *pollConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pollConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *pollConn) SetReadDeadline(t time.Time) error {
+	c.mx.Lock()
+	c.rDeadline = t
+	c.mx.Unlock()
+	signal(c.rReady)
+	return nil
+}
+
+func (c *pollConn) SetWriteDeadline(t time.Time) error {
+	c.mx.Lock()
+	c.wDeadline = t
+	c.mx.Unlock()
+	signal(c.wSpace)
+	return nil
+}
+
+func (c *pollConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// signal wakes up a waiter of the channel without blocking
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
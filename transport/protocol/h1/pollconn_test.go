@@ -0,0 +1,156 @@
+package h1
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollRoundTrip(t *testing.T) {
+	srv := NewHandle(http.NotFoundHandler())
+	srv.Poll = true
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	cl := NewClient(strings.TrimPrefix(ts.URL, "http://"), "")
+	conn, err := cl.DialPoll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// more than an exchange carries so the data spans several of them
+	up := bytes.Repeat([]byte("up"), pollBatch)
+	go conn.Write(up)
+	accepted, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	accepted.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(up))
+	if _, err := io.ReadFull(accepted, got); err != nil || !bytes.Equal(got, up) {
+		t.Fatalf("the upload should reach the server in order: %v", err)
+	}
+	down := []byte("down")
+	if _, err := accepted.Write(down); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got = make([]byte, len(down))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, down) {
+		t.Fatalf("the download should reach the client: %v", err)
+	}
+}
+
+func TestPollConnWriteLimit(t *testing.T) {
+	c := newPollConn(nil, nil)
+	if _, err := c.Write(make([]byte, pollBuffer)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Write([]byte{0}); err != os.ErrDeadlineExceeded {
+		t.Fatalf("the write past the buffer should block until the deadline, got %v", err)
+	}
+	c.SetWriteDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, err := c.Write([]byte{0})
+		done <- err
+	}()
+	c.pull(pollBatch, 0)
+	if err := <-done; err != nil {
+		t.Fatalf("the pull should unblock the write, got %v", err)
+	}
+	c.Close()
+	if _, err := c.Write([]byte{0}); err != io.ErrClosedPipe {
+		t.Fatalf("the write to a closed conn should fail, got %v", err)
+	}
+}
+
+// TestPollTokenRotation polls while the tokens expire, the exchanges after the expiry close the conns
+// and the client dials again with a new token
+func TestPollTokenRotation(t *testing.T) {
+	srv := NewHandle(http.NotFoundHandler())
+	srv.Poll = true
+	srv.TokenTTL = 20 * time.Millisecond
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	cl := NewClient(strings.TrimPrefix(ts.URL, "http://"), "")
+	for i := 0; i < 5; i++ {
+		conn, err := cl.DialPoll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the upload opens the conn while the download polls for it
+		conn.Write([]byte("up"))
+		accepted, err := srv.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error)
+		go func() {
+			_, err := io.Copy(io.Discard, accepted)
+			done <- err
+		}()
+		// the exchanges refresh the token, it expires in the pause
+		for j := 0; j < 10; j++ {
+			time.Sleep(time.Millisecond)
+			conn.Write([]byte("up"))
+		}
+		time.Sleep(2 * srv.TokenTTL)
+		conn.Write([]byte("up"))
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("the server conn should be closed with its token, got %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("the server conn should be closed with its token")
+		}
+		conn.Close()
+	}
+}
+
+// TestPollTokenExpiry expires the token while an exchange opens its conn,
+// the conn is either never opened or closed with the token
+func TestPollTokenExpiry(t *testing.T) {
+	srv := NewHandle(http.NotFoundHandler())
+	srv.Poll = true
+	go func() {
+		for {
+			srv.Accept()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		token := RandomString(16)
+		srv.regToken(token)
+		cc, _ := srv.checkToken(token)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r := httptest.NewRequest(srv.TxMethod, "/", strings.NewReader("up"))
+			srv.handlePoll(httptest.NewRecorder(), r, token, srv.TxFlag, cc)
+		}()
+		srv.mx.Lock()
+		cc.ttl = time.Now()
+		srv.mx.Unlock()
+		if _, ok := srv.checkToken(token); ok {
+			t.Fatal("the token should be expired")
+		}
+		<-done
+		cc.mx.Lock()
+		p := cc.poll
+		cc.mx.Unlock()
+		if p != nil {
+			select {
+			case <-p.closed():
+			default:
+				t.Fatal("the conn of an expired token should be closed")
+			}
+		}
+	}
+}
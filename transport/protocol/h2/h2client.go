@@ -10,18 +10,28 @@ import (
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xchan"
 	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xproxy"
+	"github.com/net-byte/vtun/common/x/xretry"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/vtun/common/x/xtun"
 	"github.com/net-byte/water"
 	"golang.org/x/net/http2"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
 const ConnTag = "h2conn"
 
+// SessionHeader is the header carrying the session id shared by the streams of a client
+const SessionHeader = "Vtun-Session"
+
 var _ctx context.Context
 var _cancel context.CancelFunc
 
@@ -33,38 +43,96 @@ func StartClientForApi(config config.Config, outputStream <-chan []byte, inputSt
 	if config.TLSSni != "" {
 		tlsConfig.ServerName = config.TLSSni
 	}
+	if err := xtls.ClientCertificate(tlsConfig, config); err != nil {
+		log.Fatalln(err)
+	}
+	if err := xtls.VerifyServer(tlsConfig, config); err != nil {
+		log.Fatalln(err)
+	}
 	httpHeader := http.Header{}
 	httpHeader.Add("Accept-Encoding", "identity")
+	transport := &http2.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	transport.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		conn, err := xproxy.DialContext(ctx, config, addr)
+		if err != nil {
+			return nil, err
+		}
+		if !config.UTLSHTTP {
+			tlsConn := tls.Client(conn, cfg)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
+		uConn, err := xtls.UClient(conn, cfg, config.UTLSFingerprint)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return uConn, nil
+	}
 	client := &Client{
 		Client: &http.Client{
-			Transport: &http2.Transport{
-				TLSClientConfig: tlsConfig,
-			},
+			Transport: transport,
 		},
 		Header: httpHeader,
 	}
+	policy := xretry.NewPolicy(config)
 	for xtun.ContextOpened(_ctx) {
 		ctx, cancel := context.WithCancel(_ctx)
-		conn, resp, err := client.Connect(ctx, fmt.Sprintf("https://%s%s", config.ServerAddr, config.Path))
+		policy.Connecting()
+		// the streams of a connection share a session so the server groups them
+		client.Header = httpHeader.Clone()
+		client.Header.Set(SessionHeader, xproto.GenSessionID().String())
+		conns, err := connectStreams(config, client, ctx)
 		if err != nil {
 			cancel()
-			time.Sleep(3 * time.Second)
-			netutil.PrintErrF(config.Verbose, "Initiate conn: %s\n", err)
+			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
-		if resp.StatusCode != http.StatusOK {
-			cancel()
-			time.Sleep(3 * time.Second)
-			netutil.PrintErrF(config.Verbose, "bad status code: %d\n", resp.StatusCode)
-			continue
+		cache.GetCache().Set(ConnTag, conns, 24*time.Hour)
+		policy.Connected()
+		var wg sync.WaitGroup
+		for _, conn := range conns {
+			wg.Add(1)
+			go func(conn *Conn) {
+				defer wg.Done()
+				go keepAlive(config, conn, ctx)
+				h2ToTun(config, conn, inputStream, ctx, cancel, writeCallback)
+				conn.Close()
+			}(conn)
 		}
-		cache.GetCache().Set(ConnTag, conn, 24*time.Hour)
-		h2ToTun(config, conn, inputStream, ctx, cancel, writeCallback)
+		wg.Wait()
+		cancel()
 		cache.GetCache().Delete(ConnTag)
-		conn.Close()
+		policy.Disconnected(_ctx)
 	}
 }
 
+// connectStreams opens the streams of a session, they share the http2 connection of the client
+func connectStreams(config config.Config, client *Client, ctx context.Context) ([]*Conn, error) {
+	var conns []*Conn
+	for i := 0; i < config.Streams || i == 0; i++ {
+		conn, resp, err := client.Connect(ctx, fmt.Sprintf("https://%s%s", config.ServerAddr, config.Path))
+		if err == nil && resp.StatusCode != http.StatusOK {
+			conn.Close()
+			err = fmt.Errorf("bad status code: %d", resp.StatusCode)
+		}
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
 // StartClient starts the h2 client
 func StartClient(iFace *water.Interface, config config.Config) {
 	log.Println("vtun h2 client started")
@@ -81,21 +149,36 @@ func StartClient(iFace *water.Interface, config config.Config) {
 	)
 }
 
-// tunToH2 sends packets from tun to h2
+// tunToH2 sends packets from tun to h2, in the batch mode the packets of a stream are written at once
 func tunToH2(config config.Config, outputStream <-chan []byte, _ctx context.Context, callback func(int)) {
-	header := make([]byte, xproto.HeaderLength)
 	for xtun.ContextOpened(_ctx) {
 		b := <-outputStream
-		if v, ok := cache.GetCache().Get(ConnTag); ok {
+		batch := [][]byte{b}
+		if config.BatchSize > 0 {
+			batch = xchan.Collect(outputStream, b, config.BatchSize, xchan.BatchDelay(config))
+		}
+		v, ok := cache.GetCache().Get(ConnTag)
+		if !ok {
+			continue
+		}
+		conns := v.([]*Conn)
+		// the packets of a flow stay on one stream
+		streams := make([][][]byte, len(conns))
+		for _, b := range batch {
+			i := netutil.FlowHash(b) % uint32(len(conns))
 			if config.Obfs {
 				b = cipher.XOR(b)
 			}
 			if config.Compress {
 				b = snappy.Encode(nil, b)
 			}
-			xproto.WriteLength(header, len(b))
-			conn := v.(*Conn)
-			n, err := conn.Write(xproto.Merge(header, b))
+			streams[i] = append(streams[i], b)
+		}
+		for i, packets := range streams {
+			if len(packets) == 0 {
+				continue
+			}
+			n, err := conns[i].Write(xproto.EncodeBatch(packets))
 			if err != nil {
 				netutil.PrintErr(err, config.Verbose)
 				continue
@@ -105,9 +188,20 @@ func tunToH2(config config.Config, outputStream <-chan []byte, _ctx context.Cont
 	}
 }
 
+// keepAlive sends empty packets to the server until the context is done
+func keepAlive(config config.Config, conn *Conn, _ctx context.Context) {
+	header := make([]byte, xproto.HeaderLength)
+	xalive.Run(_ctx, config, func() error {
+		_, err := conn.Write(header)
+		return err
+	})
+}
+
 // h2ToTun sends packets from h2 to tun
 func h2ToTun(config config.Config, conn *Conn, inputStream chan<- []byte, _ctx context.Context, _cancel context.CancelFunc, callback func(int)) {
 	defer _cancel()
+	watchdog := xalive.NewWatchdog(xalive.Timeout(config), _cancel)
+	defer watchdog.Stop()
 	buffer := make([]byte, config.BufferSize)
 	header := make([]byte, xproto.HeaderLength)
 	for xtun.ContextOpened(_ctx) {
@@ -120,7 +214,12 @@ func h2ToTun(config config.Config, conn *Conn, inputStream chan<- []byte, _ctx c
 			netutil.PrintErrF(config.Verbose, "n %d != header_length %d\n", n, xproto.HeaderLength)
 			break
 		}
+		watchdog.Touch()
 		length := xproto.ReadLength(header)
+		if length == 0 {
+			// keepalive
+			continue
+		}
 		count, err := conn.Read(buffer[:length])
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -4,14 +4,16 @@ import (
 	"context"
 	"io"
 	"sync"
+	"time"
 )
 
 type Conn struct {
-	r      io.Reader
-	wc     io.WriteCloser
-	cancel context.CancelFunc
-	wLock  sync.Mutex
-	rLock  sync.Mutex
+	r        io.Reader
+	wc       io.WriteCloser
+	cancel   context.CancelFunc
+	deadline func(time.Time) error
+	wLock    sync.Mutex
+	rLock    sync.Mutex
 }
 
 func newConn(ctx context.Context, r io.Reader, wc io.WriteCloser) (*Conn, context.Context) {
@@ -35,6 +37,13 @@ func (c *Conn) Read(data []byte) (int, error) {
 	return c.r.Read(data)
 }
 
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if c.deadline == nil {
+		return nil
+	}
+	return c.deadline(t)
+}
+
 func (c *Conn) Close() error {
 	c.cancel()
 	return c.wc.Close()
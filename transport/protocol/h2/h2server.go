@@ -1,6 +1,8 @@
 package h2
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"github.com/golang/snappy"
 	"github.com/net-byte/vtun/common/cache"
@@ -8,12 +10,15 @@ import (
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xchan"
+	"github.com/net-byte/vtun/common/x/xfallback"
 	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/water"
 	"io"
 	"log"
 	"net/http"
-	"time"
 )
 
 // StartServer starts the h2 server
@@ -23,12 +28,25 @@ func StartServer(iFace *water.Interface, config config.Config) {
 	mux.Handle(config.Path, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		ServeHTTP(writer, request, config, iFace)
 	}))
+	if xfallback.Enabled(config) {
+		mux.Handle("/", xfallback.Handler(config))
+	}
+	tlsConfig := &tls.Config{}
+	err := xtls.ServerCertificate(tlsConfig, config)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = xtls.VerifyClients(tlsConfig, config)
+	if err != nil {
+		log.Panic(err)
+	}
 	srv := &http.Server{
-		Addr:    config.LocalAddr,
-		Handler: mux,
+		Addr:      config.LocalAddr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
 	}
 	go toClient(config, iFace)
-	log.Fatal(srv.ListenAndServeTLS(config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath))
+	log.Fatal(srv.ListenAndServeTLS("", ""))
 }
 
 func ServeHTTP(w http.ResponseWriter, r *http.Request, config config.Config, iFace *water.Interface) {
@@ -41,7 +59,13 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, config config.Config, iFa
 		return
 	}
 	defer conn.Close()
-	toServer(conn, config, iFace)
+	session := r.Header.Get(SessionHeader)
+	if session == "" {
+		session = fmt.Sprintf("%p", conn)
+	}
+	identity := xtls.StateIdentity(r.TLS)
+	// a client can only join the sessions of its own identity
+	toServer(conn, identity+"/"+session, identity, config, iFace)
 }
 
 // toClient sends packets from tun to h2
@@ -56,6 +80,7 @@ func toClient(config config.Config, iFace *water.Interface) {
 		}
 		b := packet[:n]
 		if key := netutil.GetDstKey(b); key != "" {
+			hash := netutil.FlowHash(b)
 			if v, ok := cache.GetCache().Get(key); ok {
 				if config.Obfs {
 					b = cipher.XOR(b)
@@ -64,23 +89,38 @@ func toClient(config config.Config, iFace *water.Interface) {
 					b = snappy.Encode(nil, b)
 				}
 				xproto.WriteLength(header, len(b))
-				n, err = v.(*Conn).Write(xproto.Merge(header, b))
-				if err != nil {
-					cache.GetCache().Delete(key)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
+				v.(*cache.Group).Push(hash, xproto.Merge(header, b))
 			}
 		}
 	}
 }
 
 // toServer sends packets from h2 to tun
-func toServer(conn *Conn, config config.Config, iFace *water.Interface) {
+func toServer(conn *Conn, session string, identity string, config config.Config, iFace *water.Interface) {
 	defer conn.Close()
+	// the queued packets are framed already, a batch is written at once so it goes out in one data frame
+	queue := xchan.NewBatchQueue(config.SendQueueSize, xchan.ParseDropPolicy(config.DropPolicy), config.BatchSize, xchan.BatchDelay(config), func(batch [][]byte) error {
+		b := batch[0]
+		if len(batch) > 1 {
+			b = bytes.Join(batch, nil)
+		}
+		n, err := conn.Write(b)
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			conn.Close()
+			return err
+		}
+		counter.IncrWrittenBytes(n)
+		return nil
+	})
+	defer queue.Close()
+	group := cache.JoinGroup(session, queue)
+	defer cache.LeaveGroup(session, queue)
+	group.SetIdentity(identity)
 	buffer := make([]byte, config.BufferSize)
 	header := make([]byte, xproto.HeaderLength)
 	for {
+		conn.SetReadDeadline(xalive.Deadline(config))
 		n, err := conn.Read(header)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -91,6 +131,11 @@ func toServer(conn *Conn, config config.Config, iFace *water.Interface) {
 			break
 		}
 		length := xproto.ReadLength(header)
+		if length == 0 {
+			// keepalive
+			queue.Push(xproto.Copy(header))
+			continue
+		}
 		count, err := conn.Read(buffer[:length])
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -112,7 +157,10 @@ func toServer(conn *Conn, config config.Config, iFace *water.Interface) {
 			b = cipher.XOR(b)
 		}
 		if key := netutil.GetSrcKey(b); key != "" {
-			cache.GetCache().Set(key, conn, 24*time.Hour)
+			if !group.Route(key) {
+				netutil.PrintErrF(config.Verbose, "%v is owned by another client, dropped\n", key)
+				continue
+			}
 			_, err := iFace.Write(b)
 			if err != nil {
 				netutil.PrintErr(err, config.Verbose)
@@ -138,6 +186,7 @@ func (u *Server) Accept(w http.ResponseWriter, r *http.Request) (*Conn, error) {
 		return nil, ErrHTTP2NotSupported
 	}
 	c, ctx := newConn(r.Context(), r.Body, &flushWrite{w: w, f: flusher})
+	c.deadline = http.NewResponseController(w).SetReadDeadline
 	*r = *r.WithContext(ctx)
 	w.WriteHeader(u.StatusCode)
 	flusher.Flush()
@@ -0,0 +1,141 @@
+package icmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xcrypto"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xsession"
+)
+
+// TestLoopback carries a packet both ways over loopback, it needs CAP_NET_RAW
+func TestLoopback(t *testing.T) {
+	cfg := config.Config{Key: "secret"}
+	server, err := listen(cfg, "127.0.0.1", false)
+	if err != nil {
+		t.Skipf("no raw socket without CAP_NET_RAW: %v", err)
+	}
+	defer server.Close()
+	client, err := listen(cfg, "", false)
+	if err != nil {
+		t.Skipf("no raw socket without CAP_NET_RAW: %v", err)
+	}
+	defer client.Close()
+	xp := &xcrypto.XCrypto{}
+	if err := xp.Init(cfg.Key); err != nil {
+		t.Fatal(err)
+	}
+	sid := xproto.GenSessionID()
+	serverAddr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	deadline := time.Now().Add(5 * time.Second)
+	server.pc.SetReadDeadline(deadline)
+	client.pc.SetReadDeadline(deadline)
+	buffer := make([]byte, 65535)
+
+	up, _ := seal(xp, sid, dirUp, []byte("up"))
+	if err := client.write(up, true, 4242, 1, serverAddr); err != nil {
+		t.Fatal(err)
+	}
+	data, id, seq, cliAddr, err := server.read(buffer, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := open(xp, data, dirUp); err != nil || !bytes.Equal(b, []byte("up")) || seq != 1 {
+		t.Fatalf("the request should carry the packet up: %v", err)
+	}
+
+	down, _ := seal(xp, sid, dirDown, []byte("down"))
+	if err := server.write(down, false, id, seq, cliAddr); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		data, _, _, _, err := client.read(buffer, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the kernel answers the request too, its echo is sealed upwards and fails to open
+		b, err := open(xp, data, dirDown)
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(b, []byte("down")) {
+			t.Fatal("the reply should carry the packet down")
+		}
+		return
+	}
+}
+
+// TestKeepAlive runs the session logic of the server without raw sockets
+func TestKeepAlive(t *testing.T) {
+	key := []byte("secret")
+	cfg := config.Config{Key: string(key)}
+	s := &Server{config: cfg, sessions: xsession.NewTable("icmp", cfg, func() *echoes { return &echoes{} })}
+	addrA, addrB := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, &net.IPAddr{IP: net.IPv4(192, 0, 2, 2)}
+	a := &xproto.UDPKeepAlivePacket{
+		UDPHeader: xproto.UDPHeader{Type: xproto.UDPTypeKeepAlive, SessionID: xproto.GenSessionID()},
+		Counter:   1,
+		CIDRv4:    net.IPv4(172, 16, 0, 10),
+		CIDRv6:    net.ParseIP("fced:9999::9999"),
+	}
+	answer := func(b []byte) uint8 {
+		t.Helper()
+		ka := xproto.ParseUDPKeepAlivePacket(b, key)
+		if ka == nil {
+			t.Fatal("the answer should be an authenticated keepalive packet")
+		}
+		return ka.Type
+	}
+
+	if typ := answer(s.keepAlive(a, addrA, 7, 1)); typ != xproto.UDPTypeKeepAliveAck {
+		t.Fatalf("the session should be acked, got type %v", typ)
+	}
+	if s.keepAlive(a, addrB, 7, 2) != nil {
+		t.Error("a replayed keepalive should not be answered")
+	}
+	// the routes are owned by the session until it dies
+	sess, _ := s.sessions.Get(a.SessionID)
+	defer s.sessions.Close(sess)
+	if addr, _, _ := sess.State.reply(); addr != addrA {
+		t.Error("a replayed keepalive should not rebind the session")
+	}
+
+	sess.State.request(addrA, 7, 2)
+	sess.State.request(addrA, 7, 3)
+	sess.State.request(addrB, 7, 4)
+	for _, want := range []int{2, 3, 3} {
+		if addr, id, seq := sess.State.reply(); addr != addrA || id != 7 || seq != want {
+			t.Fatalf("the reply should answer request %v of the session address, got %v %v %v", want, addr, id, seq)
+		}
+	}
+
+	a.Counter++
+	if typ := answer(s.keepAlive(a, addrB, 8, 5)); typ != xproto.UDPTypeKeepAliveAck {
+		t.Fatalf("the session should be acked from its new address, got type %v", typ)
+	}
+	if addr, id, seq := sess.State.reply(); addr != addrB || id != 8 || seq != 5 {
+		t.Errorf("the keepalive should rebind the session, got %v %v %v", addr, id, seq)
+	}
+
+	b := &xproto.UDPKeepAlivePacket{
+		UDPHeader: xproto.UDPHeader{Type: xproto.UDPTypeKeepAlive, SessionID: xproto.GenSessionID()},
+		Counter:   1,
+		CIDRv4:    net.IPv4(172, 16, 0, 11),
+		CIDRv6:    a.CIDRv6,
+	}
+	if typ := answer(s.keepAlive(b, addrA, 9, 1)); typ != xproto.UDPTypeKeepAliveReject {
+		t.Fatalf("a session claiming the addresses of another one should be rejected, got type %v", typ)
+	}
+	if _, ok := s.sessions.Get(b.SessionID); ok {
+		t.Error("the rejected session should be closed")
+	}
+	if owner, _ := s.sessions.Lookup(a.CIDRv6.String()); owner != sess {
+		t.Error("the address should stay routed to its owner")
+	}
+	if _, ok := s.sessions.Lookup(b.CIDRv4.String()); ok {
+		t.Error("the rejected session should not keep any route")
+	}
+}
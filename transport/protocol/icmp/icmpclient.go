@@ -0,0 +1,247 @@
+package icmp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/net-byte/vtun/common/cipher"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/counter"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xcrypto"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xretry"
+	"github.com/net-byte/water"
+)
+
+// Client The client struct
+type Client struct {
+	config   config.Config
+	iFace    *water.Interface
+	xp       *xcrypto.XCrypto
+	peer     atomic.Pointer[peer]
+	session  xproto.SessionID
+	id       int
+	seq      atomic.Uint32
+	counter  atomic.Uint64
+	lastRecv atomic.Int64
+	lastSend atomic.Int64
+}
+
+// peer is the raw socket to the server
+type peer struct {
+	conn *conn
+	addr *net.IPAddr
+}
+
+// StartClient starts the icmp client
+func StartClient(iFace *water.Interface, config config.Config) {
+	log.Println("vtun icmp client started")
+	xp := &xcrypto.XCrypto{}
+	if err := xp.Init(config.Key); err != nil {
+		netutil.PrintErr(err, config.Verbose)
+		return
+	}
+	c := &Client{config: config, iFace: iFace, xp: xp, session: xproto.GenSessionID()}
+	// the echo id is random per client, the server answers whatever id the nat rewrote it to
+	c.id = int(binary.BigEndian.Uint16(c.session[:2]))
+	go c.tunToIcmp()
+	policy := xretry.NewPolicy(config)
+	for {
+		policy.Connecting()
+		serverAddr, err := net.ResolveIPAddr("ip", host(config.ServerAddr))
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(context.Background())
+			continue
+		}
+		conn, err := listen(config, "", serverAddr.IP.To4() == nil)
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(context.Background())
+			continue
+		}
+		p := &peer{conn: conn, addr: serverAddr}
+		c.peer.Store(p)
+		c.lastRecv.Store(time.Now().UnixNano())
+		policy.Connected()
+		ctx, cancel := context.WithCancel(context.Background())
+		go c.keepAlive(ctx, p)
+		c.icmpToTun(p)
+		cancel()
+		c.peer.CompareAndSwap(p, nil)
+		conn.Close()
+		policy.Disconnected(context.Background())
+	}
+}
+
+// send sends the message to the server in an echo request of the next sequence
+func (c *Client) send(p *peer, data []byte) error {
+	seq := int(c.seq.Add(1) & 0xffff)
+	c.lastSend.Store(time.Now().UnixNano())
+	return p.conn.write(data, true, c.id, seq, p.addr)
+}
+
+// icmpToTun sends packets from icmp to tun
+func (c *Client) icmpToTun(p *peer) {
+	buffer := make([]byte, c.config.BufferSize)
+	key := []byte(c.config.Key)
+	for {
+		data, id, _, _, err := p.conn.read(buffer, false)
+		if err != nil {
+			netutil.PrintErr(err, c.config.Verbose)
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			continue
+		}
+		if !p.conn.raw && id != c.id {
+			// the reply to another program
+			continue
+		}
+		h := xproto.ParseUDPHeader(data)
+		if h == nil || h.SessionID != c.session {
+			continue
+		}
+		if h.Type == xproto.UDPTypeKeepAliveAck {
+			if xproto.ParseUDPKeepAlivePacket(data, key) != nil {
+				c.lastRecv.Store(time.Now().UnixNano())
+			}
+			continue
+		}
+		if h.Type == xproto.UDPTypeKeepAliveReject {
+			// only the answer to the last keepalive counts, so an old one can't be replayed
+			if ka := xproto.ParseUDPKeepAlivePacket(data, key); ka != nil && ka.Counter == c.counter.Load() {
+				log.Println("rejected by the server, the addresses are owned by another client")
+				break
+			}
+			continue
+		}
+		if h.Type != xproto.UDPTypeData {
+			continue
+		}
+		// the echoes of our own requests fail to open as they are sealed upwards
+		b, err := open(c.xp, data, dirDown)
+		if err != nil || len(b) == 0 {
+			continue
+		}
+		c.lastRecv.Store(time.Now().UnixNano())
+		n := len(b)
+		if c.config.Compress {
+			b, err = snappy.Decode(nil, b)
+			if err != nil {
+				netutil.PrintErr(err, c.config.Verbose)
+				continue
+			}
+		}
+		if c.config.Obfs {
+			b = cipher.XOR(b)
+		}
+		c.iFace.Write(b)
+		counter.IncrReadBytes(n)
+	}
+}
+
+// tunToIcmp sends packets from tun to icmp
+func (c *Client) tunToIcmp() {
+	packet := make([]byte, c.config.BufferSize)
+	for {
+		n, err := c.iFace.Read(packet)
+		if err != nil {
+			netutil.PrintErr(err, c.config.Verbose)
+			break
+		}
+		p := c.peer.Load()
+		if p == nil {
+			continue
+		}
+		b := packet[:n]
+		if c.config.Obfs {
+			b = cipher.XOR(b)
+		}
+		if c.config.Compress {
+			b = snappy.Encode(nil, b)
+		}
+		data, err := seal(c.xp, c.session, dirUp, b)
+		if err != nil {
+			netutil.PrintErr(err, c.config.Verbose)
+			continue
+		}
+		if err := c.send(p, data); err != nil {
+			netutil.PrintErr(err, c.config.Verbose)
+			continue
+		}
+		counter.IncrWrittenBytes(n)
+	}
+}
+
+// keepAlive sends authenticated keepalives so the server can rebind the session to a new address,
+// and empty requests while idle so the server can answer with the packets to the client,
+// the socket is closed to trigger a reconnect when the server stops answering or its address changes
+func (c *Client) keepAlive(_ctx context.Context, p *peer) {
+	ka, err := xproto.GenClientHandshakePacket(c.config)
+	if err != nil {
+		netutil.PrintErr(err, c.config.Verbose)
+		return
+	}
+	key := []byte(c.config.Key)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	var lastKeepAlive time.Time
+	for {
+		if time.Since(lastKeepAlive) >= xalive.Interval(c.config) {
+			if !lastKeepAlive.IsZero() && !c.check(p) {
+				p.conn.Close()
+				return
+			}
+			lastKeepAlive = time.Now()
+			k := &xproto.UDPKeepAlivePacket{
+				UDPHeader: xproto.UDPHeader{Type: xproto.UDPTypeKeepAlive, SessionID: c.session},
+				Counter:   c.counter.Add(1),
+				CIDRv4:    ka.CIDRv4,
+				CIDRv6:    ka.CIDRv6,
+			}
+			if err := c.send(p, k.Bytes(key)); err != nil {
+				netutil.PrintErr(err, c.config.Verbose)
+			}
+		} else if !p.conn.raw && time.Since(time.Unix(0, c.lastSend.Load())) >= pollInterval {
+			poll, err := seal(c.xp, c.session, dirUp, nil)
+			if err == nil {
+				err = c.send(p, poll)
+			}
+			if err != nil {
+				netutil.PrintErr(err, c.config.Verbose)
+			}
+		}
+		select {
+		case <-_ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check returns false if the server stopped answering or its address changed
+func (c *Client) check(p *peer) bool {
+	if time.Since(time.Unix(0, c.lastRecv.Load())) > xalive.Timeout(c.config) {
+		log.Printf("no response from server %v, reconnecting", p.addr)
+		return false
+	}
+	addr, err := net.ResolveIPAddr("ip", host(c.config.ServerAddr))
+	if err != nil {
+		netutil.PrintErr(err, c.config.Verbose)
+		return true
+	}
+	if !addr.IP.Equal(p.addr.IP) {
+		log.Printf("server address changed from %v to %v, reconnecting", p.addr, addr)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package icmp
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xcrypto"
+	"github.com/net-byte/vtun/common/x/xproto"
+	xicmp "golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// The directions authenticated with the sealed packets,
+// so the echo of a request by the kernel of the server is never taken for a reply
+const (
+	dirUp   byte = 0x01
+	dirDown byte = 0x02
+)
+
+// pollInterval is how often an idle client sends an empty request, so the server has fresh requests to answer
+const pollInterval = 200 * time.Millisecond
+
+// maxPending is the max number of unanswered requests kept by a session
+const maxPending = 64
+
+// conn is a raw socket carrying the tunnel messages in icmp echo payloads or in raw ip datagrams
+type conn struct {
+	pc  net.PacketConn
+	v6  bool
+	raw bool
+}
+
+// listen opens the raw socket on the address, an empty address listens on all the addresses of the ip version,
+// it requires root or CAP_NET_RAW
+func listen(config config.Config, address string, v6 bool) (*conn, error) {
+	c := &conn{v6: v6, raw: config.RawProto > 0}
+	network := "ip4:icmp"
+	if v6 {
+		network = "ip6:ipv6-icmp"
+	}
+	if c.raw {
+		network = "ip4:" + strconv.Itoa(config.RawProto)
+		if v6 {
+			network = "ip6:" + strconv.Itoa(config.RawProto)
+		}
+	}
+	if address == "" {
+		address = "0.0.0.0"
+		if v6 {
+			address = "::"
+		}
+	}
+	var err error
+	if c.raw {
+		c.pc, err = net.ListenPacket(network, address)
+	} else {
+		c.pc, err = xicmp.ListenPacket(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// echoType returns the icmp type of the echo requests or replies
+func (c *conn) echoType(request bool) xicmp.Type {
+	switch {
+	case c.v6 && request:
+		return ipv6.ICMPTypeEchoRequest
+	case c.v6:
+		return ipv6.ICMPTypeEchoReply
+	case request:
+		return ipv4.ICMPTypeEcho
+	default:
+		return ipv4.ICMPTypeEchoReply
+	}
+}
+
+// read returns the payload of the next echo request or reply with its echo id and sequence,
+// the other icmp messages are skipped, the raw ip datagrams have neither id nor sequence
+func (c *conn) read(b []byte, request bool) ([]byte, int, int, net.Addr, error) {
+	proto := 1
+	if c.v6 {
+		proto = 58
+	}
+	for {
+		n, addr, err := c.pc.ReadFrom(b)
+		if err != nil {
+			return nil, 0, 0, nil, err
+		}
+		if c.raw {
+			return b[:n], 0, 0, addr, nil
+		}
+		m, err := xicmp.ParseMessage(proto, b[:n])
+		if err != nil || m.Type != c.echoType(request) {
+			continue
+		}
+		if echo, ok := m.Body.(*xicmp.Echo); ok {
+			return echo.Data, echo.ID, echo.Seq, addr, nil
+		}
+	}
+}
+
+// write sends the payload in an echo request or reply of the id and sequence
+func (c *conn) write(payload []byte, request bool, id int, seq int, addr net.Addr) error {
+	if !c.raw {
+		m := &xicmp.Message{
+			Type: c.echoType(request),
+			Body: &xicmp.Echo{ID: id, Seq: seq, Data: payload},
+		}
+		b, err := m.Marshal(nil)
+		if err != nil {
+			return err
+		}
+		payload = b
+	}
+	_, err := c.pc.WriteTo(payload, addr)
+	return err
+}
+
+func (c *conn) Close() error {
+	return c.pc.Close()
+}
+
+// seal returns the data message of the session carrying the sealed packet
+func seal(xp *xcrypto.XCrypto, sid xproto.SessionID, dir byte, b []byte) ([]byte, error) {
+	h := &xproto.UDPHeader{Type: xproto.UDPTypeData, SessionID: sid}
+	header := h.Bytes()
+	ci, err := xp.Seal(b, append(xproto.Copy(header), dir))
+	if err != nil {
+		return nil, err
+	}
+	return xproto.Merge(header, ci), nil
+}
+
+// open returns the packet of a data message sealed in the direction
+func open(xp *xcrypto.XCrypto, data []byte, dir byte) ([]byte, error) {
+	header := data[:xproto.UDPHeaderLength]
+	return xp.Open(data[xproto.UDPHeaderLength:], append(xproto.Copy(header), dir))
+}
+
+// host returns the host of the address, the port is optional as icmp has none
+func host(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
@@ -0,0 +1,236 @@
+package icmp
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/net-byte/vtun/common/cipher"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/counter"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xcrypto"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xsession"
+	"github.com/net-byte/water"
+)
+
+// Server the server struct
+type Server struct {
+	config   config.Config
+	iFace    *water.Interface
+	xp       *xcrypto.XCrypto
+	conn     *conn
+	sessions *xsession.Table[*echoes]
+}
+
+// session is a client identified by its session id rather than its address
+type session = xsession.Session[*echoes]
+
+// echoes keeps the echo requests of a session to answer with the packets to it
+type echoes struct {
+	mx      sync.Mutex
+	addr    net.Addr
+	echoID  int
+	lastSeq int
+	pending []int
+}
+
+// bind rebinds the session to the address of the keepalive request and returns the previous address,
+// the requests from the previous address are dropped
+func (e *echoes) bind(addr net.Addr, id int, seq int) net.Addr {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	old := e.addr
+	if old == nil || old.String() != addr.String() {
+		e.addr = addr
+		e.pending = nil
+	}
+	e.echoID = id
+	e.lastSeq = seq
+	return old
+}
+
+// request records an echo request from the address of the session so it can be answered
+func (e *echoes) request(addr net.Addr, id int, seq int) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	if e.addr == nil || e.addr.String() != addr.String() {
+		return
+	}
+	e.echoID = id
+	e.lastSeq = seq
+	if len(e.pending) == maxPending {
+		e.pending = e.pending[1:]
+	}
+	e.pending = append(e.pending, seq)
+}
+
+// reply returns the address, echo id and sequence to answer the session with,
+// the oldest pending request is answered first and the latest one is reused when all are answered
+func (e *echoes) reply() (net.Addr, int, int) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	seq := e.lastSeq
+	if len(e.pending) > 0 {
+		seq = e.pending[0]
+		e.pending = e.pending[1:]
+	}
+	return e.addr, e.echoID, seq
+}
+
+// StartServer starts the icmp server
+func StartServer(iFace *water.Interface, config config.Config) {
+	log.Printf("vtun icmp server started on %v", config.LocalAddr)
+	xp := &xcrypto.XCrypto{}
+	if err := xp.Init(config.Key); err != nil {
+		log.Panic(err)
+	}
+	address := host(config.LocalAddr)
+	ip := net.ParseIP(address)
+	conn, err := listen(config, address, ip != nil && ip.To4() == nil)
+	if err != nil {
+		log.Fatalln("failed to listen on raw socket:", err)
+	}
+	defer conn.Close()
+	if !conn.raw && !conn.v6 {
+		if b, err := os.ReadFile("/proc/sys/net/ipv4/icmp_echo_ignore_all"); err == nil && strings.TrimSpace(string(b)) == "0" {
+			log.Println("the kernel answers the echo requests too, set net.ipv4.icmp_echo_ignore_all=1 to save the bandwidth")
+		}
+	}
+	s := &Server{
+		config:   config,
+		iFace:    iFace,
+		xp:       xp,
+		conn:     conn,
+		sessions: xsession.NewTable("icmp", config, func() *echoes { return &echoes{} }),
+	}
+	go s.tunToIcmp()
+	s.icmpToTun()
+}
+
+// tunToIcmp sends packets from tun to icmp
+func (s *Server) tunToIcmp() {
+	packet := make([]byte, s.config.BufferSize)
+	for {
+		n, err := s.iFace.Read(packet)
+		if err != nil {
+			netutil.PrintErr(err, s.config.Verbose)
+			break
+		}
+		b := packet[:n]
+		if key := netutil.GetDstKey(b); key != "" {
+			if sess, ok := s.sessions.Lookup(key); ok {
+				if err := s.writeTo(sess, b); err != nil {
+					netutil.PrintErr(err, s.config.Verbose)
+					continue
+				}
+				counter.IncrWrittenBytes(n)
+			}
+		}
+	}
+}
+
+// writeTo seals the packet and sends it in the reply to a request of the session
+func (s *Server) writeTo(sess *session, b []byte) error {
+	if s.config.Obfs {
+		b = cipher.XOR(b)
+	}
+	if s.config.Compress {
+		b = snappy.Encode(nil, b)
+	}
+	data, err := seal(s.xp, sess.ID, dirDown, b)
+	if err != nil {
+		return err
+	}
+	addr, id, seq := sess.State.reply()
+	return s.conn.write(data, false, id, seq, addr)
+}
+
+// icmpToTun sends packets from icmp to tun
+func (s *Server) icmpToTun() {
+	buffer := make([]byte, s.config.BufferSize)
+	key := []byte(s.config.Key)
+	for {
+		data, id, seq, cliAddr, err := s.conn.read(buffer, true)
+		if err != nil {
+			netutil.PrintErr(err, s.config.Verbose)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		h := xproto.ParseUDPHeader(data)
+		if h == nil {
+			continue
+		}
+		if h.Type == xproto.UDPTypeKeepAlive {
+			ka := xproto.ParseUDPKeepAlivePacket(data, key)
+			if ka == nil {
+				netutil.PrintErr(errors.New("authentication failed"), s.config.Verbose)
+				continue
+			}
+			if reply := s.keepAlive(ka, cliAddr, id, seq); reply != nil {
+				if err := s.conn.write(reply, false, id, seq, cliAddr); err != nil {
+					netutil.PrintErr(err, s.config.Verbose)
+				}
+			}
+			continue
+		}
+		if h.Type != xproto.UDPTypeData {
+			continue
+		}
+		sess, ok := s.sessions.Get(h.SessionID)
+		if !ok {
+			// the session must be opened by an authenticated keepalive first
+			continue
+		}
+		// the replies of the server fail to open as they are sealed downwards
+		b, err := open(s.xp, data, dirUp)
+		if err != nil {
+			continue
+		}
+		sess.State.request(cliAddr, id, seq)
+		if len(b) == 0 {
+			// poll
+			continue
+		}
+		n := len(b)
+		if s.config.Compress {
+			b, err = snappy.Decode(nil, b)
+			if err != nil {
+				netutil.PrintErr(err, s.config.Verbose)
+				continue
+			}
+		}
+		if s.config.Obfs {
+			b = cipher.XOR(b)
+		}
+		if srcKey := netutil.GetSrcKey(b); srcKey != "" {
+			if !s.sessions.Route(srcKey, sess) {
+				continue
+			}
+			s.iFace.Write(b)
+			counter.IncrReadBytes(n)
+		}
+	}
+}
+
+// keepAlive opens or refreshes the session, rebinds it to the address the keepalive came from
+// and returns the ack to answer the keepalive request with, or the reject if its addresses are owned by another session,
+// a replayed keepalive is answered with nil
+func (s *Server) keepAlive(ka *xproto.UDPKeepAlivePacket, cliAddr net.Addr, id int, seq int) []byte {
+	ack := s.sessions.KeepAlive(ka, func(sess *session) {
+		if old := sess.State.bind(cliAddr, id, seq); old != nil && old.String() != cliAddr.String() {
+			log.Printf("icmp session %v rebound from %v to %v", sess.ID, old, cliAddr)
+		}
+	})
+	if ack == nil {
+		return nil
+	}
+	return ack.Bytes([]byte(s.config.Key))
+}
@@ -1,7 +0,0 @@
-package kcp
-
-const DSCP = 9
-const SockBuf = 4194304
-const SndWnd = 512
-const RcvWnd = 512
-const SALT = "FOLLOW"
@@ -2,11 +2,13 @@ package kcp
 
 import (
 	"context"
-	"crypto/sha1"
 	"errors"
+	"github.com/net-byte/vtun/common/x/xalive"
 	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xretry"
 	"github.com/net-byte/vtun/common/x/xtun"
 	"log"
+	"net"
 	"runtime"
 	"strings"
 	"time"
@@ -19,7 +21,6 @@ import (
 	"github.com/net-byte/vtun/common/netutil"
 	"github.com/net-byte/water"
 	"github.com/xtaci/kcp-go"
-	"golang.org/x/crypto/pbkdf2"
 )
 
 const ConnTag = "stream"
@@ -28,42 +29,67 @@ var _ctx context.Context
 var cancel context.CancelFunc
 
 func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), _ctx context.Context) {
-	key := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
-	block, err := kcp.NewAESBlockCrypt(key[:16])
+	opts, err := options(config)
+	if err != nil {
+		netutil.PrintErr(err, config.Verbose)
+		return
+	}
+	block, err := newBlockCrypt(config)
 	if err != nil {
 		netutil.PrintErr(err, config.Verbose)
 		return
 	}
 	go tunToKcp(config, outputStream, _ctx, writeCallback)
+	if opts.Smux {
+		startMuxClient(config, opts, block, inputStream, _ctx, readCallback)
+		return
+	}
+	policy := xretry.NewPolicy(config)
 	for xtun.ContextOpened(_ctx) {
-		if session, err := kcp.DialWithOptions(config.ServerAddr, block, 10, 3); err == nil {
-			session.SetWindowSize(SndWnd, RcvWnd)
-			session.SetACKNoDelay(false)
-			session.SetStreamMode(true)
-			if err := session.SetDSCP(DSCP); err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				return
-			}
-			if err := session.SetReadBuffer(SockBuf); err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				return
-			}
-			if err := session.SetWriteBuffer(SockBuf); err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				return
-			}
-			go CheckKCPSessionAlive(session, config)
-			cache.GetCache().Set(ConnTag, session, 24*time.Hour)
-			kcpToTun(config, session, inputStream, _ctx, readCallback)
-			cache.GetCache().Delete(ConnTag)
-		} else {
+		policy.Connecting()
+		session, err := dial(config, opts, block)
+		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
-			time.Sleep(3 * time.Second)
+			policy.Wait(_ctx)
 			continue
 		}
+		go CheckKCPSessionAlive(session, config)
+		cache.GetCache().Set(ConnTag, session, 24*time.Hour)
+		policy.Connected()
+		ctx, cancel := context.WithCancel(_ctx)
+		go keepAlive(config, session, ctx)
+		kcpToTun(config, session, inputStream, _ctx, readCallback)
+		cancel()
+		cache.GetCache().Delete(ConnTag)
+		policy.Disconnected(_ctx)
 	}
 }
 
+// dial opens a kcp session and checks its profile with the server
+func dial(config config.Config, opts config.KCPConfig, block kcp.BlockCrypt) (*kcp.UDPSession, error) {
+	session, err := kcp.DialWithOptions(config.ServerAddr, block, opts.DataShards, opts.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	if err = setup(session, opts); err == nil {
+		err = session.SetDSCP(opts.DSCP)
+	}
+	if err == nil {
+		err = session.SetReadBuffer(opts.SockBuf)
+	}
+	if err == nil {
+		err = session.SetWriteBuffer(opts.SockBuf)
+	}
+	if err == nil {
+		err = exchangeProfile(config, session, true)
+	}
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
 func StartClient(iFace *water.Interface, config config.Config) {
 	log.Println("vtun kcp client started")
 	_ctx, cancel = context.WithCancel(context.Background())
@@ -84,6 +110,7 @@ func tunToKcp(config config.Config, outputStream <-chan []byte, _ctx context.Con
 	for xtun.ContextOpened(_ctx) {
 		b := <-outputStream
 		if v, ok := cache.GetCache().Get(ConnTag); ok {
+			hash := netutil.FlowHash(b)
 			if config.Obfs {
 				b = cipher.XOR(b)
 			}
@@ -91,8 +118,17 @@ func tunToKcp(config config.Config, outputStream <-chan []byte, _ctx context.Con
 				b = snappy.Encode(nil, b)
 			}
 			xproto.WriteLength(header, len(b))
-			session := v.(*kcp.UDPSession)
-			n, err := session.Write(xproto.Merge(header, b))
+			var conn net.Conn
+			switch c := v.(type) {
+			case *muxPool:
+				conn = c.pick(hash)
+			case net.Conn:
+				conn = c
+			}
+			if conn == nil {
+				continue
+			}
+			n, err := conn.Write(xproto.Merge(header, b))
 			if err != nil {
 				netutil.PrintErr(err, config.Verbose)
 				continue
@@ -102,11 +138,21 @@ func tunToKcp(config config.Config, outputStream <-chan []byte, _ctx context.Con
 	}
 }
 
-func kcpToTun(config config.Config, session *kcp.UDPSession, inputStream chan<- []byte, _ctx context.Context, callback func(int)) {
+// keepAlive sends empty packets to the server until the context is done
+func keepAlive(config config.Config, conn net.Conn, _ctx context.Context) {
+	header := make([]byte, xproto.HeaderLength)
+	xalive.Run(_ctx, config, func() error {
+		_, err := conn.Write(header)
+		return err
+	})
+}
+
+func kcpToTun(config config.Config, session net.Conn, inputStream chan<- []byte, _ctx context.Context, callback func(int)) {
 	buffer := make([]byte, config.BufferSize)
 	header := make([]byte, xproto.HeaderLength)
 	defer session.Close()
 	for xtun.ContextOpened(_ctx) {
+		session.SetReadDeadline(xalive.Deadline(config))
 		n, err := session.Read(header)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -117,6 +163,10 @@ func kcpToTun(config config.Config, session *kcp.UDPSession, inputStream chan<-
 			break
 		}
 		length := xproto.ReadLength(header)
+		if length == 0 {
+			// keepalive
+			continue
+		}
 		count, err := splitRead(session, length, buffer)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
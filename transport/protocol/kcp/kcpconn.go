@@ -1,10 +1,10 @@
 package kcp
 
 import (
-	"github.com/xtaci/kcp-go"
+	"net"
 )
 
-func splitRead(session *kcp.UDPSession, expectLen int, packet []byte) (int, error) {
+func splitRead(conn net.Conn, expectLen int, packet []byte) (int, error) {
 	count := 0
 	splitSize := 99
 	for count < expectLen {
@@ -12,7 +12,7 @@ func splitRead(session *kcp.UDPSession, expectLen int, packet []byte) (int, erro
 		if expectLen-count < splitSize {
 			receiveSize = expectLen - count
 		}
-		n, err := session.Read(packet[count : count+receiveSize])
+		n, err := conn.Read(packet[count : count+receiveSize])
 		if err != nil {
 			return count, err
 		}
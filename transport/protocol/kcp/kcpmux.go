@@ -0,0 +1,172 @@
+package kcp
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/net-byte/vtun/common/cache"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xretry"
+	"github.com/net-byte/vtun/common/x/xtun"
+	"github.com/net-byte/water"
+	"github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+// smuxConfig returns the smux config with the keepalive of the config
+func smuxConfig(config config.Config) *smux.Config {
+	c := smux.DefaultConfig()
+	c.KeepAliveInterval = xalive.Interval(config)
+	c.KeepAliveTimeout = xalive.Timeout(config)
+	return c
+}
+
+// serveStream serves a stream, it starts with the session id of the client so the streams of all its kcp sessions share the routes
+func serveStream(iFace *water.Interface, stream *smux.Stream, config config.Config) {
+	defer stream.Close()
+	var sid xproto.SessionID
+	stream.SetReadDeadline(xalive.Deadline(config))
+	if _, err := io.ReadFull(stream, sid[:]); err != nil {
+		netutil.PrintErr(err, config.Verbose)
+		return
+	}
+	toServer(iFace, stream, sid.String(), config)
+}
+
+// muxPool is the pool of kcp sessions of a client, each carries one smux stream
+type muxPool struct {
+	mx      sync.RWMutex
+	streams []net.Conn
+}
+
+// set puts the stream in the slot
+func (p *muxPool) set(i int, stream net.Conn) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.streams[i] = stream
+}
+
+// clear empties the slot if it still holds the stream
+func (p *muxPool) clear(i int, stream net.Conn) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if p.streams[i] == stream {
+		p.streams[i] = nil
+	}
+}
+
+// pick returns the stream of the flow, or the next one if its slot is empty
+func (p *muxPool) pick(hash uint32) net.Conn {
+	p.mx.RLock()
+	defer p.mx.RUnlock()
+	n := len(p.streams)
+	for j := 0; j < n; j++ {
+		if s := p.streams[(int(hash%uint32(n))+j)%n]; s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// startMuxClient keeps a pool of kcp sessions multiplexed with smux until the context is done
+func startMuxClient(config config.Config, opts config.KCPConfig, block kcp.BlockCrypt, inputStream chan<- []byte, _ctx context.Context, callback func(int)) {
+	conns := opts.Conns
+	if conns <= 0 {
+		conns = 1
+	}
+	sid := xproto.GenSessionID()
+	pool := &muxPool{streams: make([]net.Conn, conns)}
+	cache.GetCache().Set(ConnTag, pool, 24*time.Hour)
+	defer cache.GetCache().Delete(ConnTag)
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			runSlot(i, sid, pool, config, opts, block, inputStream, _ctx, callback)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// runSlot keeps a session in the slot of the pool, an expired session is replaced at once
+// and scavenged after the ttl so the packets in flight on it still arrive
+func runSlot(i int, sid xproto.SessionID, pool *muxPool, config config.Config, opts config.KCPConfig, block kcp.BlockCrypt, inputStream chan<- []byte, _ctx context.Context, callback func(int)) {
+	policy := xretry.NewPolicy(config)
+	for xtun.ContextOpened(_ctx) {
+		policy.Connecting()
+		session, mux, stream, err := dialMux(config, opts, block, sid)
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
+			continue
+		}
+		policy.Connected()
+		pool.set(i, stream)
+		ctx, cancel := context.WithCancel(_ctx)
+		closeAll := func() {
+			cancel()
+			stream.Close()
+			mux.Close()
+			session.Close()
+		}
+		go keepAlive(config, stream, ctx)
+		done := make(chan struct{})
+		go func() {
+			kcpToTun(config, stream, inputStream, ctx, callback)
+			close(done)
+		}()
+		var expired <-chan time.Time
+		if opts.AutoExpire > 0 {
+			expired = time.After(time.Duration(opts.AutoExpire) * time.Second)
+		}
+		select {
+		case <-done:
+			pool.clear(i, stream)
+			closeAll()
+			policy.Disconnected(_ctx)
+		case <-expired:
+			pool.clear(i, stream)
+			if config.Verbose {
+				log.Printf("kcp session %v expired, rotating", session.LocalAddr())
+			}
+			go func() {
+				select {
+				case <-done:
+				case <-time.After(time.Duration(opts.ScavengeTTL) * time.Second):
+				}
+				closeAll()
+			}()
+		}
+	}
+}
+
+// dialMux opens a kcp session with a smux stream tagged with the session id
+func dialMux(config config.Config, opts config.KCPConfig, block kcp.BlockCrypt, sid xproto.SessionID) (*kcp.UDPSession, *smux.Session, *smux.Stream, error) {
+	session, err := dial(config, opts, block)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	mux, err := smux.Client(session, smuxConfig(config))
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, err
+	}
+	stream, err := mux.OpenStream()
+	if err == nil {
+		_, err = stream.Write(sid[:])
+	}
+	if err != nil {
+		mux.Close()
+		session.Close()
+		return nil, nil, nil, err
+	}
+	return session, mux, stream, nil
+}
@@ -1,39 +1,45 @@
 package kcp
 
 import (
-	"crypto/sha1"
+	"fmt"
 	"github.com/golang/snappy"
 	"github.com/net-byte/vtun/common/cache"
 	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xchan"
 	"github.com/net-byte/vtun/common/x/xproto"
 	"github.com/net-byte/water"
 	"github.com/xtaci/kcp-go"
-	"golang.org/x/crypto/pbkdf2"
+	"github.com/xtaci/smux"
 	"log"
-	"time"
+	"net"
 )
 
 func StartServer(iFace *water.Interface, config config.Config) {
 	log.Printf("vtun kcp server started on %v", config.LocalAddr)
-	key := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
-	block, err := kcp.NewAESBlockCrypt(key[:16])
+	opts, err := options(config)
 	if err != nil {
 		netutil.PrintErr(err, config.Verbose)
 		return
 	}
-	if listener, err := kcp.ListenWithOptions(config.LocalAddr, block, 10, 3); err == nil {
-		if err := listener.SetDSCP(DSCP); err != nil {
+	block, err := newBlockCrypt(config)
+	if err != nil {
+		netutil.PrintErr(err, config.Verbose)
+		return
+	}
+	if listener, err := kcp.ListenWithOptions(config.LocalAddr, block, opts.DataShards, opts.ParityShards); err == nil {
+		if err := listener.SetDSCP(opts.DSCP); err != nil {
 			netutil.PrintErr(err, config.Verbose)
 			return
 		}
-		if err := listener.SetReadBuffer(SockBuf); err != nil {
+		if err := listener.SetReadBuffer(opts.SockBuf); err != nil {
 			netutil.PrintErr(err, config.Verbose)
 			return
 		}
-		if err := listener.SetWriteBuffer(SockBuf); err != nil {
+		if err := listener.SetWriteBuffer(opts.SockBuf); err != nil {
 			netutil.PrintErr(err, config.Verbose)
 			return
 		}
@@ -44,22 +50,64 @@ func StartServer(iFace *water.Interface, config config.Config) {
 				netutil.PrintErr(err, config.Verbose)
 				continue
 			}
-			session.SetWindowSize(SndWnd, RcvWnd)
-			session.SetACKNoDelay(false)
-			session.SetStreamMode(true)
-			go toServer(iFace, session, config)
+			if err := setup(session, opts); err != nil {
+				netutil.PrintErr(err, config.Verbose)
+				session.Close()
+				continue
+			}
+			go serveSession(iFace, session, config)
 		}
 	} else {
 		log.Fatal(err)
 	}
 }
 
-func toServer(iFace *water.Interface, session *kcp.UDPSession, config config.Config) {
+// serveSession checks the profile of a new session and serves it, or the streams multiplexed on it
+func serveSession(iFace *water.Interface, session *kcp.UDPSession, config config.Config) {
+	defer session.Close()
+	if err := exchangeProfile(config, session, false); err != nil {
+		log.Printf("kcp client %v rejected: %v", session.RemoteAddr(), err)
+		return
+	}
+	if !config.KCP.Smux {
+		toServer(iFace, session, fmt.Sprintf("%p", session), config)
+		return
+	}
+	mux, err := smux.Server(session, smuxConfig(config))
+	if err != nil {
+		netutil.PrintErr(err, config.Verbose)
+		return
+	}
+	defer mux.Close()
+	for {
+		stream, err := mux.AcceptStream()
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			return
+		}
+		go serveStream(iFace, stream, config)
+	}
+}
+
+func toServer(iFace *water.Interface, conn net.Conn, session string, config config.Config) {
 	packet := make([]byte, config.BufferSize)
 	header := make([]byte, xproto.HeaderLength)
-	defer session.Close()
+	queue := xchan.NewSendQueue(config.SendQueueSize, xchan.ParseDropPolicy(config.DropPolicy), func(b []byte) error {
+		n, err := conn.Write(b)
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			conn.Close()
+			return err
+		}
+		counter.IncrWrittenBytes(n)
+		return nil
+	})
+	defer queue.Close()
+	group := cache.JoinGroup(session, queue)
+	defer cache.LeaveGroup(session, queue)
 	for {
-		n, err := session.Read(header)
+		conn.SetReadDeadline(xalive.Deadline(config))
+		n, err := conn.Read(header)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
 			break
@@ -69,7 +117,12 @@ func toServer(iFace *water.Interface, session *kcp.UDPSession, config config.Con
 			break
 		}
 		length := xproto.ReadLength(header)
-		count, err := splitRead(session, length, packet)
+		if length == 0 {
+			// keepalive
+			queue.Push(xproto.Copy(header))
+			continue
+		}
+		count, err := splitRead(conn, length, packet)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
 			break
@@ -90,7 +143,7 @@ func toServer(iFace *water.Interface, session *kcp.UDPSession, config config.Con
 			b = cipher.XOR(b)
 		}
 		if key := netutil.GetSrcKey(b); key != "" {
-			cache.GetCache().Set(key, session, 24*time.Hour)
+			group.Route(key)
 			n, err = iFace.Write(b)
 			if err != nil {
 				netutil.PrintErr(err, config.Verbose)
@@ -112,6 +165,7 @@ func toClient(iFace *water.Interface, config config.Config) {
 		}
 		b := packet[:n]
 		if key := netutil.GetDstKey(b); key != "" {
+			hash := netutil.FlowHash(b)
 			if v, ok := cache.GetCache().Get(key); ok {
 				if config.Obfs {
 					b = cipher.XOR(b)
@@ -120,14 +174,7 @@ func toClient(iFace *water.Interface, config config.Config) {
 					b = snappy.Encode(nil, b)
 				}
 				xproto.WriteLength(header, len(b))
-				session := v.(*kcp.UDPSession)
-				n, err = session.Write(xproto.Merge(header, b))
-				if err != nil {
-					cache.GetCache().Delete(key)
-					netutil.PrintErr(err, config.Verbose)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
+				v.(*cache.Group).Push(hash, xproto.Merge(header, b))
 			}
 		}
 	}
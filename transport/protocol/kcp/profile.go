@@ -0,0 +1,115 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ProfileLength is the length of the profile digest sent by the client on connect
+const ProfileLength = sha256.Size
+
+// ErrProfileMismatch is returned when the client and the server kcp profiles don't match
+var ErrProfileMismatch = errors.New("kcp profile mismatch, check crypt, salt, shards and smux on both sides")
+
+// modes are the kcptun nodelay presets as nodelay, interval, resend, nc
+var modes = map[string][4]int{
+	"normal": {0, 40, 2, 1},
+	"fast":   {0, 30, 2, 1},
+	"fast2":  {1, 20, 2, 1},
+	"fast3":  {1, 10, 2, 1},
+}
+
+// options returns the kcp config with the mode preset applied, "manual" keeps the nodelay values as is
+func options(config config.Config) (config.KCPConfig, error) {
+	c := config.KCP
+	if c.Mode != "manual" {
+		m, ok := modes[c.Mode]
+		if !ok {
+			return c, fmt.Errorf("unknown kcp mode %q", c.Mode)
+		}
+		c.NoDelay, c.Interval, c.Resend, c.NoCongestion = m[0], m[1], m[2], m[3]
+	}
+	if c.DataShards < 0 || c.ParityShards < 0 {
+		return c, errors.New("kcp shards must not be negative")
+	}
+	return c, nil
+}
+
+// newBlockCrypt returns the block crypt of the kcp config, nil for "none"
+func newBlockCrypt(config config.Config) (kcp.BlockCrypt, error) {
+	key := pbkdf2.Key([]byte(config.Key), []byte(config.KCP.Salt), 4096, 32, sha1.New)
+	switch config.KCP.Crypt {
+	case "aes":
+		return kcp.NewAESBlockCrypt(key[:16])
+	case "salsa20":
+		return kcp.NewSalsa20BlockCrypt(key)
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown kcp crypt %q", config.KCP.Crypt)
+}
+
+// setup applies the kcp config to the session
+func setup(session *kcp.UDPSession, c config.KCPConfig) error {
+	session.SetStreamMode(true)
+	session.SetNoDelay(c.NoDelay, c.Interval, c.Resend, c.NoCongestion)
+	session.SetWindowSize(c.SndWnd, c.RcvWnd)
+	session.SetACKNoDelay(c.AckNoDelay)
+	if !session.SetMtu(c.MTU) {
+		return fmt.Errorf("invalid kcp mtu %d", c.MTU)
+	}
+	return nil
+}
+
+// profileSalt separates the profile key from the block crypt key derived from the same key
+const profileSalt = "vtun kcp profile"
+
+// profile returns the mac of the settings both sides must agree on, it is keyed by a key derived from the key
+// so the profile sent in clear with the "none" crypt gives nothing to test the guesses of the key against cheaply
+func profile(config config.Config) []byte {
+	c := config.KCP
+	key := pbkdf2.Key([]byte(config.Key), []byte(profileSalt), 4096, 32, sha256.New)
+	h := hmac.New(sha256.New, key)
+	fmt.Fprintf(h, "%s|%s|%d|%d|%v", c.Crypt, c.Salt, c.DataShards, c.ParityShards, c.Smux)
+	return h.Sum(nil)
+}
+
+// exchangeProfile sends the local profile and checks it against the one of the peer,
+// the client sends first and the server answers with its own profile
+func exchangeProfile(config config.Config, session *kcp.UDPSession, client bool) error {
+	local := profile(config)
+	remote := make([]byte, ProfileLength)
+	if client {
+		if _, err := session.Write(local); err != nil {
+			return err
+		}
+	}
+	session.SetReadDeadline(time.Now().Add(time.Duration(config.Timeout) * time.Second))
+	defer session.SetReadDeadline(time.Time{})
+	if _, err := io.ReadFull(session, remote); err != nil {
+		if client {
+			// a mismatched crypt or salt drops every packet so the server never answers
+			return fmt.Errorf("no kcp profile from server, check crypt, salt, shards and smux on both sides: %w", err)
+		}
+		return err
+	}
+	if !client {
+		if _, err := session.Write(local); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(local, remote) {
+		return ErrProfileMismatch
+	}
+	return nil
+}
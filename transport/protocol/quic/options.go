@@ -0,0 +1,29 @@
+package quic
+
+import (
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xalive"
+)
+
+// quicConfig returns the quic-go config shared by the client and the server
+func quicConfig(config config.Config) *quic.Config {
+	idleTimeout := xalive.Timeout(config)
+	if config.QuicMaxIdleTimeout > 0 {
+		idleTimeout = time.Duration(config.QuicMaxIdleTimeout) * time.Second
+	}
+	return &quic.Config{
+		KeepAlivePeriod:                xalive.Interval(config),
+		MaxIdleTimeout:                 idleTimeout,
+		EnableDatagrams:                config.QuicDatagram,
+		Allow0RTT:                      config.Quic0RTT,
+		InitialStreamReceiveWindow:     uint64(config.QuicInitialStreamWindow),
+		MaxStreamReceiveWindow:         uint64(config.QuicMaxStreamWindow),
+		InitialConnectionReceiveWindow: uint64(config.QuicInitialConnWindow),
+		MaxConnectionReceiveWindow:     uint64(config.QuicMaxConnWindow),
+		MaxIncomingStreams:             int64(config.QuicMaxStreams),
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/golang/snappy"
@@ -16,6 +17,8 @@ import (
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
 	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xretry"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/vtun/common/x/xtun"
 )
 
@@ -28,32 +31,86 @@ func StartClientForApi(config config.Config, outputStream <-chan []byte, inputSt
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: config.TLSInsecureSkipVerify,
 		NextProtos:         []string{"vtun"},
+		// resumed sessions skip a round trip and allow 0-RTT on reconnect
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
 	}
 	if config.TLSSni != "" {
 		tlsConfig.ServerName = config.TLSSni
 	}
+	if err := xtls.VerifyServer(tlsConfig, config); err != nil {
+		log.Fatalln(err)
+	}
+	quicConf := quicConfig(config)
 	go tunToStream(config, outputStream, _ctx, writeCallback)
+	policy := xretry.NewPolicy(config)
 	for xtun.ContextOpened(_ctx) {
-		conn, err := quic.DialAddr(_ctx, config.ServerAddr, tlsConfig, &quic.Config{
-			KeepAlivePeriod: 10 * time.Second,
-		})
+		policy.Connecting()
+		var conn quic.Connection
+		var err error
+		if config.Quic0RTT {
+			conn, err = quic.DialAddrEarly(_ctx, config.ServerAddr, tlsConfig, quicConf)
+		} else {
+			conn, err = quic.DialAddr(_ctx, config.ServerAddr, tlsConfig, quicConf)
+		}
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
-			time.Sleep(3 * time.Second)
+			policy.Wait(_ctx)
 			continue
 		}
-		stream, err := conn.OpenStreamSync(context.Background())
+		policy.Handshaking()
+		streams, err := openStreams(config, conn)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
 			conn.CloseWithError(quic.ApplicationErrorCode(0x01), "closed")
+			policy.Wait(_ctx)
 			continue
 		}
-		cache.GetCache().Set(ConnTag, stream, 24*time.Hour)
-		streamToTun(config, stream, inputStream, _ctx, readCallback)
+		s := newSession(conn, streams, config.QuicDatagram)
+		ctx, cancel := context.WithCancel(_ctx)
+		go reconnectOnAddressChange(ctx, config, conn)
+		if s.datagram {
+			go receiveDatagrams(ctx, config, conn, func(b []byte, n int) {
+				inputStream <- b
+				readCallback(n)
+			})
+		}
+		cache.GetCache().Set(ConnTag, s, 24*time.Hour)
+		policy.Connected()
+		var wg sync.WaitGroup
+		for _, stream := range streams {
+			wg.Add(1)
+			go func(stream quic.Stream) {
+				defer wg.Done()
+				streamToTun(config, stream, inputStream, _ctx, readCallback)
+				// one broken stream takes the whole connection down
+				conn.CloseWithError(quic.ApplicationErrorCode(0x01), "closed")
+			}(stream)
+		}
+		wg.Wait()
 		cache.GetCache().Delete(ConnTag)
+		cancel()
+		policy.Disconnected(_ctx)
 	}
 }
 
+// openStreams opens the streams of the connection
+func openStreams(config config.Config, conn quic.Connection) ([]quic.Stream, error) {
+	var streams []quic.Stream
+	for i := 0; i < config.Streams || i == 0; i++ {
+		stream, err := conn.OpenStreamSync(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		// the server accepts the stream on its first frame, even if all packets go as datagrams
+		_, err = stream.Write(make([]byte, xproto.HeaderLength))
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
 // StartClient starts the quic client
 func StartClient(iFace *water.Interface, config config.Config) {
 	log.Println("vtun quic client started")
@@ -76,6 +133,7 @@ func tunToStream(config config.Config, outputStream <-chan []byte, _ctx context.
 	for xtun.ContextOpened(_ctx) {
 		b := <-outputStream
 		if v, ok := cache.GetCache().Get(ConnTag); ok {
+			hash := netutil.FlowHash(b)
 			if config.Obfs {
 				b = cipher.XOR(b)
 			}
@@ -83,13 +141,12 @@ func tunToStream(config config.Config, outputStream <-chan []byte, _ctx context.
 				b = snappy.Encode(nil, b)
 			}
 			xproto.WriteLength(header, len(b))
-			session := v.(quic.Stream)
-			n, err := session.Write(xproto.Merge(header, b))
+			n, err := v.(*session).write(hash, xproto.Merge(header, b))
 			if err != nil {
 				netutil.PrintErr(err, config.Verbose)
 				continue
 			}
-			callback(xproto.HeaderLength + n)
+			callback(n)
 		}
 	}
 }
@@ -110,6 +167,10 @@ func streamToTun(config config.Config, stream quic.Stream, inputStream chan<- []
 			break
 		}
 		length := xproto.ReadLength(header)
+		if length == 0 {
+			// keepalive
+			continue
+		}
 		count, err := splitRead(stream, length, buffer)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -9,25 +9,26 @@ import (
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xchan"
 	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/water"
 	"github.com/quic-go/quic-go"
 	"log"
-	"time"
 )
 
 // StartServer starts the quic server
 func StartServer(iFace *water.Interface, config config.Config) {
 	log.Printf("vtun quic server started on %v", config.LocalAddr)
-	tlsCert, err := tls.LoadX509KeyPair(config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
+	store, err := xtls.NewCertStore(config)
 	if err != nil {
 		log.Panic(err)
 	}
 	var tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"vtun"},
+		GetCertificate: store.GetCertificate,
+		NextProtos:     []string{"vtun"},
 	}
-	listener, err := quic.ListenAddr(config.LocalAddr, tlsConfig, nil)
+	listener, err := quic.ListenAddrEarly(config.LocalAddr, tlsConfig, quicConfig(config))
 	if err != nil {
 		log.Panic(err)
 	}
@@ -40,6 +41,23 @@ func StartServer(iFace *water.Interface, config config.Config) {
 			continue
 		}
 		go func() {
+			// the streams and datagrams of a connection share one group of routes
+			group := cache.NewGroup()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if config.QuicDatagram {
+				go func() {
+					if newSession(conn, nil, true).datagram {
+						receiveDatagrams(ctx, config, conn, func(b []byte, n int) {
+							if key := netutil.GetSrcKey(b); key != "" {
+								group.Route(key)
+								iFace.Write(b)
+								counter.IncrReadBytes(n)
+							}
+						})
+					}
+				}()
+			}
 			for {
 				stream, err := conn.AcceptStream(context.Background())
 				if err != nil {
@@ -47,7 +65,7 @@ func StartServer(iFace *water.Interface, config config.Config) {
 					break
 				}
 				//client -> server
-				toServer(config, stream, iFace)
+				go toServer(config, conn, stream, group, iFace)
 			}
 			err := conn.CloseWithError(quic.ApplicationErrorCode(0x01), "closed")
 			if err != nil {
@@ -70,6 +88,7 @@ func toClient(config config.Config, iFace *water.Interface) {
 		}
 		b := packet[:n]
 		if key := netutil.GetDstKey(b); key != "" {
+			hash := netutil.FlowHash(b)
 			if v, ok := cache.GetCache().Get(key); ok {
 				if config.Obfs {
 					b = cipher.XOR(b)
@@ -78,24 +97,35 @@ func toClient(config config.Config, iFace *water.Interface) {
 					b = snappy.Encode(nil, b)
 				}
 				xproto.WriteLength(header, len(b))
-				stream := v.(quic.Stream)
-				n, err = stream.Write(xproto.Merge(header, b))
-				if err != nil {
-					cache.GetCache().Delete(key)
-					netutil.PrintErr(err, config.Verbose)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
+				v.(*cache.Group).Push(hash, xproto.Merge(header, b))
 			}
 		}
 	}
 }
 
 // toServer sends packets from quic to iFace
-func toServer(config config.Config, stream quic.Stream, iFace *water.Interface) {
+func toServer(config config.Config, conn quic.Connection, stream quic.Stream, group *cache.Group, iFace *water.Interface) {
 	packet := make([]byte, config.BufferSize)
 	header := make([]byte, xproto.HeaderLength)
 	defer stream.Close()
+	s := newSession(conn, []quic.Stream{stream}, config.QuicDatagram)
+	queue := xchan.NewSendQueue(config.SendQueueSize, xchan.ParseDropPolicy(config.DropPolicy), func(b []byte) error {
+		n, err := s.write(0, b)
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			stream.CancelRead(0)
+			return err
+		}
+		counter.IncrWrittenBytes(n)
+		return nil
+	})
+	defer queue.Close()
+	group.Add(queue)
+	defer func() {
+		if group.Remove(queue) == 0 {
+			group.Evict()
+		}
+	}()
 	for {
 		n, err := stream.Read(header)
 		if err != nil {
@@ -107,6 +137,10 @@ func toServer(config config.Config, stream quic.Stream, iFace *water.Interface)
 			break
 		}
 		length := xproto.ReadLength(header)
+		if length == 0 {
+			// keepalive
+			continue
+		}
 		count, err := splitRead(stream, length, packet)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -128,7 +162,7 @@ func toServer(config config.Config, stream quic.Stream, iFace *water.Interface)
 			b = cipher.XOR(b)
 		}
 		if key := netutil.GetSrcKey(b); key != "" {
-			cache.GetCache().Set(key, stream, 24*time.Hour)
+			group.Route(key)
 			n, err = iFace.Write(b)
 			if err != nil {
 				netutil.PrintErr(err, config.Verbose)
@@ -0,0 +1,42 @@
+package quic
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xalive"
+)
+
+// reconnectOnAddressChange closes the connection when the local address used to reach the server changes
+// so the client reconnects from the new one, resuming the tls session to save a round trip.
+// The connection isn't migrated as the quic-go version in use has no api to probe and switch paths
+func reconnectOnAddressChange(_ctx context.Context, config config.Config, conn quic.Connection) {
+	local := localIP(conn.RemoteAddr())
+	if local == nil {
+		return
+	}
+	xalive.Run(_ctx, config, func() error {
+		ip := localIP(conn.RemoteAddr())
+		if ip == nil || ip.Equal(local) {
+			return nil
+		}
+		log.Printf("local address changed from %v to %v, reconnecting", local, ip)
+		conn.CloseWithError(quic.ApplicationErrorCode(0x02), "local address changed")
+		return errors.New("local address changed")
+	})
+}
+
+// localIP returns the local ip routed to the remote address, no packet is sent
+func localIP(remote net.Addr) net.IP {
+	conn, err := net.Dial("udp", remote.String())
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
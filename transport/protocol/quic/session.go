@@ -0,0 +1,70 @@
+package quic
+
+import (
+	"context"
+
+	"github.com/golang/snappy"
+	"github.com/quic-go/quic-go"
+
+	"github.com/net-byte/vtun/common/cipher"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xproto"
+)
+
+// session is a quic connection carrying packets on its streams, or as datagrams when negotiated,
+// packets that don't fit in a datagram are sent on the stream of their flow
+type session struct {
+	conn     quic.Connection
+	streams  []quic.Stream
+	datagram bool
+}
+
+func newSession(conn quic.Connection, streams []quic.Stream, datagram bool) *session {
+	if datagram {
+		if early, ok := conn.(quic.EarlyConnection); ok {
+			// datagram support is only known once the handshake is done
+			select {
+			case <-early.HandshakeComplete():
+			case <-conn.Context().Done():
+			}
+		}
+		datagram = conn.ConnectionState().SupportsDatagrams
+	}
+	return &session{
+		conn:     conn,
+		streams:  streams,
+		datagram: datagram,
+	}
+}
+
+// write sends a length prefixed packet, as a datagram without the prefix if possible
+func (s *session) write(hash uint32, frame []byte) (int, error) {
+	if s.datagram && s.conn.SendMessage(frame[xproto.HeaderLength:]) == nil {
+		return len(frame), nil
+	}
+	return s.streams[hash%uint32(len(s.streams))].Write(frame)
+}
+
+// receiveDatagrams decodes the packets received as datagrams until the connection is closed
+func receiveDatagrams(_ctx context.Context, config config.Config, conn quic.Connection, handle func(b []byte, n int)) {
+	for {
+		b, err := conn.ReceiveMessage(_ctx)
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			return
+		}
+		n := len(b)
+		if config.Compress {
+			b, err = snappy.Decode(nil, b)
+			if err != nil {
+				netutil.PrintErr(err, config.Verbose)
+				continue
+			}
+		}
+		if config.Obfs {
+			b = cipher.XOR(b)
+		}
+		handle(b, n)
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/net-byte/vtun/common/x/xalive"
 	"github.com/net-byte/vtun/common/x/xcrypto"
 	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xproxy"
+	"github.com/net-byte/vtun/common/x/xretry"
 	"github.com/net-byte/vtun/common/x/xtun"
 	"log"
 	"net"
@@ -28,31 +31,33 @@ var cancel context.CancelFunc
 
 func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), _ctx context.Context) {
 	go Tun2Conn(config, outputStream, _ctx, readCallback)
+	policy := xretry.NewPolicy(config)
 	for xtun.ContextOpened(_ctx) {
-		var (
-			conn *net.TCPConn
-			err  error
-		)
-
-		tcpAddr, _ := net.ResolveTCPAddr("tcp", config.ServerAddr)
-		conn, err = net.DialTCP("tcp", nil, tcpAddr)
+		policy.Connecting()
+		conn, err := xproxy.Dial(config, config.ServerAddr)
 		if err != nil {
-			time.Sleep(3 * time.Second)
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
 
+		policy.Handshaking()
 		err = Handshake(config, conn)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
-		conn.SetKeepAlive(true)
-		conn.SetKeepAlivePeriod(10 * time.Second)
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(10 * time.Second)
+		}
 
 		cache.GetCache().Set(ConnTag, conn, 24*time.Hour)
+		policy.Connected()
 		Conn2Tun(config, conn, inputStream, _ctx, writeCallback)
 		cache.GetCache().Delete(ConnTag)
+		policy.Disconnected(_ctx)
 	}
 }
 
@@ -123,13 +128,7 @@ func Tun2Conn(config config.Config, outputStream <-chan []byte, _ctx context.Con
 				Length:          len(b),
 			}
 			conn := v.(net.Conn)
-			_, err = conn.Write(ph.Bytes())
-			if err != nil {
-				conn.Close()
-				netutil.PrintErr(err, config.Verbose)
-				continue
-			}
-			n, err := conn.Write(b)
+			n, err := conn.Write(xproto.Merge(ph.Bytes(), b))
 			if err != nil {
 				conn.Close()
 				netutil.PrintErr(err, config.Verbose)
@@ -140,9 +139,25 @@ func Tun2Conn(config config.Config, outputStream <-chan []byte, _ctx context.Con
 	}
 }
 
+// KeepAlive sends empty packets to the server until the context is done
+func KeepAlive(config config.Config, conn net.Conn, _ctx context.Context) {
+	ph := &xproto.ClientSendPacketHeader{
+		ProtocolVersion: xproto.ProtocolVersion,
+		Key:             xproto.ParseAuthKeyFromString(config.Key),
+		Length:          0,
+	}
+	xalive.Run(_ctx, config, func() error {
+		_, err := conn.Write(ph.Bytes())
+		return err
+	})
+}
+
 // Conn2Tun sends packets from conn to tun
 func Conn2Tun(config config.Config, conn net.Conn, inputStream chan<- []byte, _ctx context.Context, callback func(int)) {
 	defer conn.Close()
+	ctx, cancel := context.WithCancel(_ctx)
+	defer cancel()
+	go KeepAlive(config, conn, ctx)
 	header := make([]byte, xproto.ServerSendPacketHeaderLength)
 	buffer := make([]byte, config.BufferSize)
 	xp := &xcrypto.XCrypto{}
@@ -152,6 +167,7 @@ func Conn2Tun(config config.Config, conn net.Conn, inputStream chan<- []byte, _c
 		return
 	}
 	for xtun.ContextOpened(_ctx) {
+		conn.SetReadDeadline(xalive.Deadline(config))
 		n, err := conn.Read(header)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -166,6 +182,10 @@ func Conn2Tun(config config.Config, conn net.Conn, inputStream chan<- []byte, _c
 			netutil.PrintErr(errors.New("ph == nil"), config.Verbose)
 			break
 		}
+		if ph.Length == 0 {
+			// keepalive
+			continue
+		}
 		n, err = splitRead(conn, ph.Length, buffer[:ph.Length])
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -9,12 +9,13 @@ import (
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xchan"
 	"github.com/net-byte/vtun/common/x/xcrypto"
 	"github.com/net-byte/vtun/common/x/xproto"
 	"github.com/net-byte/water"
 	"log"
 	"net"
-	"time"
 )
 
 // StartServer starts the tcp server
@@ -34,7 +35,7 @@ func StartServer(iFace *water.Interface, config config.Config) {
 			netutil.PrintErr(err, config.Verbose)
 			continue
 		}
-		go ToServer(config, conn, iFace)
+		go ToServer(config, conn, iFace, "")
 	}
 }
 
@@ -71,29 +72,15 @@ func ToClient(config config.Config, iFace *water.Interface) {
 					ProtocolVersion: xproto.ProtocolVersion,
 					Length:          len(b),
 				}
-				conn := v.(net.Conn)
-				_, err := conn.Write(ph.Bytes())
-				if err != nil {
-					netutil.PrintErr(err, config.Verbose)
-					cache.GetCache().Delete(key)
-					conn.Close()
-					continue
-				}
-				n, err := conn.Write(b)
-				if err != nil {
-					netutil.PrintErr(err, config.Verbose)
-					cache.GetCache().Delete(key)
-					conn.Close()
-					continue
-				}
-				counter.IncrWrittenBytes(n)
+				v.(*xchan.SendQueue).Push(xproto.Merge(ph.Bytes(), b))
 			}
 		}
 	}
 }
 
-// ToServer sends packets from conn to iFace
-func ToServer(config config.Config, conn net.Conn, iFace *water.Interface) {
+// ToServer sends packets from conn to iFace,
+// the identity is the verified client identity of the conn or empty if the client is not authenticated by certificate
+func ToServer(config config.Config, conn net.Conn, iFace *water.Interface, identity string) {
 	defer conn.Close()
 	handshake := make([]byte, xproto.ClientHandshakePacketLength)
 	header := make([]byte, xproto.ClientSendPacketHeaderLength)
@@ -105,6 +92,7 @@ func ToServer(config config.Config, conn net.Conn, iFace *water.Interface) {
 		netutil.PrintErr(err, config.Verbose)
 		return
 	}
+	conn.SetReadDeadline(xalive.Deadline(config))
 	n, err := conn.Read(handshake)
 	if err != nil {
 		netutil.PrintErr(err, config.Verbose)
@@ -123,9 +111,30 @@ func ToServer(config config.Config, conn net.Conn, iFace *water.Interface) {
 		netutil.PrintErr(errors.New("authentication failed"), config.Verbose)
 		return
 	}
-	cache.GetCache().Set(hs.CIDRv4.String(), conn, 24*time.Hour)
-	cache.GetCache().Set(hs.CIDRv6.String(), conn, 24*time.Hour)
+	queue := xchan.NewSendQueue(config.SendQueueSize, xchan.ParseDropPolicy(config.DropPolicy), func(b []byte) error {
+		n, err := conn.Write(b)
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			conn.Close()
+			return err
+		}
+		counter.IncrWrittenBytes(n)
+		return nil
+	})
+	defer queue.Close()
+	peer := cache.NewPeer(queue)
+	defer peer.Evict()
+	peer.SetIdentity(identity)
+	if !peer.Route(hs.CIDRv4.String()) || !peer.Route(hs.CIDRv6.String()) {
+		netutil.PrintErrF(config.Verbose, "%v is owned by another client, rejected\n", hs.CIDRv4)
+		return
+	}
+	keepAlive := &xproto.ServerSendPacketHeader{
+		ProtocolVersion: xproto.ProtocolVersion,
+		Length:          0,
+	}
 	for {
+		conn.SetReadDeadline(xalive.Deadline(config))
 		n, err := conn.Read(header)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -144,6 +153,11 @@ func ToServer(config config.Config, conn net.Conn, iFace *water.Interface) {
 			netutil.PrintErr(errors.New("authentication failed"), config.Verbose)
 			break
 		}
+		if ph.Length == 0 {
+			// keepalive
+			queue.Push(keepAlive.Bytes())
+			continue
+		}
 		n, err = splitRead(conn, ph.Length, packet[:ph.Length])
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -7,7 +7,10 @@ import (
 	"log"
 	"net"
 
+	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xfallback"
+	"github.com/net-byte/vtun/common/x/xproto"
 )
 
 type SniffConn struct {
@@ -129,3 +132,28 @@ func (c *SniffConn) Handle() bool {
 	}(c)
 	return write > 0
 }
+
+// IsHandshake returns true if the pre data starts with a client handshake of the key
+func (c *SniffConn) IsHandshake(key string) bool {
+	if len(c.preData) < xproto.ClientHandshakePacketLength {
+		return false
+	}
+	hs := xproto.ParseClientHandshakePacket(c.preData[:xproto.ClientHandshakePacketLength])
+	return hs != nil && hs.Key.Equals(xproto.ParseAuthKeyFromString(key))
+}
+
+// Fallback serves the conn by the fallback if it is not a tunnel client, returns true if it did
+func (c *SniffConn) Fallback(config config.Config) bool {
+	if !xfallback.Enabled(config) {
+		return false
+	}
+	switch {
+	case c.Type == TypeHttp:
+		xfallback.ServeConn(config, c, true)
+	case c.Type == TypeHttp2 || !c.IsHandshake(config.Key):
+		xfallback.ServeConn(config, c, false)
+	default:
+		return false
+	}
+	return true
+}
@@ -7,10 +7,14 @@ import (
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xproxy"
+	"github.com/net-byte/vtun/common/x/xretry"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/vtun/common/x/xtun"
 	"github.com/net-byte/vtun/transport/protocol/tcp"
 	"github.com/net-byte/water"
 	"log"
+	"net"
 	"time"
 )
 
@@ -35,23 +39,44 @@ func StartClientForApi(config config.Config, outputStream <-chan []byte, inputSt
 	if config.TLSSni != "" {
 		tlsConfig.ServerName = config.TLSSni
 	}
+	if err := xtls.ClientCertificate(tlsConfig, config); err != nil {
+		log.Fatalln(err)
+	}
+	if err := xtls.VerifyServer(tlsConfig, config); err != nil {
+		log.Fatalln(err)
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(config.ServerAddr)
+	}
 	go tcp.Tun2Conn(config, outputStream, _ctx, readCallback)
+	policy := xretry.NewPolicy(config)
 	for xtun.ContextOpened(_ctx) {
-		conn, err := tls.Dial("tcp", config.ServerAddr, tlsConfig)
+		policy.Connecting()
+		rawConn, err := xproxy.Dial(config, config.ServerAddr)
 		if err != nil {
-			time.Sleep(3 * time.Second)
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
+			continue
+		}
+		conn := tls.Client(rawConn, tlsConfig)
+		if err = conn.Handshake(); err != nil {
+			conn.Close()
+			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
+		policy.Handshaking()
 		err = tcp.Handshake(config, conn)
 		if err != nil {
-			time.Sleep(3 * time.Second)
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
 		cache.GetCache().Set(tcp.ConnTag, conn, 24*time.Hour)
+		policy.Connected()
 		tcp.Conn2Tun(config, conn, inputStream, _ctx, writeCallback)
 		cache.GetCache().Delete(tcp.ConnTag)
+		policy.Disconnected(_ctx)
 	}
 }
 
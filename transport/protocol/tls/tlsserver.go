@@ -3,20 +3,18 @@ package tls
 import (
 	"crypto/tls"
 	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/vtun/transport/protocol/tcp"
 	"github.com/net-byte/water"
 	"log"
+	"net"
 )
 
 // StartServer starts the tls server
 func StartServer(iFace *water.Interface, config config.Config) {
 	log.Printf("vtun tls server started on %v", config.LocalAddr)
-	cert, err := tls.LoadX509KeyPair(config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
-	if err != nil {
-		log.Panic(err)
-	}
 	tlsConfig := &tls.Config{
-		Certificates:     []tls.Certificate{cert},
 		MinVersion:       tls.VersionTLS13,
 		CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
 		CipherSuites: []uint16{
@@ -29,6 +27,14 @@ func StartServer(iFace *water.Interface, config config.Config) {
 			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
 		},
 	}
+	err := xtls.ServerCertificate(tlsConfig, config)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = xtls.VerifyClients(tlsConfig, config)
+	if err != nil {
+		log.Panic(err)
+	}
 	ln, err := tls.Listen("tcp", config.LocalAddr, tlsConfig)
 	if err != nil {
 		log.Panic(err)
@@ -41,17 +47,24 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		if err != nil {
 			continue
 		}
-		sniffConn := NewPeekPreDataConn(conn)
-		switch sniffConn.Type {
-		case TypeHttp:
-			if sniffConn.Handle() {
-				continue
+		go func(conn net.Conn) {
+			conn.SetReadDeadline(xalive.Deadline(config))
+			sniffConn := NewPeekPreDataConn(conn)
+			if sniffConn.Fallback(config) {
+				return
 			}
-		case TypeHttp2:
-			if sniffConn.Handle() {
-				continue
+			switch sniffConn.Type {
+			case TypeHttp:
+				if sniffConn.Handle() {
+					return
+				}
+			case TypeHttp2:
+				if sniffConn.Handle() {
+					return
+				}
 			}
-		}
-		go tcp.ToServer(config, sniffConn, iFace)
+			state := conn.(*tls.Conn).ConnectionState()
+			tcp.ToServer(config, sniffConn, iFace, xtls.StateIdentity(&state))
+		}(conn)
 	}
 }
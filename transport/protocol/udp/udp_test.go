@@ -0,0 +1,84 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xsession"
+)
+
+// reply returns the keepalive answer read by the conn
+func reply(t *testing.T, conn *net.UDPConn, key []byte) *xproto.UDPKeepAlivePacket {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1500)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ka := xproto.ParseUDPKeepAlivePacket(b[:n], key)
+	if ka == nil {
+		t.Fatal("the answer should be an authenticated keepalive packet")
+	}
+	return ka
+}
+
+func TestKeepAliveOwnedRoutes(t *testing.T) {
+	key := []byte("secret")
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	cfg := config.Config{Key: string(key)}
+	s := &Server{
+		config:    cfg,
+		localConn: local,
+		sessions:  xsession.NewTable("udp", cfg, func() *peer { return &peer{} }),
+	}
+
+	claim := func(counter uint64) (*xproto.UDPKeepAlivePacket, *net.UDPConn) {
+		conn, err := net.DialUDP("udp", nil, local.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &xproto.UDPKeepAlivePacket{
+			UDPHeader: xproto.UDPHeader{Type: xproto.UDPTypeKeepAlive, SessionID: xproto.GenSessionID()},
+			Counter:   counter,
+			CIDRv4:    net.IPv4(172, 16, 0, 10),
+			CIDRv6:    net.ParseIP("fced:9999::9999"),
+		}, conn
+	}
+	a, connA := claim(1)
+	s.keepAlive(a, connA.LocalAddr().(*net.UDPAddr))
+	if ka := reply(t, connA, key); ka.Type != xproto.UDPTypeKeepAliveAck || ka.SessionID != a.SessionID {
+		t.Fatalf("the first session should be acked, got type %v", ka.Type)
+	}
+	// the routes are owned by the session until it dies
+	sess, _ := s.sessions.Get(a.SessionID)
+	defer s.sessions.Close(sess)
+
+	b, connB := claim(1)
+	s.keepAlive(b, connB.LocalAddr().(*net.UDPAddr))
+	if ka := reply(t, connB, key); ka.Type != xproto.UDPTypeKeepAliveReject || ka.SessionID != b.SessionID {
+		t.Fatalf("the second session claiming the same addresses should be rejected, got type %v", ka.Type)
+	}
+	if _, ok := s.sessions.Get(b.SessionID); ok {
+		t.Error("the rejected session should be closed")
+	}
+	for _, addr := range []string{"172.16.0.10", "fced:9999::9999"} {
+		if sess, ok := s.sessions.Lookup(addr); !ok || sess.ID != a.SessionID {
+			t.Errorf("%v should stay routed to the first session", addr)
+		}
+	}
+
+	a.Counter++
+	s.keepAlive(a, connA.LocalAddr().(*net.UDPAddr))
+	if ka := reply(t, connA, key); ka.Type != xproto.UDPTypeKeepAliveAck {
+		t.Fatalf("the first session should still be acked, got type %v", ka.Type)
+	}
+}
@@ -1,8 +1,11 @@
 package udp
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/snappy"
@@ -10,44 +13,90 @@ import (
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xretry"
 	"github.com/net-byte/water"
 )
 
 // Client The client struct
 type Client struct {
-	config config.Config
-	iFace  *water.Interface
-	conn   *net.UDPConn
+	config   config.Config
+	iFace    *water.Interface
+	conn     atomic.Pointer[net.UDPConn]
+	session  xproto.SessionID
+	counter  atomic.Uint64
+	lastRecv atomic.Int64
 }
 
 // StartClient starts the udp client
 func StartClient(iFace *water.Interface, config config.Config) {
-	serverAddr, err := net.ResolveUDPAddr("udp", config.ServerAddr)
-	if err != nil {
-		log.Fatalln("failed to resolve server addr:", err)
-	}
-	conn, err := net.DialUDP("udp", nil, serverAddr)
-	if err != nil {
-		log.Fatalln("failed to dial udp server:", err)
-	}
-	defer conn.Close()
 	log.Println("vtun udp client started")
-	c := &Client{config: config, iFace: iFace, conn: conn}
-	go c.udpToTun()
-	go c.keepAlive()
-	c.tunToUdp()
+	c := &Client{config: config, iFace: iFace, session: xproto.GenSessionID()}
+	go c.tunToUdp()
+	policy := xretry.NewPolicy(config)
+	for {
+		policy.Connecting()
+		serverAddr, err := net.ResolveUDPAddr("udp", config.ServerAddr)
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(context.Background())
+			continue
+		}
+		conn, err := net.DialUDP("udp", nil, serverAddr)
+		if err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(context.Background())
+			continue
+		}
+		c.conn.Store(conn)
+		c.lastRecv.Store(time.Now().UnixNano())
+		policy.Connected()
+		ctx, cancel := context.WithCancel(context.Background())
+		go c.keepAlive(ctx, conn, serverAddr)
+		c.udpToTun(conn)
+		cancel()
+		c.conn.CompareAndSwap(conn, nil)
+		conn.Close()
+		policy.Disconnected(context.Background())
+	}
 }
 
 // udpToTun sends packets from udp to tun
-func (c *Client) udpToTun() {
+func (c *Client) udpToTun(conn *net.UDPConn) {
 	packet := make([]byte, c.config.BufferSize)
+	key := []byte(c.config.Key)
 	for {
-		n, err := c.conn.Read(packet)
+		n, err := conn.Read(packet)
 		if err != nil {
 			netutil.PrintErr(err, c.config.Verbose)
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
 			continue
 		}
-		b := packet[:n]
+		h := xproto.ParseUDPHeader(packet[:n])
+		if h == nil || h.SessionID != c.session {
+			continue
+		}
+		if h.Type == xproto.UDPTypeKeepAliveAck {
+			if xproto.ParseUDPKeepAlivePacket(packet[:n], key) != nil {
+				c.lastRecv.Store(time.Now().UnixNano())
+			}
+			continue
+		}
+		if h.Type == xproto.UDPTypeKeepAliveReject {
+			// only the answer to the last keepalive counts, so an old one can't be replayed
+			if ka := xproto.ParseUDPKeepAlivePacket(packet[:n], key); ka != nil && ka.Counter == c.counter.Load() {
+				log.Println("rejected by the server, the addresses are owned by another client")
+				break
+			}
+			continue
+		}
+		if h.Type != xproto.UDPTypeData {
+			continue
+		}
+		b := packet[xproto.UDPHeaderLength:n]
 		if c.config.Compress {
 			b, err = snappy.Decode(nil, b)
 			if err != nil {
@@ -58,6 +107,7 @@ func (c *Client) udpToTun() {
 		if c.config.Obfs {
 			b = cipher.XOR(b)
 		}
+		c.lastRecv.Store(time.Now().UnixNano())
 		c.iFace.Write(b)
 		counter.IncrReadBytes(n)
 	}
@@ -66,12 +116,18 @@ func (c *Client) udpToTun() {
 // tunToUdp sends packets from tun to udp
 func (c *Client) tunToUdp() {
 	packet := make([]byte, c.config.BufferSize)
+	h := &xproto.UDPHeader{Type: xproto.UDPTypeData, SessionID: c.session}
+	header := h.Bytes()
 	for {
 		n, err := c.iFace.Read(packet)
 		if err != nil {
 			netutil.PrintErr(err, c.config.Verbose)
 			break
 		}
+		conn := c.conn.Load()
+		if conn == nil {
+			continue
+		}
 		b := packet[:n]
 		if c.config.Obfs {
 			b = cipher.XOR(b)
@@ -79,7 +135,7 @@ func (c *Client) tunToUdp() {
 		if c.config.Compress {
 			b = snappy.Encode(nil, b)
 		}
-		_, err = c.conn.Write(b)
+		_, err = conn.Write(xproto.Merge(header, b))
 		if err != nil {
 			netutil.PrintErr(err, c.config.Verbose)
 			continue
@@ -88,32 +144,47 @@ func (c *Client) tunToUdp() {
 	}
 }
 
-func (c *Client) keepAlive() {
-	srcIp, _, err := net.ParseCIDR(c.config.CIDR)
+// keepAlive sends authenticated keepalives so the server can rebind the session to a new address,
+// the conn is closed to trigger a reconnect when the server stops answering or its address changes
+func (c *Client) keepAlive(_ctx context.Context, conn *net.UDPConn, serverAddr *net.UDPAddr) {
+	ka, err := xproto.GenClientHandshakePacket(c.config)
 	if err != nil {
 		netutil.PrintErr(err, c.config.Verbose)
 		return
 	}
-
-	// dst ip(pingIpPacket[12:16]): 0.0.0.0, src ip(pingIpPacket[16:20]): 0.0.0.0
-	pingIpPacket := []byte{0x45, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x40, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00}
-	copy(pingIpPacket[12:16], srcIp[12:16]) // modify ping packet src ip to client CIDR ip
-
-	if c.config.Obfs {
-		pingIpPacket = cipher.XOR(pingIpPacket)
-	}
-	if c.config.Compress {
-		pingIpPacket = snappy.Encode(nil, pingIpPacket)
-	}
-
+	key := []byte(c.config.Key)
+	ticker := time.NewTicker(xalive.Interval(c.config))
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Second * 10)
-
-		_, err := c.conn.Write(pingIpPacket)
+		p := &xproto.UDPKeepAlivePacket{
+			UDPHeader: xproto.UDPHeader{Type: xproto.UDPTypeKeepAlive, SessionID: c.session},
+			Counter:   c.counter.Add(1),
+			CIDRv4:    ka.CIDRv4,
+			CIDRv6:    ka.CIDRv6,
+		}
+		_, err := conn.Write(p.Bytes(key))
+		if err != nil {
+			netutil.PrintErr(err, c.config.Verbose)
+		}
+		select {
+		case <-_ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(time.Unix(0, c.lastRecv.Load())) > xalive.Timeout(c.config) {
+			log.Printf("no response from server %v, reconnecting", serverAddr)
+			conn.Close()
+			return
+		}
+		addr, err := net.ResolveUDPAddr("udp", c.config.ServerAddr)
 		if err != nil {
 			netutil.PrintErr(err, c.config.Verbose)
 			continue
 		}
+		if !addr.IP.Equal(serverAddr.IP) || addr.Port != serverAddr.Port {
+			log.Printf("server address changed from %v to %v, reconnecting", serverAddr, addr)
+			conn.Close()
+			return
+		}
 	}
 }
@@ -1,17 +1,19 @@
 package udp
 
 import (
+	"errors"
 	"log"
 	"net"
-	"time"
+	"sync"
 
 	"github.com/golang/snappy"
 	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xsession"
 	"github.com/net-byte/water"
-	"github.com/patrickmn/go-cache"
 )
 
 // Server the server struct
@@ -19,7 +21,34 @@ type Server struct {
 	config    config.Config
 	iFace     *water.Interface
 	localConn *net.UDPConn
-	connCache *cache.Cache
+	sessions  *xsession.Table[*peer]
+}
+
+// session is a client identified by its session id rather than its source address
+type session = xsession.Session[*peer]
+
+// peer is the address of a session, it changes when the client roams
+type peer struct {
+	mx   sync.Mutex
+	addr *net.UDPAddr
+}
+
+// Addr returns the current address of the session
+func (p *peer) Addr() *net.UDPAddr {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.addr
+}
+
+// bind rebinds the session to the address, it returns false if it is already bound to it
+func (p *peer) bind(addr *net.UDPAddr) bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if p.addr != nil && p.addr.String() == addr.String() {
+		return false
+	}
+	p.addr = addr
+	return true
 }
 
 // StartServer starts the udp server
@@ -34,7 +63,12 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		log.Fatalln("failed to listen on udp socket:", err)
 	}
 	defer conn.Close()
-	s := &Server{config: config, iFace: iFace, localConn: conn, connCache: cache.New(30*time.Minute, 10*time.Minute)}
+	s := &Server{
+		config:    config,
+		iFace:     iFace,
+		localConn: conn,
+		sessions:  xsession.NewTable("udp", config, func() *peer { return &peer{} }),
+	}
 	go s.tunToUdp()
 	s.udpToTun()
 }
@@ -50,16 +84,9 @@ func (s *Server) tunToUdp() {
 		}
 		b := packet[:n]
 		if key := netutil.GetDstKey(b); key != "" {
-			if v, ok := s.connCache.Get(key); ok {
-				if s.config.Obfs {
-					b = cipher.XOR(b)
-				}
-				if s.config.Compress {
-					b = snappy.Encode(nil, b)
-				}
-				_, err := s.localConn.WriteToUDP(b, v.(*net.UDPAddr))
-				if err != nil {
-					s.connCache.Delete(key)
+			if sess, ok := s.sessions.Lookup(key); ok {
+				if err := s.writeTo(sess, b); err != nil {
+					netutil.PrintErr(err, s.config.Verbose)
 					continue
 				}
 				counter.IncrWrittenBytes(n)
@@ -68,16 +95,56 @@ func (s *Server) tunToUdp() {
 	}
 }
 
+// writeTo encodes the packet and sends it to the current address of the session
+func (s *Server) writeTo(sess *session, b []byte) error {
+	if s.config.Obfs {
+		b = cipher.XOR(b)
+	}
+	if s.config.Compress {
+		b = snappy.Encode(nil, b)
+	}
+	h := &xproto.UDPHeader{Type: xproto.UDPTypeData, SessionID: sess.ID}
+	_, err := s.localConn.WriteToUDP(xproto.Merge(h.Bytes(), b), sess.State.Addr())
+	return err
+}
+
 // udpToTun sends packets from udp to tun
 func (s *Server) udpToTun() {
 	packet := make([]byte, s.config.BufferSize)
+	key := []byte(s.config.Key)
+	cidrIP, _, err := net.ParseCIDR(s.config.CIDR)
+	if err != nil {
+		netutil.PrintErr(err, s.config.Verbose)
+		return
+	}
 	for {
 		n, cliAddr, err := s.localConn.ReadFromUDP(packet)
 		if err != nil || n == 0 {
 			netutil.PrintErr(err, s.config.Verbose)
 			continue
 		}
-		b := packet[:n]
+		h := xproto.ParseUDPHeader(packet[:n])
+		if h == nil {
+			continue
+		}
+		if h.Type == xproto.UDPTypeKeepAlive {
+			ka := xproto.ParseUDPKeepAlivePacket(packet[:n], key)
+			if ka == nil {
+				netutil.PrintErr(errors.New("authentication failed"), s.config.Verbose)
+				continue
+			}
+			s.keepAlive(ka, cliAddr)
+			continue
+		}
+		if h.Type != xproto.UDPTypeData {
+			continue
+		}
+		sess, ok := s.sessions.Get(h.SessionID)
+		if !ok {
+			// the session must be opened by an authenticated keepalive first
+			continue
+		}
+		b := packet[xproto.UDPHeaderLength:n]
 		if s.config.Compress {
 			b, err = snappy.Decode(nil, b)
 			if err != nil {
@@ -89,35 +156,19 @@ func (s *Server) udpToTun() {
 			b = cipher.XOR(b)
 		}
 
-		cidrIP, _, err := net.ParseCIDR(s.config.CIDR)
-		if err != nil {
-			netutil.PrintErr(err, s.config.Verbose)
-			return
-		}
-
 		if dstKey := netutil.GetDstKey(b); dstKey != "" {
-			// the package come from vtun udp client in-code ping operation
-			if dstKey == "0.0.0.0" {
-				srcKey := netutil.GetSrcKey(b)
-				s.connCache.Set(srcKey, cliAddr, 24*time.Hour)
-				continue
-			}
-
 			// the package come from vtun udp client, send to this vtun udp server
 			if dstKey == cidrIP.String() {
-				if key := netutil.GetSrcKey(b); key != "" {
+				if key := netutil.GetSrcKey(b); key != "" && s.sessions.Route(key, sess) {
 					s.iFace.Write(b)
-					s.connCache.Set(key, cliAddr, 24*time.Hour)
 					counter.IncrReadBytes(n)
 				}
 				continue
 			}
 
 			// the package come from vtun udp client, send to another client
-			if v, ok := s.connCache.Get(dstKey); ok {
-				_, err := s.localConn.WriteToUDP(b, v.(*net.UDPAddr))
-				if err != nil {
-					s.connCache.Delete(dstKey)
+			if dst, ok := s.sessions.Lookup(dstKey); ok {
+				if err := s.writeTo(dst, b); err != nil {
 					continue
 				}
 				counter.IncrWrittenBytes(n)
@@ -125,3 +176,20 @@ func (s *Server) udpToTun() {
 		}
 	}
 }
+
+// keepAlive opens or refreshes the session and rebinds it to the address the keepalive came from,
+// the keepalive is rejected if its addresses are owned by another session
+func (s *Server) keepAlive(ka *xproto.UDPKeepAlivePacket, cliAddr *net.UDPAddr) {
+	ack := s.sessions.KeepAlive(ka, func(sess *session) {
+		if old := sess.State.Addr(); sess.State.bind(cliAddr) && old != nil {
+			log.Printf("udp session %v rebound from %v to %v", sess.ID, old, cliAddr)
+		}
+	})
+	if ack == nil {
+		return
+	}
+	_, err := s.localConn.WriteToUDP(ack.Bytes([]byte(s.config.Key)), cliAddr)
+	if err != nil {
+		netutil.PrintErr(err, s.config.Verbose)
+	}
+}
@@ -2,12 +2,14 @@ package utls
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/net-byte/vtun/common/counter"
+	"github.com/net-byte/vtun/common/x/xproxy"
+	"github.com/net-byte/vtun/common/x/xretry"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/vtun/common/x/xtun"
 	"github.com/net-byte/vtun/transport/protocol/tcp"
-	utls "github.com/refraction-networking/utls"
 	"log"
-	"net"
 	"time"
 
 	"github.com/net-byte/vtun/common/cache"
@@ -20,36 +22,48 @@ var _ctx context.Context
 var cancel context.CancelFunc
 
 func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), _ctx context.Context) {
-	tlsConfig := &utls.Config{
+	tlsConfig := &tls.Config{
 		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+		NextProtos:         config.TLSALPN,
 	}
 	if config.TLSSni != "" {
 		tlsConfig.ServerName = config.TLSSni
 	}
+	if err := xtls.ClientCertificate(tlsConfig, config); err != nil {
+		log.Fatalln(err)
+	}
+	if err := xtls.VerifyServer(tlsConfig, config); err != nil {
+		log.Fatalln(err)
+	}
 	go tcp.Tun2Conn(config, outputStream, _ctx, readCallback)
+	policy := xretry.NewPolicy(config)
 	for xtun.ContextOpened(_ctx) {
-		tcpConn, err := net.Dial("tcp", config.ServerAddr)
+		policy.Connecting()
+		tcpConn, err := xproxy.Dial(config, config.ServerAddr)
 		if err != nil {
-			time.Sleep(3 * time.Second)
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
-		conn := utls.UClient(tcpConn, tlsConfig, utls.HelloRandomized)
-		err = conn.Handshake()
+		policy.Handshaking()
+		conn, err := xtls.UClient(tcpConn, tlsConfig, config.UTLSFingerprint)
 		if err != nil {
-			time.Sleep(3 * time.Second)
+			tcpConn.Close()
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
 		err = tcp.Handshake(config, conn)
 		if err != nil {
-			time.Sleep(3 * time.Second)
 			netutil.PrintErr(err, config.Verbose)
+			policy.Wait(_ctx)
 			continue
 		}
 		cache.GetCache().Set(tcp.ConnTag, conn, 24*time.Hour)
+		policy.Connected()
 		tcp.Conn2Tun(config, conn, inputStream, _ctx, writeCallback)
 		cache.GetCache().Delete(tcp.ConnTag)
+		policy.Disconnected(_ctx)
 	}
 }
 
@@ -2,22 +2,36 @@ package utls
 
 import (
 	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xtls"
 	"github.com/net-byte/vtun/transport/protocol/tcp"
 	"github.com/net-byte/vtun/transport/protocol/tls"
 	"github.com/net-byte/water"
 	utls "github.com/refraction-networking/utls"
 	"log"
+	"net"
 )
 
 // StartServer starts the utls server
 func StartServer(iFace *water.Interface, config config.Config) {
 	log.Printf("vtun utls server started on %v", config.LocalAddr)
-	cert, err := utls.LoadX509KeyPair(config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
+	store, err := xtls.NewCertStore(config)
 	if err != nil {
 		log.Panic(err)
 	}
 	tlsConfig := &utls.Config{
-		Certificates: []utls.Certificate{cert},
+		GetCertificate: func(hello *utls.ClientHelloInfo) (*utls.Certificate, error) {
+			cert := store.Certificate(hello.ServerName)
+			return &utls.Certificate{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey, Leaf: cert.Leaf}, nil
+		},
+	}
+	if config.TLSClientCAFilePath != "" {
+		pool, err := xtls.LoadCertPool(config.TLSClientCAFilePath)
+		if err != nil {
+			log.Panic(err)
+		}
+		tlsConfig.ClientAuth = utls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = pool
 	}
 	ln, err := utls.Listen("tcp", config.LocalAddr, tlsConfig)
 	if err != nil {
@@ -31,17 +45,27 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		if err != nil {
 			continue
 		}
-		sniffConn := tls.NewPeekPreDataConn(conn)
-		switch sniffConn.Type {
-		case tls.TypeHttp:
-			if sniffConn.Handle() {
-				continue
+		go func(conn net.Conn) {
+			conn.SetReadDeadline(xalive.Deadline(config))
+			sniffConn := tls.NewPeekPreDataConn(conn)
+			if sniffConn.Fallback(config) {
+				return
 			}
-		case tls.TypeHttp2:
-			if sniffConn.Handle() {
-				continue
+			switch sniffConn.Type {
+			case tls.TypeHttp:
+				if sniffConn.Handle() {
+					return
+				}
+			case tls.TypeHttp2:
+				if sniffConn.Handle() {
+					return
+				}
 			}
-		}
-		go tcp.ToServer(config, sniffConn, iFace)
+			identity := ""
+			if state := conn.(*utls.Conn).ConnectionState(); len(state.PeerCertificates) > 0 {
+				identity = xtls.Identity(state.PeerCertificates[0])
+			}
+			tcp.ToServer(config, sniffConn, iFace, identity)
+		}(conn)
 	}
 }
@@ -0,0 +1,158 @@
+package ws
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/water"
+)
+
+// tun stands in for the tun device, the packets written to it are received on out
+type tun struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func (t *tun) Read(b []byte) (int, error) {
+	p, ok := <-t.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, p), nil
+}
+
+func (t *tun) Write(b []byte) (int, error) {
+	t.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (t *tun) Close() error {
+	close(t.in)
+	return nil
+}
+
+// receive returns the next packet written to the tun
+func (t *tun) receive() ([]byte, error) {
+	select {
+	case b := <-t.out:
+		return b, nil
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("no packet")
+	}
+}
+
+// packet returns an ipv4 packet from src to dst
+func packet(src, dst net.IP) []byte {
+	b := make([]byte, 64)
+	b[0] = 0x45
+	b[9] = 17
+	copy(b[12:16], src.To4())
+	copy(b[16:20], dst.To4())
+	return b
+}
+
+// serve starts the ws server of the config on a loopback port and returns the config of its clients
+func serve(t *testing.T, cfg config.Config) (config.Config, *tun) {
+	cfg.LocalAddr = "127.0.0.1:0"
+	cfg.Path = "/ws"
+	cfg.BufferSize = 65535
+	tun := &tun{in: make(chan []byte, 16), out: make(chan []byte, 16)}
+	srv := newServer(NewHandler(&water.Interface{ReadWriteCloser: tun}, cfg), cfg)
+	ln, err := listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		srv.Close()
+		tun.Close()
+	})
+	cfg.ServerAddr = ln.Addr().String()
+	cfg.Proxy = "direct"
+	cfg.Timeout = 5
+	return cfg, tun
+}
+
+func TestHandshake(t *testing.T) {
+	cfg, tun := serve(t, config.Config{Key: "secret"})
+	client, gateway := net.IPv4(172, 16, 46, 10), net.IPv4(172, 16, 46, 1)
+
+	wrong := cfg
+	wrong.Key = "other"
+	if conn := netutil.ConnectServer(wrong, nil); conn != nil {
+		conn.Close()
+		t.Fatal("the handshake with a token of another key should be refused")
+	}
+
+	conn := netutil.ConnectServer(cfg, nil)
+	if conn == nil {
+		t.Fatal("the handshake with the token should succeed")
+	}
+	defer conn.Close()
+	up := packet(client, gateway)
+	if err := wsutil.WriteClientBinary(conn, up); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tun.receive(); err != nil || !bytes.Equal(got, up) {
+		t.Fatalf("the packet should reach the server tun: %v", err)
+	}
+	down := packet(gateway, client)
+	tun.in <- down
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := wsutil.ReadServerBinary(conn)
+	if err != nil || !bytes.Equal(got, down) {
+		t.Fatalf("the packet should reach the client: %v", err)
+	}
+}
+
+// TestMaxConns checks the connections over ws_max_conns wait until one is closed
+func TestMaxConns(t *testing.T) {
+	cfg, _ := serve(t, config.Config{Key: "secret", WSMaxConns: 1})
+	conn := netutil.ConnectServer(cfg, nil)
+	if conn == nil {
+		t.Fatal("the first connection should be accepted")
+	}
+	client := &http.Client{Timeout: 300 * time.Millisecond}
+	if res, err := client.Get("http://" + cfg.ServerAddr + "/ip"); err == nil {
+		res.Body.Close()
+		t.Fatal("the connection over the limit should not be served")
+	}
+	conn.Close()
+	client.Timeout = 5 * time.Second
+	res, err := client.Get("http://" + cfg.ServerAddr + "/ip")
+	if err != nil {
+		t.Fatalf("the connection should be served once the other one is closed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "127.0.0.1" {
+		t.Errorf("the api should answer the client ip, got %q", body)
+	}
+}
+
+// TestReadHeaderTimeout checks a client sending its headers too slowly is disconnected
+func TestReadHeaderTimeout(t *testing.T) {
+	cfg, _ := serve(t, config.Config{Key: "secret", WSReadHeaderTimeout: 1})
+	conn, err := net.Dial("tcp", cfg.ServerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /ip HTTP/1.1\r\nHost: vtun\r\n")
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("the server should close the connection: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("the connection should be closed after the read header timeout, got %v", elapsed)
+	}
+}
@@ -2,7 +2,12 @@ package ws
 
 import (
 	"context"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xchan"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xretry"
 	"github.com/net-byte/vtun/common/x/xtun"
+	"github.com/net-byte/vtun/common/x/xws"
 	"log"
 	"net"
 	"time"
@@ -20,24 +25,50 @@ import (
 
 const ConnTag = "conn"
 
+// keepAliveText is the text of the keepalive frames, the server echoes it
+const keepAliveText = "ping"
+
 var _ctx context.Context
 var _cancel context.CancelFunc
 
 func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), _ctx context.Context) {
-	go tunToWs(config, outputStream, _ctx, writeCallback)
+	var early chan []byte
+	if config.WSEarlyData > 0 {
+		early = make(chan []byte, 1)
+	}
+	go tunToWs(config, outputStream, early, _ctx, writeCallback)
+	policy := xretry.NewPolicy(config)
 	for xtun.ContextOpened(_ctx) {
+		// with early data the handshake waits for the first packet and carries it
+		var earlyData, pending []byte
+		if early != nil {
+			select {
+			case earlyData = <-early:
+			case <-_ctx.Done():
+				return
+			}
+			if _, ok := xws.EncodeEarlyData(config, earlyData); !ok {
+				pending, earlyData = earlyData, nil
+			}
+		}
 		ctx, cancel := context.WithCancel(_ctx)
-		conn := netutil.ConnectServer(config)
+		policy.Connecting()
+		conn := netutil.ConnectServer(config, earlyData)
 		if conn == nil {
 			cancel()
-			time.Sleep(3 * time.Second)
+			policy.Wait(_ctx)
 			continue
 		}
+		if pending != nil {
+			writeBinary(config, conn, [][]byte{pending})
+		}
 		cache.GetCache().Set(ConnTag, conn, 24*time.Hour)
+		policy.Connected()
 		go wsToTun(config, conn, inputStream, ctx, cancel, readCallback)
 		ping(conn, config, ctx, cancel)
 		cache.GetCache().Delete(ConnTag)
 		conn.Close()
+		policy.Disconnected(_ctx)
 	}
 }
 
@@ -59,56 +90,100 @@ func StartClient(iFace *water.Interface, config config.Config) {
 
 func ping(conn net.Conn, config config.Config, _ctx context.Context, _cancel context.CancelFunc) {
 	defer _cancel()
-	for xtun.ContextOpened(_ctx) {
-		err := wsutil.WriteClientMessage(conn, ws.OpText, []byte("ping"))
-		if err != nil {
-			break
-		}
-		time.Sleep(3 * time.Second)
-	}
+	xalive.Run(_ctx, config, func() error {
+		return wsutil.WriteClientMessage(conn, ws.OpText, []byte(keepAliveText))
+	})
 }
 
 // wsToTun sends packets from ws to tun
 func wsToTun(config config.Config, conn net.Conn, inputStream chan<- []byte, _ctx context.Context, _cancel context.CancelFunc, callback func(int)) {
 	defer _cancel()
 	for xtun.ContextOpened(_ctx) {
-		packet, err := wsutil.ReadServerBinary(conn)
+		conn.SetReadDeadline(xalive.Deadline(config))
+		packet, op, err := wsutil.ReadServerData(conn)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
 			break
 		}
-		n := len(packet)
-		if config.Compress {
-			packet, _ = snappy.Decode(nil, packet)
+		if op != ws.OpBinary {
+			// pong
+			continue
 		}
-		if config.Obfs {
-			packet = cipher.XOR(packet)
+		packets := [][]byte{packet}
+		if config.BatchSize > 0 {
+			packets, err = xproto.DecodeBatch(packet)
+			if err != nil {
+				netutil.PrintErr(err, config.Verbose)
+				break
+			}
+		}
+		for _, packet := range packets {
+			n := len(packet)
+			if config.Compress {
+				packet, _ = snappy.Decode(nil, packet)
+			}
+			if config.Obfs {
+				packet = cipher.XOR(packet)
+			}
+			inputStream <- packet[:]
+			callback(n)
 		}
-		inputStream <- packet[:]
-		callback(n)
 	}
 }
 
-// tunToWs sends packets from tun to ws
-func tunToWs(config config.Config, outputStream <-chan []byte, _ctx context.Context, callback func(int)) {
+// tunToWs sends packets from tun to ws, the packets without a conn go to the early channel if any,
+// in the batch mode the packets are coalesced into one frame
+func tunToWs(config config.Config, outputStream <-chan []byte, early chan<- []byte, _ctx context.Context, callback func(int)) {
 	for xtun.ContextOpened(_ctx) {
 		b := <-outputStream
-		n := len(b)
-		if v, ok := cache.GetCache().Get(ConnTag); ok {
+		batch := [][]byte{b}
+		if config.BatchSize > 0 {
+			batch = xchan.Collect(outputStream, b, config.BatchSize, xchan.BatchDelay(config))
+		}
+		v, ok := cache.GetCache().Get(ConnTag)
+		if !ok && early == nil {
+			continue
+		}
+		n := 0
+		packets := make([][]byte, len(batch))
+		for i, b := range batch {
+			n += len(b)
 			if config.Obfs {
 				b = cipher.XOR(b)
 			}
 			if config.Compress {
 				b = snappy.Encode(nil, b)
 			}
-			conn := v.(net.Conn)
-			if err := wsutil.WriteClientBinary(conn, b); err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				continue
+			packets[i] = b
+		}
+		if !ok {
+			// the early data is a single packet
+			select {
+			case early <- packets[0]:
+				callback(len(batch[0]))
+			default:
 			}
-			callback(n)
+			continue
+		}
+		if err := writeBinary(config, v.(net.Conn), packets); err != nil {
+			netutil.PrintErr(err, config.Verbose)
+			continue
+		}
+		callback(n)
+	}
+}
+
+// writeBinary writes the packets in one batch frame in the batch mode, otherwise in a frame each
+func writeBinary(config config.Config, conn net.Conn, packets [][]byte) error {
+	if config.BatchSize > 0 {
+		return wsutil.WriteClientBinary(conn, xproto.EncodeBatch(packets))
+	}
+	for _, b := range packets {
+		if err := wsutil.WriteClientBinary(conn, b); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 func Close() {
@@ -1,6 +1,7 @@
 package ws
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
@@ -17,48 +18,104 @@ import (
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xalive"
+	"github.com/net-byte/vtun/common/x/xchan"
+	"github.com/net-byte/vtun/common/x/xfallback"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xtls"
+	"github.com/net-byte/vtun/common/x/xws"
 	"github.com/net-byte/vtun/register"
 	"github.com/net-byte/water"
+	xnetutil "golang.org/x/net/netutil"
 )
 
-// StartServer starts the ws server
-func StartServer(iFace *water.Interface, config config.Config) {
+// StartServer starts the ws server, it returns the error of the listener
+func StartServer(iFace *water.Interface, config config.Config) error {
+	srv := newServer(NewHandler(iFace, config), config)
+	ln, err := listen(config)
+	if err != nil {
+		return err
+	}
+	log.Printf("vtun websocket server started on %v", config.LocalAddr)
+	if config.Protocol == "wss" && (len(config.ACME.Domains) > 0 || config.TLSCertificateFilePath != "" && config.TLSCertificateKeyFilePath != "") {
+		tlsConfig := &tls.Config{}
+		err = xtls.ServerCertificate(tlsConfig, config)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		err = xtls.VerifyClients(tlsConfig, config)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// newServer returns the http server of the handler with the timeouts and limits of the config
+func newServer(handler http.Handler, config config.Config) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout(config),
+		IdleTimeout:       idleTimeout(config),
+		MaxHeaderBytes:    maxHeaderBytes(config),
+	}
+}
+
+// listen listens on the local address, the connections over ws_max_conns wait to be accepted
+func listen(config config.Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", config.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	if config.WSMaxConns > 0 {
+		ln = xnetutil.LimitListener(ln, config.WSMaxConns)
+	}
+	return ln, nil
+}
+
+// NewHandler returns the handler of the tunnel and its api, so it can be mounted into another http server,
+// it starts sending the packets from the tun to the clients
+func NewHandler(iFace *water.Interface, config config.Config) http.Handler {
 	// server -> client
 	go toClient(config, iFace)
+	mux := http.NewServeMux()
 	// client -> server
-	http.HandleFunc(config.Path, func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(config.Path, func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
-		wsconn, _, _, err := ws.UpgradeHTTP(r, w)
+		early := xws.EarlyData(r)
+		upgrader := ws.HTTPUpgrader{
+			// the early data is echoed as the subprotocol as the clients expect
+			Protocol: func(string) bool { return early != nil },
+		}
+		wsconn, _, _, err := upgrader.Upgrade(r, w)
 		if err != nil {
-			log.Printf("[server] failed to upgrade http %v", err)
+			log.Printf("[server] failed to upgrade http from %v %v", xws.ClientIP(config, r), err)
 			return
 		}
-		toServer(config, wsconn, iFace)
+		toServer(config, wsconn, iFace, xtls.StateIdentity(r.TLS), early, xws.Batched(r))
 	})
 
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "text/plain")
-		w.Header().Set("Content-Length", "6")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("CF-Cache-Status", "DYNAMIC")
-		w.Header().Set("Server", "cloudflare")
-		w.Write([]byte(`follow`))
-	})
+	mux.Handle("/", xfallback.Handler(config))
 
-	http.HandleFunc("/ip", func(w http.ResponseWriter, req *http.Request) {
-		ip := req.Header.Get("X-Forwarded-For")
-		if ip == "" {
-			ip, _, _ = net.SplitHostPort(req.RemoteAddr)
+	mux.HandleFunc("/ip", func(w http.ResponseWriter, req *http.Request) {
+		if xfallback.Enabled(config) && !checkPermission(w, req, config) {
+			return
 		}
-		resp := fmt.Sprintf("%v", ip)
-		io.WriteString(w, resp)
+		io.WriteString(w, xws.ClientIP(config, req))
 	})
 
-	http.HandleFunc("/register/pick/ip", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/pick/ip", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
@@ -67,7 +124,7 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		io.WriteString(w, resp)
 	})
 
-	http.HandleFunc("/register/delete/ip", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/delete/ip", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
@@ -78,7 +135,7 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		io.WriteString(w, "OK")
 	})
 
-	http.HandleFunc("/register/keepalive/ip", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/keepalive/ip", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
@@ -89,14 +146,14 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		io.WriteString(w, "OK")
 	})
 
-	http.HandleFunc("/register/list/ip", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/list/ip", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
 		io.WriteString(w, strings.Join(register.ListClientIPs(), "\r\n"))
 	})
 
-	http.HandleFunc("/register/prefix/ipv4", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/prefix/ipv4", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
@@ -110,7 +167,7 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		io.WriteString(w, resp)
 	})
 
-	http.HandleFunc("/register/prefix/ipv6", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/prefix/ipv6", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
@@ -124,26 +181,48 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		io.WriteString(w, resp)
 	})
 
-	http.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
-		io.WriteString(w, counter.PrintBytes(true))
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
+		if xfallback.Enabled(config) && !checkPermission(w, req, config) {
+			return
+		}
+		io.WriteString(w, counter.PrintBytes(true)+" "+counter.PrintDropped())
 	})
 
-	log.Printf("vtun websocket server started on %v", config.LocalAddr)
-	if config.Protocol == "wss" && config.TLSCertificateFilePath != "" && config.TLSCertificateKeyFilePath != "" {
-		http.ListenAndServeTLS(config.LocalAddr, config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath, nil)
-	} else {
-		http.ListenAndServe(config.LocalAddr, nil)
+	return mux
+}
+
+// readHeaderTimeout returns the timeout of reading the request headers
+func readHeaderTimeout(config config.Config) time.Duration {
+	if config.WSReadHeaderTimeout <= 0 {
+		return 10 * time.Second
 	}
+	return time.Duration(config.WSReadHeaderTimeout) * time.Second
+}
 
+// idleTimeout returns how long a keep-alive connection waits for the next request
+func idleTimeout(config config.Config) time.Duration {
+	if config.WSIdleTimeout <= 0 {
+		return 120 * time.Second
+	}
+	return time.Duration(config.WSIdleTimeout) * time.Second
+}
+
+// maxHeaderBytes returns the max size of the request headers
+func maxHeaderBytes(config config.Config) int {
+	if config.WSMaxHeaderBytes <= 0 {
+		return 16 << 10
+	}
+	return config.WSMaxHeaderBytes
 }
 
 // checkPermission checks the permission of the request
 func checkPermission(w http.ResponseWriter, req *http.Request, config config.Config) bool {
-	if config.Key == "" {
-		return true
-	}
-	key := req.Header.Get("key")
-	if key != config.Key {
+	if !xws.Authorized(config, req) {
+		if xfallback.Enabled(config) {
+			// an unauthenticated request gets the answer of the fallback site
+			xfallback.Handler(config).ServeHTTP(w, req)
+			return false
+		}
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("No permission"))
 		return false
@@ -169,21 +248,58 @@ func toClient(config config.Config, iFace *water.Interface) {
 				if config.Compress {
 					b = snappy.Encode(nil, b)
 				}
-				err := wsutil.WriteServerBinary(v.(net.Conn), b)
-				if err != nil {
-					cache.GetCache().Delete(key)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
+				v.(*xchan.SendQueue).Push(xproto.Copy(b))
 			}
 		}
 	}
 }
 
-// toServer sends data to server
-func toServer(config config.Config, wsconn net.Conn, iFace *water.Interface) {
+// toServer sends data to server, the early data of the handshake is the first packet if not nil,
+// the binary frames of a batched conn are batches both ways
+func toServer(config config.Config, wsconn net.Conn, iFace *water.Interface, identity string, early []byte, batched bool) {
 	defer wsconn.Close()
+	batchSize := 0
+	if batched {
+		batchSize = config.BatchSize
+	}
+	queue := xchan.NewBatchQueue(config.SendQueueSize, xchan.ParseDropPolicy(config.DropPolicy), batchSize, xchan.BatchDelay(config), func(batch [][]byte) error {
+		for _, frame := range serverFrames(batch, batched) {
+			n, err := wsconn.Write(ws.MustCompileFrame(frame))
+			if err != nil {
+				netutil.PrintErr(err, config.Verbose)
+				wsconn.Close()
+				return err
+			}
+			counter.IncrWrittenBytes(n)
+		}
+		return nil
+	})
+	defer queue.Close()
+	peer := cache.NewPeer(queue)
+	defer peer.Evict()
+	peer.SetIdentity(identity)
+	binary := func(b []byte) {
+		if config.Compress {
+			b, _ = snappy.Decode(nil, b)
+		}
+		if config.Obfs {
+			b = cipher.XOR(b)
+		}
+		if key := netutil.GetSrcKey(b); key != "" {
+			if !peer.Route(key) {
+				netutil.PrintErrF(config.Verbose, "%v is owned by another client, dropped\n", key)
+				return
+			}
+			counter.IncrReadBytes(len(b))
+			iFace.Write(b)
+		}
+	}
+	if early != nil {
+		// the early data is a single packet
+		binary(early)
+	}
 	for {
+		wsconn.SetReadDeadline(xalive.Deadline(config))
 		b, op, err := wsutil.ReadClientData(wsconn)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -193,19 +309,38 @@ func toServer(config config.Config, wsconn net.Conn, iFace *water.Interface) {
 			if config.Verbose {
 				log.Println(string(b[:]))
 			}
-			wsutil.WriteServerMessage(wsconn, op, b)
-		} else if op == ws.OpBinary {
-			if config.Compress {
-				b, _ = snappy.Decode(nil, b)
-			}
-			if config.Obfs {
-				b = cipher.XOR(b)
+			queue.Push(nil)
+		} else if op == ws.OpBinary && batched {
+			packets, err := xproto.DecodeBatch(b)
+			if err != nil {
+				netutil.PrintErr(err, config.Verbose)
+				break
 			}
-			if key := netutil.GetSrcKey(b); key != "" {
-				cache.GetCache().Set(key, wsconn, 24*time.Hour)
-				counter.IncrReadBytes(len(b))
-				iFace.Write(b)
+			for _, b := range packets {
+				binary(b)
 			}
+		} else if op == ws.OpBinary {
+			binary(b)
 		}
 	}
 }
+
+// serverFrames returns the frames of the queued packets, nil is the reply of a keepalive,
+// the packets to a batched conn go in one frame
+func serverFrames(batch [][]byte, batched bool) []ws.Frame {
+	var frames []ws.Frame
+	var packets [][]byte
+	for _, b := range batch {
+		if b == nil {
+			frames = append(frames, ws.NewTextFrame([]byte(keepAliveText)))
+		} else if batched {
+			packets = append(packets, b)
+		} else {
+			frames = append(frames, ws.NewBinaryFrame(b))
+		}
+	}
+	if len(packets) > 0 {
+		frames = append(frames, ws.NewBinaryFrame(xproto.EncodeBatch(packets)))
+	}
+	return frames
+}